@@ -0,0 +1,193 @@
+package batch
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format is the encoding of a job list.
+type Format string
+
+const (
+	FormatJSON Format = "json"
+	FormatCSV  Format = "csv"
+)
+
+var csvHeader = []string{"containerId", "bundlePath", "outputFile"}
+
+// Job is a single container to export.
+type Job struct {
+	ContainerId string `json:"containerId"`
+	BundlePath  string `json:"bundlePath"`
+	OutputFile  string `json:"outputFile"`
+}
+
+// Output describes a layer written by an ExportFunc.
+type Output struct {
+	Digest string
+	Size   int64
+}
+
+// ExportFunc exports a single job's layer.
+type ExportFunc func(ctx context.Context, job Job) (Output, error)
+
+// Result is the outcome of a single job.
+type Result struct {
+	Job
+	Digest   string  `json:"digest,omitempty"`
+	Size     int64   `json:"size,omitempty"`
+	Duration float64 `json:"durationSeconds"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Summary is the outcome of a batch, with Results in the same order as the
+// jobs that were run.
+type Summary struct {
+	Total     int      `json:"total"`
+	Succeeded int      `json:"succeeded"`
+	Failed    int      `json:"failed"`
+	Results   []Result `json:"results"`
+}
+
+// ReadJobs parses a job list. JSON input is an array of jobs; CSV input has
+// one containerId,bundlePath,outputFile row per job and an optional header.
+func ReadJobs(r io.Reader, format Format) ([]Job, error) {
+	var jobs []Job
+	switch format {
+	case FormatJSON:
+		if err := json.NewDecoder(r).Decode(&jobs); err != nil {
+			return nil, fmt.Errorf("Error parsing json job list: %w", err)
+		}
+	case FormatCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = len(csvHeader)
+		reader.TrimLeadingSpace = true
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing csv job list: %w", err)
+		}
+		if len(records) > 0 && isHeader(records[0]) {
+			records = records[1:]
+		}
+		for _, record := range records {
+			jobs = append(jobs, Job{ContainerId: record[0], BundlePath: record[1], OutputFile: record[2]})
+		}
+	default:
+		return nil, fmt.Errorf("unknown job list format %q", format)
+	}
+
+	// Jobs run concurrently, so two for the same container would unprepare
+	// it at once and two for the same output file would replace each
+	// other's layer. Windows paths and container ids ignore case.
+	containers := map[string]int{}
+	outputs := map[string]int{}
+	for i, job := range jobs {
+		if err := job.validate(); err != nil {
+			return nil, fmt.Errorf("job %d: %w", i+1, err)
+		}
+		if other, ok := containers[strings.ToLower(job.ContainerId)]; ok {
+			return nil, fmt.Errorf("job %d: container %s is already exported by job %d", i+1, job.ContainerId, other)
+		}
+		containers[strings.ToLower(job.ContainerId)] = i + 1
+		output := strings.ToLower(filepath.Clean(job.OutputFile))
+		if other, ok := outputs[output]; ok {
+			return nil, fmt.Errorf("job %d: output file %s is already written by job %d", i+1, job.OutputFile, other)
+		}
+		outputs[output] = i + 1
+	}
+	return jobs, nil
+}
+
+func isHeader(record []string) bool {
+	for i, field := range record {
+		if !strings.EqualFold(field, csvHeader[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (j Job) validate() error {
+	if j.ContainerId == "" {
+		return errors.New("must provide container id")
+	}
+	if j.BundlePath == "" {
+		return errors.New("must provide bundle path")
+	}
+	if j.OutputFile == "" {
+		return errors.New("must provide output file")
+	}
+	return nil
+}
+
+// Run exports jobs with at most concurrency exports in flight. Jobs that have
+// not started when ctx is done fail with ctx's error.
+func Run(ctx context.Context, jobs []Job, concurrency int, export ExportFunc) Summary {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]Result, len(jobs))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		if !acquire(ctx, slots) {
+			results[i] = Result{Job: job, Error: ctx.Err().Error()}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, job Job) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = runJob(ctx, job, export)
+		}(i, job)
+	}
+	wg.Wait()
+
+	summary := Summary{Total: len(jobs), Results: results}
+	for _, result := range results {
+		if result.Error == "" {
+			summary.Succeeded++
+		} else {
+			summary.Failed++
+		}
+	}
+	return summary
+}
+
+func acquire(ctx context.Context, slots chan struct{}) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func runJob(ctx context.Context, job Job, export ExportFunc) Result {
+	start := time.Now()
+	output, err := export(ctx, job)
+	result := Result{
+		Job:      job,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Digest = output.Digest
+	result.Size = output.Size
+	return result
+}
@@ -0,0 +1,136 @@
+package batch_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/diff-exporter/batch"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ReadJobs", func() {
+	It("reads a json job list", func() {
+		jobs, err := batch.ReadJobs(strings.NewReader(`[
+			{"containerId": "a", "bundlePath": "C:\\bundles\\a", "outputFile": "C:\\out\\a.tgz"},
+			{"containerId": "b", "bundlePath": "C:\\bundles\\b", "outputFile": "C:\\out\\b.tgz"}
+		]`), batch.FormatJSON)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(jobs).To(Equal([]batch.Job{
+			{ContainerId: "a", BundlePath: `C:\bundles\a`, OutputFile: `C:\out\a.tgz`},
+			{ContainerId: "b", BundlePath: `C:\bundles\b`, OutputFile: `C:\out\b.tgz`},
+		}))
+	})
+
+	It("reads a csv job list with a header", func() {
+		jobs, err := batch.ReadJobs(strings.NewReader("containerId,bundlePath,outputFile\na, C:\\bundles\\a, C:\\out\\a.tgz\n"), batch.FormatCSV)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(jobs).To(Equal([]batch.Job{{ContainerId: "a", BundlePath: `C:\bundles\a`, OutputFile: `C:\out\a.tgz`}}))
+	})
+
+	It("reads a csv job list without a header", func() {
+		jobs, err := batch.ReadJobs(strings.NewReader("a,C:\\bundles\\a,C:\\out\\a.tgz\nb,C:\\bundles\\b,C:\\out\\b.tgz\n"), batch.FormatCSV)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(jobs).To(HaveLen(2))
+		Expect(jobs[1].ContainerId).To(Equal("b"))
+	})
+
+	DescribeTable("invalid job lists",
+		func(input string, format batch.Format, expected string) {
+			_, err := batch.ReadJobs(strings.NewReader(input), format)
+			Expect(err).To(MatchError(ContainSubstring(expected)))
+		},
+		Entry("malformed json", `[{"containerId":`, batch.FormatJSON, "Error parsing json job list"),
+		Entry("a csv row with too few fields", "a,C:\\bundles\\a\n", batch.FormatCSV, "Error parsing csv job list"),
+		Entry("a job without a container id", `[{"bundlePath": "b", "outputFile": "o"}]`, batch.FormatJSON, "job 1: must provide container id"),
+		Entry("a job without a bundle path", "a,,o\n", batch.FormatCSV, "job 1: must provide bundle path"),
+		Entry("a job without an output file", `[{"containerId": "a", "bundlePath": "b"}]`, batch.FormatJSON, "job 1: must provide output file"),
+		Entry("an unknown format", `[]`, batch.Format("yaml"), "unknown job list format"),
+		Entry("two jobs for the same container", "a,b,o1\nA,b,o2\n", batch.FormatCSV, "job 2: container A is already exported by job 1"),
+		Entry("two jobs writing the same output file", "a,b,C:\\out\\a.tgz\nb,b,c:\\OUT\\a.tgz\n", batch.FormatCSV, "job 2: output file c:\\OUT\\a.tgz is already written by job 1"),
+	)
+})
+
+var _ = Describe("Run", func() {
+	var jobs []batch.Job
+
+	BeforeEach(func() {
+		jobs = []batch.Job{
+			{ContainerId: "a", BundlePath: "bundle-a", OutputFile: "a.tgz"},
+			{ContainerId: "b", BundlePath: "bundle-b", OutputFile: "b.tgz"},
+			{ContainerId: "c", BundlePath: "bundle-c", OutputFile: "c.tgz"},
+			{ContainerId: "d", BundlePath: "bundle-d", OutputFile: "d.tgz"},
+		}
+	})
+
+	It("reports every job's result in order", func() {
+		summary := batch.Run(context.Background(), jobs, 2, func(_ context.Context, job batch.Job) (batch.Output, error) {
+			if job.ContainerId == "c" {
+				return batch.Output{}, errors.New("c is broken")
+			}
+			return batch.Output{Digest: "sha256:" + job.ContainerId, Size: 42}, nil
+		})
+
+		Expect(summary.Total).To(Equal(4))
+		Expect(summary.Succeeded).To(Equal(3))
+		Expect(summary.Failed).To(Equal(1))
+		Expect(summary.Results).To(HaveLen(4))
+		for i, result := range summary.Results {
+			Expect(result.Job).To(Equal(jobs[i]))
+		}
+		Expect(summary.Results[0].Digest).To(Equal("sha256:a"))
+		Expect(summary.Results[0].Size).To(Equal(int64(42)))
+		Expect(summary.Results[2].Error).To(Equal("c is broken"))
+		Expect(summary.Results[2].Digest).To(BeEmpty())
+	})
+
+	It("runs no more than the concurrency limit at once", func() {
+		var running, maxRunning int32
+		summary := batch.Run(context.Background(), jobs, 2, func(context.Context, batch.Job) (batch.Output, error) {
+			now := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if now <= max || atomic.CompareAndSwapInt32(&maxRunning, max, now) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			return batch.Output{}, nil
+		})
+
+		Expect(summary.Succeeded).To(Equal(4))
+		Expect(atomic.LoadInt32(&maxRunning)).To(Equal(int32(2)))
+	})
+
+	It("runs jobs one at a time when the limit is not positive", func() {
+		var mu sync.Mutex
+		var order []string
+		batch.Run(context.Background(), jobs, 0, func(_ context.Context, job batch.Job) (batch.Output, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, job.ContainerId)
+			return batch.Output{}, nil
+		})
+
+		Expect(order).To(Equal([]string{"a", "b", "c", "d"}))
+	})
+
+	It("fails jobs that have not started once the context is cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		summary := batch.Run(ctx, jobs, 1, func(_ context.Context, job batch.Job) (batch.Output, error) {
+			if job.ContainerId == "b" {
+				cancel()
+			}
+			return batch.Output{}, nil
+		})
+
+		Expect(summary.Succeeded).To(Equal(2))
+		Expect(summary.Failed).To(Equal(2))
+		Expect(summary.Results[3].Error).To(Equal(context.Canceled.Error()))
+	})
+})
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/diff-exporter/batch"
+	"code.cloudfoundry.org/diff-exporter/layer"
+	"code.cloudfoundry.org/diff-exporter/metrics"
+)
+
+const (
+	batchCommand = "batch"
+	batchUsage   = "USAGE: diff-exporter.exe batch <-jobs jobsFile> [-format json|csv] [-concurrency concurrency] [-summaryFile summaryFile] [-noClobber] [-reprepare] [-errorFormat text|json] [-metricsFile metricsFile]"
+)
+
+type batchConfig struct {
+	jobsFile    string
+	format      string
+	concurrency int
+	summaryFile string
+	noClobber   bool
+	reprepare   bool
+	errorFormat string
+	metricsFile string
+}
+
+// runBatch exports every container in a job list and writes a summary of
+// the results as json, exiting with exitBatchFailed if any export failed.
+func runBatch(args []string) {
+	cfg, err := parseBatchFlags(args)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, batchUsage)
+		os.Exit(0)
+	}
+	reporter := errorReporter{format: cfg.errorFormat, usage: batchUsage}
+	if err != nil {
+		reporter.exit(&stageError{stage: stageFlags, err: fmt.Errorf("Error parsing flags: %w", err)})
+	}
+
+	jobs, err := readJobs(cfg.jobsFile, batch.Format(cfg.format))
+	if err != nil {
+		reporter.exit(&stageError{stage: stageFlags, err: fmt.Errorf("Error reading jobs: %w", err)})
+	}
+	// Fail before exporting anything rather than once the summary is due.
+	if cfg.noClobber && cfg.summaryFile != "" {
+		if err := checkNotExists(cfg.summaryFile); err != nil {
+			reporter.exit(&stageError{stage: stageWrite, err: err})
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	recorder := metrics.NewRecorder()
+	summary := batch.Run(ctx, jobs, cfg.concurrency, func(ctx context.Context, job batch.Job) (batch.Output, error) {
+		exporter := layer.New(job.ContainerId, job.BundlePath)
+		start := time.Now()
+		result, err := writeTgzFile(ctx, exporter, layer.Options{Reprepare: cfg.reprepare}, job.OutputFile, cfg.noClobber)
+		recorder.Record(exportMetrics(result, time.Since(start), err))
+		if err != nil {
+			return batch.Output{}, err
+		}
+		return batch.Output{Digest: result.Digest, Size: result.Size}, nil
+	})
+
+	if err := writeSummary(cfg.summaryFile, cfg.noClobber, summary); err != nil {
+		reporter.exit(&stageError{stage: stageWrite, err: fmt.Errorf("Error writing summary: %w", err)})
+	}
+	if cfg.metricsFile != "" {
+		if err := writeMetricsFile(cfg.metricsFile, recorder); err != nil {
+			reporter.exit(&stageError{stage: stageWrite, err: fmt.Errorf("Error writing metrics file: %w", err)})
+		}
+	}
+	if summary.Failed > 0 {
+		os.Exit(exitBatchFailed)
+	}
+}
+
+func parseBatchFlags(args []string) (batchConfig, error) {
+	var cfg batchConfig
+	flags := flag.NewFlagSet("diff-exporter batch", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&cfg.jobsFile, "jobs", "", "File listing the containerId, bundlePath and outputFile of each export, or - to read it from stdin")
+	flags.StringVar(&cfg.format, "format", "", "Format of the jobs file: json or csv (default csv for .csv files, json otherwise)")
+	flags.IntVar(&cfg.concurrency, "concurrency", 1, "Maximum number of containers to export at once")
+	flags.StringVar(&cfg.summaryFile, "summaryFile", "", "File to save the json summary of the results (default stdout)")
+	flags.BoolVar(&cfg.noClobber, "noClobber", false, "Refuse to overwrite existing output files, including the summary file")
+	flags.BoolVar(&cfg.reprepare, "reprepare", false, "Prepare each container's layer again after exporting it so the containers can keep running")
+	flags.StringVar(&cfg.errorFormat, "errorFormat", errorFormatText, "How to report errors on stderr: text or json")
+	flags.StringVar(&cfg.metricsFile, "metricsFile", "", "File to save metrics about the exports to in the Prometheus text format, e.g. for node_exporter's textfile collector")
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if err := checkErrorFormat(&cfg.errorFormat); err != nil {
+		return cfg, err
+	}
+	if cfg.jobsFile == "" {
+		return cfg, errors.New("must provide jobs file listing the containers to export")
+	}
+	if cfg.concurrency < 1 {
+		return cfg, errors.New("concurrency must be at least 1")
+	}
+	if cfg.format == "" {
+		cfg.format = string(batch.FormatJSON)
+		if strings.EqualFold(filepath.Ext(cfg.jobsFile), ".csv") {
+			cfg.format = string(batch.FormatCSV)
+		}
+	}
+
+	return cfg, nil
+}
+
+func readJobs(jobsFile string, format batch.Format) ([]batch.Job, error) {
+	var r io.Reader = os.Stdin
+	if jobsFile != stdinFile {
+		f, err := os.Open(jobsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	jobs, err := batch.ReadJobs(r, format)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		// Layers from concurrent exports can't share stdout with the summary.
+		if job.OutputFile == stdoutFile {
+			return nil, fmt.Errorf("container %s: output file can't be stdout in a batch", job.ContainerId)
+		}
+	}
+	return jobs, nil
+}
+
+func writeSummary(summaryFile string, noClobber bool, summary batch.Summary) error {
+	if summaryFile == "" {
+		return writeJSON(os.Stdout, summary)
+	}
+
+	return writeFileAtomically(summaryFile, noClobber, func(w io.Writer) error {
+		return writeJSON(w, summary)
+	})
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"code.cloudfoundry.org/diff-exporter/posix"
+)
+
+const (
+	convertCommand = "convert"
+	convertUsage   = "USAGE: diff-exporter.exe convert <-inputFile layerFile> <-outputFile outputFile> [-noClobber] [-errorFormat text|json]"
+)
+
+type convertConfig struct {
+	inputFile   string
+	outputFile  string
+	noClobber   bool
+	errorFormat string
+}
+
+// runConvert rewrites an exported layer as a plain POSIX tar, exiting with
+// exitConvert if it can't.
+func runConvert(args []string) {
+	cfg, err := parseConvertFlags(args)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, convertUsage)
+		os.Exit(0)
+	}
+	reporter := errorReporter{format: cfg.errorFormat, usage: convertUsage}
+	if err != nil {
+		reporter.exit(&stageError{stage: stageFlags, err: fmt.Errorf("Error parsing flags: %w", err)})
+	}
+
+	if err := convertLayer(cfg); err != nil {
+		reporter.exit(err)
+	}
+}
+
+func convertLayer(cfg convertConfig) error {
+	input, err := os.Open(cfg.inputFile)
+	if err != nil {
+		return &stageError{stage: stageConvert, err: fmt.Errorf("Error reading layer: %w", err)}
+	}
+	defer input.Close()
+
+	var result posix.Result
+	err = writeFileAtomically(cfg.outputFile, cfg.noClobber, func(w io.Writer) error {
+		if result, err = posix.Convert(w, input); err != nil {
+			return &stageError{stage: stageConvert, err: fmt.Errorf("Error converting layer: %w", err)}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Converted %d entries, left out %d entries outside Files and %d alternate data streams\n", result.Entries, result.Skipped, result.Streams)
+	return nil
+}
+
+func parseConvertFlags(args []string) (convertConfig, error) {
+	var cfg convertConfig
+	flags := flag.NewFlagSet("diff-exporter convert", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&cfg.inputFile, "inputFile", "", "Exported layer to convert, which may be gzipped")
+	flags.StringVar(&cfg.outputFile, "outputFile", "", "File to save the POSIX tar to")
+	flags.BoolVar(&cfg.noClobber, "noClobber", false, "Refuse to overwrite an existing output file")
+	flags.StringVar(&cfg.errorFormat, "errorFormat", errorFormatText, "How to report errors on stderr: text or json")
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if err := checkErrorFormat(&cfg.errorFormat); err != nil {
+		return cfg, err
+	}
+	if cfg.inputFile == "" {
+		return cfg, errors.New("must provide layer to convert")
+	}
+	if cfg.outputFile == "" {
+		return cfg, errors.New("must provide output file to save converted layer")
+	}
+
+	return cfg, nil
+}
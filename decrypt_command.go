@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"code.cloudfoundry.org/diff-exporter/encryption"
+)
+
+const (
+	decryptCommand = "decrypt"
+	decryptUsage   = "USAGE: diff-exporter.exe decrypt <-key privateKeyFile> <-descriptor descriptorFile> <-inputFile encryptedLayer> <-outputFile outputFile> [-noClobber] [-errorFormat text|json]"
+)
+
+type decryptConfig struct {
+	keyFile        string
+	descriptorFile string
+	inputFile      string
+	outputFile     string
+	noClobber      bool
+	errorFormat    string
+}
+
+// runDecrypt decrypts a layer exported with -encryptionKey, exiting with
+// exitDecrypt if it can't.
+func runDecrypt(args []string) {
+	cfg, err := parseDecryptFlags(args)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, decryptUsage)
+		os.Exit(0)
+	}
+	reporter := errorReporter{format: cfg.errorFormat, usage: decryptUsage}
+	if err != nil {
+		reporter.exit(&stageError{stage: stageFlags, err: fmt.Errorf("Error parsing flags: %w", err)})
+	}
+
+	if err := decryptLayer(cfg); err != nil {
+		reporter.exit(err)
+	}
+}
+
+// decryptLayer only moves the decrypted layer into place once it has been
+// authenticated.
+func decryptLayer(cfg decryptConfig) error {
+	pemBytes, err := os.ReadFile(cfg.keyFile)
+	if err != nil {
+		return &stageError{stage: stageDecrypt, err: fmt.Errorf("Error reading private key: %w", err)}
+	}
+	key, err := encryption.LoadPrivateKey(pemBytes)
+	if err != nil {
+		return &stageError{stage: stageDecrypt, err: fmt.Errorf("Error loading private key: %w", err)}
+	}
+	descriptorJSON, err := os.ReadFile(cfg.descriptorFile)
+	if err != nil {
+		return &stageError{stage: stageDecrypt, err: fmt.Errorf("Error reading descriptor: %w", err)}
+	}
+	var desc encryption.Descriptor
+	if err := json.Unmarshal(descriptorJSON, &desc); err != nil {
+		return &stageError{stage: stageDecrypt, err: fmt.Errorf("Error reading descriptor: %w: %w", encryption.ErrInvalidDescriptor, err)}
+	}
+
+	input, err := os.Open(cfg.inputFile)
+	if err != nil {
+		return &stageError{stage: stageDecrypt, err: fmt.Errorf("Error reading encrypted layer: %w", err)}
+	}
+	defer input.Close()
+
+	return writeFileAtomically(cfg.outputFile, cfg.noClobber, func(w io.Writer) error {
+		if err := encryption.Decrypt(w, input, desc, key); err != nil {
+			return &stageError{stage: stageDecrypt, err: fmt.Errorf("Error decrypting layer: %w", err)}
+		}
+		return nil
+	})
+}
+
+func parseDecryptFlags(args []string) (decryptConfig, error) {
+	var cfg decryptConfig
+	flags := flag.NewFlagSet("diff-exporter decrypt", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&cfg.keyFile, "key", "", "PEM encoded RSA or ECDSA private key of a recipient the layer was encrypted for")
+	flags.StringVar(&cfg.descriptorFile, "descriptor", "", "Descriptor written with the encrypted layer")
+	flags.StringVar(&cfg.inputFile, "inputFile", "", "Encrypted layer to decrypt")
+	flags.StringVar(&cfg.outputFile, "outputFile", "", "File to save the decrypted layer to")
+	flags.BoolVar(&cfg.noClobber, "noClobber", false, "Refuse to overwrite an existing output file")
+	flags.StringVar(&cfg.errorFormat, "errorFormat", errorFormatText, "How to report errors on stderr: text or json")
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if err := checkErrorFormat(&cfg.errorFormat); err != nil {
+		return cfg, err
+	}
+	if cfg.keyFile == "" {
+		return cfg, errors.New("must provide private key to decrypt the layer with")
+	}
+	if cfg.descriptorFile == "" {
+		return cfg, errors.New("must provide descriptor file")
+	}
+	if cfg.inputFile == "" {
+		return cfg, errors.New("must provide encrypted layer to decrypt")
+	}
+	if cfg.outputFile == "" {
+		return cfg, errors.New("must provide output file to save decrypted layer")
+	}
+
+	return cfg, nil
+}
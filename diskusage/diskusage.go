@@ -0,0 +1,263 @@
+// Package diskusage reports where the size of a layer goes, like du: the
+// cumulative size of its directories, its largest files and the size of
+// each type of file.
+package diskusage
+
+import (
+	"archive/tar"
+	"container/heap"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
+)
+
+const (
+	DefaultDepth = 3
+	DefaultTop   = 10
+)
+
+// Options controls how detailed a report is.
+type Options struct {
+	// Depth is how many levels of directories are reported, counting the
+	// layer's Files folder as the first. Zero uses DefaultDepth.
+	Depth int
+	// Top is how many of the largest files and file types are reported.
+	// Zero uses DefaultTop.
+	Top int
+}
+
+// Report is where the size of a layer's files goes. Sizes are those of the
+// files' content, without the tar headers or compression.
+type Report struct {
+	Size      int64 `json:"size"`
+	Files     int   `json:"files"`
+	Whiteouts int   `json:"whiteouts"`
+	// Depth is the number of levels of Directories.
+	Depth        int         `json:"depth"`
+	Directories  []Directory `json:"directories"`
+	LargestFiles []File      `json:"largestFiles"`
+	Types        []Type      `json:"types"`
+
+	top         int
+	directories map[string]*Directory
+	largest     fileHeap
+	types       map[string]*Type
+}
+
+// Directory is the cumulative size of the files under a directory.
+type Directory struct {
+	Path  string `json:"path"`
+	Files int    `json:"files"`
+	Size  int64  `json:"size"`
+}
+
+type File struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// Type is the size of the files with an extension, which is empty for
+// files without one.
+type Type struct {
+	Extension string `json:"extension"`
+	Files     int    `json:"files"`
+	Size      int64  `json:"size"`
+}
+
+func New(opts Options) *Report {
+	if opts.Depth == 0 {
+		opts.Depth = DefaultDepth
+	}
+	if opts.Top == 0 {
+		opts.Top = DefaultTop
+	}
+	return &Report{
+		Depth:        opts.Depth,
+		Directories:  []Directory{},
+		LargestFiles: []File{},
+		Types:        []Type{},
+		top:          opts.Top,
+		directories:  map[string]*Directory{},
+		types:        map[string]*Type{},
+	}
+}
+
+// Add counts entry towards the report.
+func (r *Report) Add(entry layerfmt.Entry) {
+	if entry.Whiteout {
+		r.Whiteouts++
+		return
+	}
+
+	parts := strings.Split(entry.Path, "/")
+	dirs := parts[:len(parts)-1]
+	if entry.Dir {
+		dirs = parts
+	}
+	for i := 1; i <= len(dirs) && i <= r.Depth; i++ {
+		r.directory(strings.Join(dirs[:i], "/"))
+	}
+	if entry.Dir {
+		return
+	}
+
+	r.Files++
+	r.Size += entry.Size
+	for i := 1; i <= len(dirs) && i <= r.Depth; i++ {
+		dir := r.directory(strings.Join(dirs[:i], "/"))
+		dir.Files++
+		dir.Size += entry.Size
+	}
+
+	ext := strings.ToLower(path.Ext(entry.Path))
+	t, ok := r.types[ext]
+	if !ok {
+		t = &Type{Extension: ext}
+		r.types[ext] = t
+	}
+	t.Files++
+	t.Size += entry.Size
+
+	heap.Push(&r.largest, File{Path: entry.Path, Size: entry.Size})
+	if r.largest.Len() > r.top {
+		heap.Pop(&r.largest)
+	}
+}
+
+// directory returns the directory at p, adding it if it hasn't been seen.
+// Windows paths are case insensitive.
+func (r *Report) directory(p string) *Directory {
+	key := strings.ToLower(p)
+	dir, ok := r.directories[key]
+	if !ok {
+		dir = &Directory{Path: p}
+		r.directories[key] = dir
+	}
+	return dir
+}
+
+// Finish lists the directories, files and types largest first, once every
+// entry has been added.
+func (r *Report) Finish() {
+	r.Directories = make([]Directory, 0, len(r.directories))
+	for _, dir := range r.directories {
+		r.Directories = append(r.Directories, *dir)
+	}
+	sort.Slice(r.Directories, func(i, j int) bool {
+		return larger(r.Directories[i].Size, r.Directories[j].Size, r.Directories[i].Path, r.Directories[j].Path)
+	})
+
+	r.LargestFiles = append([]File{}, r.largest...)
+	sort.Slice(r.LargestFiles, func(i, j int) bool {
+		return larger(r.LargestFiles[i].Size, r.LargestFiles[j].Size, r.LargestFiles[i].Path, r.LargestFiles[j].Path)
+	})
+
+	r.Types = make([]Type, 0, len(r.types))
+	for _, t := range r.types {
+		r.Types = append(r.Types, *t)
+	}
+	sort.Slice(r.Types, func(i, j int) bool {
+		return larger(r.Types[i].Size, r.Types[j].Size, r.Types[i].Extension, r.Types[j].Extension)
+	})
+	if len(r.Types) > r.top {
+		r.Types = r.Types[:r.top]
+	}
+}
+
+// larger orders by size, largest first, then by name.
+func larger(size1, size2 int64, name1, name2 string) bool {
+	if size1 != size2 {
+		return size1 > size2
+	}
+	return name1 < name2
+}
+
+// ReadTar adds every entry of an exported layer, which may be gzipped, to
+// the report. Only the size of a file's data is counted, as for the entries
+// of an export: its alternate data streams, which backuptar writes as
+// entries of their own right after it, are left out.
+func (r *Report) ReadTar(layer io.Reader) error {
+	input, _, err := layerfmt.Decompress(layer)
+	if err != nil {
+		return err
+	}
+
+	t := tar.NewReader(input)
+	var file string
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(hdr.Name, "/")
+		if file != "" && hdr.Typeflag == tar.TypeReg && strings.HasPrefix(name, file+":") {
+			continue
+		}
+
+		dir, base := path.Split(name)
+		entry := layerfmt.Entry{Path: name, Dir: hdr.Typeflag == tar.TypeDir}
+		switch {
+		case strings.HasPrefix(base, layerfmt.WhiteoutPrefix):
+			entry = layerfmt.Entry{Path: dir + strings.TrimPrefix(base, layerfmt.WhiteoutPrefix), Change: layerfmt.ChangeDeleted, Whiteout: true}
+		case hdr.Typeflag == tar.TypeReg:
+			entry.Size = hdr.Size
+		}
+		file = entry.Path
+		r.Add(entry)
+	}
+	return nil
+}
+
+// WriteText writes the report as tables, once it has been finished.
+func (r *Report) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "Total: %s in %d files, %d whiteouts\n\n", layerfmt.FormatSize(r.Size), r.Files, r.Whiteouts)
+
+	t := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(t, "SIZE\tFILES\tDIRECTORY")
+	for _, dir := range r.Directories {
+		fmt.Fprintf(t, "%s\t%d\t%s\n", layerfmt.FormatSize(dir.Size), dir.Files, dir.Path)
+	}
+	fmt.Fprintln(t)
+	fmt.Fprintln(t, "SIZE\tLARGEST FILES")
+	for _, file := range r.LargestFiles {
+		fmt.Fprintf(t, "%s\t%s\n", layerfmt.FormatSize(file.Size), file.Path)
+	}
+	fmt.Fprintln(t)
+	fmt.Fprintln(t, "SIZE\tFILES\tTYPE")
+	for _, typ := range r.Types {
+		ext := typ.Extension
+		if ext == "" {
+			ext = "(none)"
+		}
+		fmt.Fprintf(t, "%s\t%d\t%s\n", layerfmt.FormatSize(typ.Size), typ.Files, ext)
+	}
+	return t.Flush()
+}
+
+// fileHeap is a min-heap of files by size, holding the largest ones seen.
+type fileHeap []File
+
+func (h fileHeap) Len() int { return len(h) }
+func (h fileHeap) Less(i, j int) bool {
+	return larger(h[j].Size, h[i].Size, h[j].Path, h[i].Path)
+}
+func (h fileHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *fileHeap) Push(x interface{}) {
+	*h = append(*h, x.(File))
+}
+
+func (h *fileHeap) Pop() interface{} {
+	old := *h
+	f := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return f
+}
@@ -0,0 +1,13 @@
+package diskusage_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestDiskusage(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Diskusage Suite")
+}
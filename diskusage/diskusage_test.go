@@ -0,0 +1,165 @@
+package diskusage_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"strings"
+
+	"code.cloudfoundry.org/diff-exporter/diskusage"
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func layerTar(headers ...*tar.Header) []byte {
+	var buf bytes.Buffer
+	t := tar.NewWriter(&buf)
+	for _, hdr := range headers {
+		ExpectWithOffset(1, t.WriteHeader(hdr)).To(Succeed())
+		_, err := t.Write(bytes.Repeat([]byte("x"), int(hdr.Size)))
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	}
+	ExpectWithOffset(1, t.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+func file(name string, size int64) *tar.Header {
+	return &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size}
+}
+
+func dir(name string) *tar.Header {
+	return &tar.Header{Typeflag: tar.TypeDir, Name: name}
+}
+
+var _ = Describe("Report", func() {
+	var report *diskusage.Report
+
+	BeforeEach(func() {
+		report = diskusage.New(diskusage.Options{Depth: 2, Top: 2})
+		for _, entry := range []layerfmt.Entry{
+			{Path: "Files", Dir: true},
+			{Path: "Files/Windows", Dir: true},
+			{Path: "Files/Windows/System32/big.dll", Size: 3000},
+			{Path: "Files/Windows/System32/small.DLL", Size: 100},
+			{Path: "Files/windows/notepad.exe", Size: 200},
+			{Path: "Files/Users", Dir: true},
+			{Path: "Files/hello", Size: 5},
+			{Path: "Files/deleted.txt", Change: layerfmt.ChangeDeleted, Whiteout: true},
+			{Path: "Hives/DefaultUser_Delta", Size: 1000},
+		} {
+			report.Add(entry)
+		}
+		report.Finish()
+	})
+
+	It("counts the files and whiteouts", func() {
+		Expect(report.Files).To(Equal(5))
+		Expect(report.Whiteouts).To(Equal(1))
+		Expect(report.Size).To(BeEquivalentTo(4305))
+		Expect(report.Depth).To(Equal(2))
+	})
+
+	It("sums the files under each directory up to the depth, largest first", func() {
+		Expect(report.Directories).To(Equal([]diskusage.Directory{
+			{Path: "Files", Files: 4, Size: 3305},
+			{Path: "Files/Windows", Files: 3, Size: 3300},
+			{Path: "Hives", Files: 1, Size: 1000},
+			{Path: "Files/Users"},
+		}))
+	})
+
+	It("lists the largest files", func() {
+		Expect(report.LargestFiles).To(Equal([]diskusage.File{
+			{Path: "Files/Windows/System32/big.dll", Size: 3000},
+			{Path: "Hives/DefaultUser_Delta", Size: 1000},
+		}))
+	})
+
+	It("sums the largest file types, ignoring the case of extensions", func() {
+		Expect(report.Types).To(Equal([]diskusage.Type{
+			{Extension: ".dll", Files: 2, Size: 3100},
+			{Extension: "", Files: 2, Size: 1005},
+		}))
+	})
+
+	It("uses the default depth and number of files", func() {
+		report := diskusage.New(diskusage.Options{})
+		for i := 0; i < 20; i++ {
+			report.Add(layerfmt.Entry{Path: strings.Repeat("dir/", 5) + strings.Repeat("f", i+1), Size: int64(i)})
+		}
+		report.Finish()
+
+		Expect(report.Depth).To(Equal(diskusage.DefaultDepth))
+		Expect(report.Directories).To(HaveLen(diskusage.DefaultDepth))
+		Expect(report.LargestFiles).To(HaveLen(diskusage.DefaultTop))
+		Expect(report.LargestFiles[0].Size).To(BeEquivalentTo(19))
+	})
+
+	It("writes tables", func() {
+		var out bytes.Buffer
+		Expect(report.WriteText(&out)).To(Succeed())
+
+		Expect(out.String()).To(Equal(`Total: 4.2 KiB in 5 files, 1 whiteouts
+
+SIZE     FILES  DIRECTORY
+3.2 KiB  4      Files
+3.2 KiB  3      Files/Windows
+1000 B   1      Hives
+0 B      0      Files/Users
+
+SIZE     LARGEST FILES
+2.9 KiB  Files/Windows/System32/big.dll
+1000 B   Hives/DefaultUser_Delta
+
+SIZE     FILES  TYPE
+3.0 KiB  2      .dll
+1005 B   2      (none)
+`))
+	})
+
+	Describe("ReadTar", func() {
+		var layer []byte
+
+		BeforeEach(func() {
+			link := &tar.Header{Typeflag: tar.TypeLink, Name: "Files/copy.exe", Linkname: "Files/app.exe"}
+			layer = layerTar(
+				dir("Files"),
+				file("Files/app.exe", 300),
+				file("Files/app.exe:Zone.Identifier", 20),
+				link,
+				file("Files/.wh.deleted.txt", 0),
+			)
+			report = diskusage.New(diskusage.Options{})
+		})
+
+		It("adds the entries of an exported layer without their alternate data streams", func() {
+			Expect(report.ReadTar(bytes.NewReader(layer))).To(Succeed())
+			report.Finish()
+
+			Expect(report.Files).To(Equal(2))
+			Expect(report.Whiteouts).To(Equal(1))
+			Expect(report.LargestFiles).To(Equal([]diskusage.File{
+				{Path: "Files/app.exe", Size: 300},
+				{Path: "Files/copy.exe"},
+			}))
+			Expect(report.Directories).To(Equal([]diskusage.Directory{{Path: "Files", Files: 2, Size: 300}}))
+		})
+
+		It("reads gzipped layers", func() {
+			var compressed bytes.Buffer
+			g := gzip.NewWriter(&compressed)
+			_, err := g.Write(layer)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(g.Close()).To(Succeed())
+
+			Expect(report.ReadTar(&compressed)).To(Succeed())
+			report.Finish()
+			Expect(report.Size).To(BeEquivalentTo(300))
+		})
+
+		It("fails for something other than a tar", func() {
+			Expect(report.ReadTar(bytes.NewReader(bytes.Repeat([]byte("not a tar"), 100)))).ToNot(Succeed())
+		})
+	})
+})
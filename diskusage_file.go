@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"syscall"
+
+	"code.cloudfoundry.org/diff-exporter/diskusage"
+	"code.cloudfoundry.org/diff-exporter/layer"
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
+)
+
+// recordUsage makes opts add every entry written to the layer to report.
+func recordUsage(opts *layer.Options, report *diskusage.Report) {
+	onEntry := opts.OnEntry
+	opts.OnEntry = func(entry layer.Entry) {
+		reported := reportEntry(entry)
+		if entry.Link != "" {
+			// Hard links don't write the content again.
+			reported.Size = 0
+		}
+		report.Add(reported)
+
+		if onEntry != nil {
+			onEntry(entry)
+		}
+	}
+}
+
+func writeUsageFile(cfg config, report *diskusage.Report) error {
+	report.Finish()
+	err := writeFileAtomically(cfg.usageFile, cfg.noClobber, func(w io.Writer) error {
+		return writeUsage(w, report, cfg.usageFormat)
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing usage file: %w", err)
+	}
+	return nil
+}
+
+// reportEntry is entry as the dry run and usage reports count it.
+func reportEntry(entry layer.Entry) layerfmt.Entry {
+	return layerfmt.Entry{
+		Path:     entry.Name,
+		Change:   entry.Change,
+		Size:     entry.Size,
+		Dir:      isDir(entry),
+		Whiteout: entry.Whiteout,
+	}
+}
+
+func isDir(entry layer.Entry) bool {
+	return entry.FileInfo != nil && entry.FileInfo.FileAttributes&syscall.FILE_ATTRIBUTE_DIRECTORY != 0
+}
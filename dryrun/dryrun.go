@@ -0,0 +1,116 @@
+// Package dryrun summarizes what an export would write, so operators can
+// see what a layer would contain and how large it would be before producing
+// it.
+package dryrun
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
+)
+
+// Report counts the entries of a layer, in total and per top-level
+// directory.
+type Report struct {
+	Entries  int `json:"entries"`
+	Added    int `json:"added"`
+	Modified int `json:"modified"`
+	// Whiteouts are the paths deleted in the layer.
+	Whiteouts int `json:"whiteouts"`
+	// Skipped is the number of entries the export's filters leave out.
+	Skipped int `json:"skipped"`
+	// Size is the uncompressed size of the content of the files, without
+	// the tar headers.
+	Size        int64       `json:"size"`
+	Directories []Directory `json:"directories"`
+
+	directories map[string]*Directory
+}
+
+// Directory is one of the layer's top-level directories: the folders at
+// the root of the container's system drive, its other entries, which are
+// reported together as Files, and the other folders of the layer, such as
+// Hives.
+type Directory struct {
+	Path      string `json:"path"`
+	Entries   int    `json:"entries"`
+	Whiteouts int    `json:"whiteouts"`
+	Size      int64  `json:"size"`
+}
+
+func New() *Report {
+	return &Report{Directories: []Directory{}, directories: map[string]*Directory{}}
+}
+
+// Add counts entry towards the report and its top-level directory.
+func (r *Report) Add(entry layerfmt.Entry) {
+	r.Entries++
+	r.Size += entry.Size
+	switch entry.Change {
+	case layerfmt.ChangeAdded:
+		r.Added++
+	case layerfmt.ChangeModified:
+		r.Modified++
+	case layerfmt.ChangeDeleted:
+		r.Whiteouts++
+	}
+
+	top := topLevel(entry)
+	dir, ok := r.directories[strings.ToLower(top)]
+	if !ok {
+		dir = &Directory{Path: top}
+		r.directories[strings.ToLower(top)] = dir
+	}
+	dir.Entries++
+	dir.Size += entry.Size
+	if entry.Change == layerfmt.ChangeDeleted {
+		dir.Whiteouts++
+	}
+}
+
+// Finish records the number of entries the export skipped, once every entry
+// it kept has been added, and lists the directories largest first.
+func (r *Report) Finish(skipped int) {
+	r.Skipped = skipped
+	r.Directories = make([]Directory, 0, len(r.directories))
+	for _, dir := range r.directories {
+		r.Directories = append(r.Directories, *dir)
+	}
+	sort.Slice(r.Directories, func(i, j int) bool {
+		if r.Directories[i].Size != r.Directories[j].Size {
+			return r.Directories[i].Size > r.Directories[j].Size
+		}
+		return r.Directories[i].Path < r.Directories[j].Path
+	})
+}
+
+// topLevel returns the top-level directory entry belongs to.
+func topLevel(entry layerfmt.Entry) string {
+	parts := strings.SplitN(entry.Path, "/", 3)
+	if parts[0] != layerfmt.Root || len(parts) == 1 {
+		return parts[0]
+	}
+	if len(parts) == 2 && !entry.Dir {
+		return layerfmt.Root
+	}
+	return parts[0] + "/" + parts[1]
+}
+
+// WriteText writes the report as a table, largest directories first, once
+// it has been finished.
+func (r *Report) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "Entries:   %d (%d added, %d modified, %d whiteouts)\n", r.Entries, r.Added, r.Modified, r.Whiteouts)
+	fmt.Fprintf(w, "Skipped:   %d\n", r.Skipped)
+	fmt.Fprintf(w, "Size:      %s uncompressed\n\n", layerfmt.FormatSize(r.Size))
+
+	t := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(t, "DIRECTORY\tENTRIES\tWHITEOUTS\tSIZE")
+	for _, dir := range r.Directories {
+		fmt.Fprintf(t, "%s\t%d\t%d\t%s\n", dir.Path, dir.Entries, dir.Whiteouts, layerfmt.FormatSize(dir.Size))
+	}
+	return t.Flush()
+}
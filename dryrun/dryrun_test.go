@@ -0,0 +1,64 @@
+package dryrun_test
+
+import (
+	"bytes"
+
+	"code.cloudfoundry.org/diff-exporter/dryrun"
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Report", func() {
+	var report *dryrun.Report
+
+	BeforeEach(func() {
+		report = dryrun.New()
+		for _, entry := range []layerfmt.Entry{
+			{Path: "Files/Windows", Change: layerfmt.ChangeModified, Dir: true},
+			{Path: "Files/Windows/System32/big.dll", Change: layerfmt.ChangeAdded, Size: 3000},
+			{Path: "Files/windows/Temp/old.log", Change: layerfmt.ChangeDeleted},
+			{Path: "Files/Users/app.exe", Change: layerfmt.ChangeModified, Size: 500},
+			{Path: "Files/hello.txt", Change: layerfmt.ChangeAdded, Size: 5},
+			{Path: "Files/deleted.txt", Change: layerfmt.ChangeDeleted},
+			{Path: "Hives/DefaultUser_Delta", Change: layerfmt.ChangeAdded, Size: 1000},
+		} {
+			report.Add(entry)
+		}
+		report.Finish(2)
+	})
+
+	It("counts the entries by change", func() {
+		Expect(report.Entries).To(Equal(7))
+		Expect(report.Added).To(Equal(3))
+		Expect(report.Modified).To(Equal(2))
+		Expect(report.Whiteouts).To(Equal(2))
+		Expect(report.Skipped).To(Equal(2))
+		Expect(report.Size).To(BeEquivalentTo(4505))
+	})
+
+	It("sums each top-level directory, largest first", func() {
+		Expect(report.Directories).To(Equal([]dryrun.Directory{
+			{Path: "Files/Windows", Entries: 3, Whiteouts: 1, Size: 3000},
+			{Path: "Hives", Entries: 1, Size: 1000},
+			{Path: "Files/Users", Entries: 1, Size: 500},
+			{Path: "Files", Entries: 2, Whiteouts: 1, Size: 5},
+		}))
+	})
+
+	It("writes a table", func() {
+		var out bytes.Buffer
+		Expect(report.WriteText(&out)).To(Succeed())
+
+		Expect(out.String()).To(Equal(`Entries:   7 (3 added, 2 modified, 2 whiteouts)
+Skipped:   2
+Size:      4.4 KiB uncompressed
+
+DIRECTORY      ENTRIES  WHITEOUTS  SIZE
+Files/Windows  3        1          2.9 KiB
+Hives          1        0          1000 B
+Files/Users    1        0          500 B
+Files          2        1          5 B
+`))
+	})
+})
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"code.cloudfoundry.org/diff-exporter/dryrun"
+	"code.cloudfoundry.org/diff-exporter/layer"
+)
+
+const (
+	reportFormatText = "text"
+	reportFormatJSON = "json"
+)
+
+// dryRun walks the container's layer as the export would, writing a report
+// of what it would contain to stdout instead of the layer. Reading the layer
+// means unpreparing it, so it is always prepared again afterwards to leave
+// the container as it was.
+func dryRun(ctx context.Context, exporter Exporter, opts layer.Options, reportFormat string) (layer.Result, error) {
+	report := dryrun.New()
+	opts.DryRun = true
+	opts.Reprepare = true
+	onEntry := opts.OnEntry
+	opts.OnEntry = func(entry layer.Entry) {
+		report.Add(reportEntry(entry))
+
+		if onEntry != nil {
+			onEntry(entry)
+		}
+	}
+
+	result, err := exporter.ExportTo(ctx, io.Discard, opts)
+	if err != nil {
+		return result, fmt.Errorf("Error walking layer: %w", err)
+	}
+	report.Finish(result.Skipped)
+
+	if reportFormat == reportFormatJSON {
+		err = writeJSON(os.Stdout, report)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		return result, &stageError{stage: stageWrite, err: fmt.Errorf("Error writing report: %w", err)}
+	}
+	return result, nil
+}
+
+// checkReportFormat validates a report format, defaulting it to
+// defaultFormat.
+func checkReportFormat(format *string, defaultFormat string) error {
+	switch *format {
+	case "":
+		*format = defaultFormat
+	case reportFormatText, reportFormatJSON:
+	default:
+		return fmt.Errorf("unknown report format %q", *format)
+	}
+	return nil
+}
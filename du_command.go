@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"code.cloudfoundry.org/diff-exporter/diskusage"
+)
+
+const (
+	duCommand = "du"
+	duUsage   = "USAGE: diff-exporter.exe du <-inputFile layerFile> [-depth depth] [-top count] [-format text|json] [-errorFormat text|json]"
+)
+
+type duConfig struct {
+	inputFile   string
+	depth       int
+	top         int
+	format      string
+	errorFormat string
+}
+
+// runDu prints where the size of an exported layer goes, exiting with
+// exitDu if the layer can't be read.
+func runDu(args []string) {
+	cfg, err := parseDuFlags(args)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, duUsage)
+		os.Exit(0)
+	}
+	reporter := errorReporter{format: cfg.errorFormat, usage: duUsage}
+	if err != nil {
+		reporter.exit(&stageError{stage: stageFlags, err: fmt.Errorf("Error parsing flags: %w", err)})
+	}
+
+	if err := reportUsage(cfg); err != nil {
+		reporter.exit(err)
+	}
+}
+
+func reportUsage(cfg duConfig) error {
+	input, err := os.Open(cfg.inputFile)
+	if err != nil {
+		return &stageError{stage: stageDu, err: fmt.Errorf("Error reading layer: %w", err)}
+	}
+	defer input.Close()
+
+	report := diskusage.New(diskusage.Options{Depth: cfg.depth, Top: cfg.top})
+	if err := report.ReadTar(input); err != nil {
+		return &stageError{stage: stageDu, err: fmt.Errorf("Error reading layer: %w", err)}
+	}
+	report.Finish()
+
+	if err := writeUsage(os.Stdout, report, cfg.format); err != nil {
+		return &stageError{stage: stageWrite, err: fmt.Errorf("Error writing report: %w", err)}
+	}
+	return nil
+}
+
+func writeUsage(w io.Writer, report *diskusage.Report, format string) error {
+	if format == reportFormatJSON {
+		return writeJSON(w, report)
+	}
+	return report.WriteText(w)
+}
+
+// checkUsageOptions validates the depth, number of files and format of a
+// usage report, defaulting the format to defaultFormat.
+func checkUsageOptions(depth, top int, format *string, defaultFormat string) error {
+	if depth < 0 {
+		return errors.New("depth must not be negative")
+	}
+	if top < 0 {
+		return errors.New("number of files must not be negative")
+	}
+	return checkReportFormat(format, defaultFormat)
+}
+
+func parseDuFlags(args []string) (duConfig, error) {
+	var cfg duConfig
+	flags := flag.NewFlagSet("diff-exporter du", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&cfg.inputFile, "inputFile", "", "Exported layer to report on, which may be gzipped")
+	flags.IntVar(&cfg.depth, "depth", diskusage.DefaultDepth, "Levels of directories to report, counting the layer's Files folder as the first")
+	flags.IntVar(&cfg.top, "top", diskusage.DefaultTop, "Number of the largest files and file types to report")
+	flags.StringVar(&cfg.format, "format", reportFormatText, "How to print the report: text or json")
+	flags.StringVar(&cfg.errorFormat, "errorFormat", errorFormatText, "How to report errors on stderr: text or json")
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if err := checkErrorFormat(&cfg.errorFormat); err != nil {
+		return cfg, err
+	}
+	if cfg.inputFile == "" {
+		return cfg, errors.New("must provide layer to report on")
+	}
+	if err := checkUsageOptions(cfg.depth, cfg.top, &cfg.format, reportFormatText); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,312 @@
+package encryption
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// The media type and annotations of an encrypted layer, as defined by the
+// OCI image encryption convention implemented by containerd's ocicrypt.
+const (
+	MediaType         = "application/vnd.oci.image.layer.v1.tar+gzip+encrypted"
+	AnnotationKeysJWE = "org.opencontainers.image.enc.keys.jwe"
+	AnnotationPubOpts = "org.opencontainers.image.enc.pubopts"
+
+	cipherType = "AES_256_CTR_HMAC_SHA256"
+	keySize    = 32
+)
+
+var (
+	ErrInvalidKey           = errors.New("key is not a PEM encoded RSA or ECDSA key")
+	ErrInvalidDescriptor    = errors.New("descriptor is not an encrypted layer descriptor")
+	ErrNoMatchingKey        = errors.New("layer was not encrypted for this key")
+	ErrAuthenticationFailed = errors.New("encrypted layer failed authentication")
+	ErrDigestMismatch       = errors.New("decrypted layer does not match its digest")
+)
+
+// Descriptor is the OCI content descriptor of an encrypted layer. Its
+// annotations carry everything a recipient needs to decrypt it.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// privateOptions are wrapped for each recipient, since they hold the key.
+type privateOptions struct {
+	SymmetricKey  []byte            `json:"symkey"`
+	Digest        string            `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// publicOptions are stored in the clear.
+type publicOptions struct {
+	CipherType    string            `json:"cipher"`
+	HMAC          []byte            `json:"hmac"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// LoadPublicKey parses a PKIX RSA or ECDSA public key of a recipient.
+func LoadPublicKey(pemBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, ErrInvalidKey
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %T", ErrInvalidKey, key)
+	}
+}
+
+// LoadPrivateKey parses an unencrypted PKCS #8, PKCS #1 or SEC 1 private key.
+func LoadPrivateKey(pemBytes []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, ErrInvalidKey
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%w: unsupported PEM block %q", ErrInvalidKey, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %T", ErrInvalidKey, key)
+	}
+}
+
+// Writer encrypts a layer with a random key as it is written through it.
+type Writer struct {
+	w          io.Writer
+	recipients []crypto.PublicKey
+	key        []byte
+	nonce      []byte
+	stream     cipher.Stream
+	mac        hash.Hash
+	digest     hash.Hash
+	size       int64
+	buf        []byte
+}
+
+// NewWriter returns a Writer encrypting to w for recipients.
+func NewWriter(w io.Writer, recipients []crypto.PublicKey) (*Writer, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients to encrypt the layer for")
+	}
+	key := make([]byte, keySize)
+	nonce := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:          w,
+		recipients: recipients,
+		key:        key,
+		nonce:      nonce,
+		stream:     cipher.NewCTR(block, nonce),
+		mac:        hmac.New(sha256.New, key),
+		digest:     sha256.New(),
+	}, nil
+}
+
+func (e *Writer) Write(p []byte) (int, error) {
+	if cap(e.buf) < len(p) {
+		e.buf = make([]byte, len(p))
+	}
+	out := e.buf[:len(p)]
+	e.stream.XORKeyStream(out, p)
+
+	n, err := e.w.Write(out)
+	e.mac.Write(out[:n])
+	e.digest.Write(out[:n])
+	e.size += int64(n)
+	return n, err
+}
+
+// Descriptor describes the encrypted layer once all of it has been written.
+// layerDigest is the digest of the unencrypted layer, which decryption
+// checks.
+func (e *Writer) Descriptor(layerDigest string) (Descriptor, error) {
+	private, err := json.Marshal(privateOptions{
+		SymmetricKey:  e.key,
+		Digest:        layerDigest,
+		CipherOptions: map[string][]byte{"nonce": e.nonce},
+	})
+	if err != nil {
+		return Descriptor{}, err
+	}
+	wrapped, err := wrapKey(e.recipients, private)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("Error wrapping layer key: %w", err)
+	}
+	public, err := json.Marshal(publicOptions{
+		CipherType:    cipherType,
+		HMAC:          e.mac.Sum(nil),
+		CipherOptions: map[string][]byte{},
+	})
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	return Descriptor{
+		MediaType: MediaType,
+		Digest:    "sha256:" + hex.EncodeToString(e.digest.Sum(nil)),
+		Size:      e.size,
+		Annotations: map[string]string{
+			AnnotationKeysJWE: base64.StdEncoding.EncodeToString(wrapped),
+			AnnotationPubOpts: base64.StdEncoding.EncodeToString(public),
+		},
+	}, nil
+}
+
+// Decrypt decrypts the layer desc describes from r to w with a recipient's
+// private key. Nothing written to w may be trusted unless it succeeds, as
+// the layer can only be authenticated once all of it has been read.
+func Decrypt(w io.Writer, r io.Reader, desc Descriptor, key crypto.PrivateKey) error {
+	if !strings.HasSuffix(desc.MediaType, "+encrypted") {
+		return fmt.Errorf("%w: media type %q", ErrInvalidDescriptor, desc.MediaType)
+	}
+	var public publicOptions
+	if err := decodePublicOptions(desc.Annotations[AnnotationPubOpts], &public); err != nil {
+		return err
+	}
+	if public.CipherType != cipherType {
+		return fmt.Errorf("%w: unsupported cipher %q", ErrInvalidDescriptor, public.CipherType)
+	}
+
+	private, err := unwrapOptions(desc.Annotations[AnnotationKeysJWE], key)
+	if err != nil {
+		return err
+	}
+	nonce := private.CipherOptions["nonce"]
+	if len(private.SymmetricKey) != keySize || len(nonce) != aes.BlockSize {
+		return fmt.Errorf("%w: invalid layer key", ErrInvalidDescriptor)
+	}
+	block, err := aes.NewCipher(private.SymmetricKey)
+	if err != nil {
+		return err
+	}
+	stream := cipher.NewCTR(block, nonce)
+	mac := hmac.New(sha256.New, private.SymmetricKey)
+	encryptedDigest := sha256.New()
+	digest := sha256.New()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			mac.Write(buf[:n])
+			encryptedDigest.Write(buf[:n])
+			stream.XORKeyStream(buf[:n], buf[:n])
+			digest.Write(buf[:n])
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if !hmac.Equal(mac.Sum(nil), public.HMAC) {
+		return ErrAuthenticationFailed
+	}
+	if desc.Digest != "" && desc.Digest != "sha256:"+hex.EncodeToString(encryptedDigest.Sum(nil)) {
+		return fmt.Errorf("%w: encrypted layer is not %s", ErrDigestMismatch, desc.Digest)
+	}
+	if private.Digest != "" && private.Digest != "sha256:"+hex.EncodeToString(digest.Sum(nil)) {
+		return fmt.Errorf("%w: decrypted layer is not %s", ErrDigestMismatch, private.Digest)
+	}
+	return nil
+}
+
+// unwrapOptions unwraps the private options from the keys annotation, a
+// comma separated list of base64 encoded JWEs.
+func unwrapOptions(annotation string, key crypto.PrivateKey) (privateOptions, error) {
+	if annotation == "" {
+		return privateOptions{}, fmt.Errorf("%w: missing %s annotation", ErrInvalidDescriptor, AnnotationKeysJWE)
+	}
+	for _, encoded := range strings.Split(annotation, ",") {
+		jwe, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return privateOptions{}, fmt.Errorf("%w: %w", ErrInvalidDescriptor, err)
+		}
+		plaintext, err := unwrapKey(jwe, key)
+		if errors.Is(err, ErrNoMatchingKey) {
+			continue
+		}
+		if err != nil {
+			return privateOptions{}, err
+		}
+
+		var private privateOptions
+		if err := json.Unmarshal(plaintext, &private); err != nil {
+			return privateOptions{}, fmt.Errorf("%w: %w", ErrInvalidDescriptor, err)
+		}
+		return private, nil
+	}
+	return privateOptions{}, ErrNoMatchingKey
+}
+
+func decodePublicOptions(annotation string, public *publicOptions) error {
+	if annotation == "" {
+		return fmt.Errorf("%w: missing %s annotation", ErrInvalidDescriptor, AnnotationPubOpts)
+	}
+	data, err := base64.StdEncoding.DecodeString(annotation)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidDescriptor, err)
+	}
+	if err := json.Unmarshal(data, public); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidDescriptor, err)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package encryption_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/diff-exporter/encryption"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func digestOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func encrypt(layer []byte, recipients ...crypto.PublicKey) ([]byte, encryption.Descriptor) {
+	var out bytes.Buffer
+	w, err := encryption.NewWriter(&out, recipients)
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	// Write in pieces, as the compressor does.
+	for i := 0; i < len(layer); i += 1000 {
+		_, err := w.Write(layer[i:min(i+1000, len(layer))])
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	}
+	desc, err := w.Descriptor(digestOf(layer))
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	return out.Bytes(), desc
+}
+
+func decrypt(encrypted []byte, desc encryption.Descriptor, key crypto.PrivateKey) ([]byte, error) {
+	var out bytes.Buffer
+	err := encryption.Decrypt(&out, bytes.NewReader(encrypted), desc, key)
+	return out.Bytes(), err
+}
+
+var _ = Describe("Encryption", func() {
+	var layer []byte
+
+	BeforeEach(func() {
+		layer = make([]byte, 10000)
+		_, err := rand.Read(layer)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	keys := []struct {
+		name     string
+		generate func() (crypto.PrivateKey, crypto.PublicKey)
+	}{
+		{"RSA", func() (crypto.PrivateKey, crypto.PublicKey) {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			return key, key.Public()
+		}},
+		{"ECDSA P-256", func() (crypto.PrivateKey, crypto.PublicKey) {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			return key, key.Public()
+		}},
+		{"ECDSA P-521", func() (crypto.PrivateKey, crypto.PublicKey) {
+			key, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			return key, key.Public()
+		}},
+	}
+
+	for _, k := range keys {
+		k := k
+		Context("with an "+k.name+" key", func() {
+			var (
+				private crypto.PrivateKey
+				public  crypto.PublicKey
+			)
+
+			BeforeEach(func() {
+				private, public = k.generate()
+			})
+
+			It("decrypts what it encrypted", func() {
+				encrypted, desc := encrypt(layer, public)
+				Expect(encrypted).To(HaveLen(len(layer)))
+				Expect(encrypted).ToNot(Equal(layer))
+
+				decrypted, err := decrypt(encrypted, desc, private)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(decrypted).To(Equal(layer))
+			})
+
+			It("refuses another recipient's key", func() {
+				encrypted, desc := encrypt(layer, public)
+				other, _ := k.generate()
+
+				_, err := decrypt(encrypted, desc, other)
+				Expect(err).To(MatchError(encryption.ErrNoMatchingKey))
+			})
+		})
+	}
+
+	It("describes the encrypted layer with the ocicrypt annotations", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		encrypted, desc := encrypt(layer, key.Public())
+
+		Expect(desc.MediaType).To(Equal("application/vnd.oci.image.layer.v1.tar+gzip+encrypted"))
+		Expect(desc.Digest).To(Equal(digestOf(encrypted)))
+		Expect(desc.Size).To(BeEquivalentTo(len(encrypted)))
+		Expect(desc.Annotations).To(HaveKey("org.opencontainers.image.enc.keys.jwe"))
+
+		pubopts, err := base64.StdEncoding.DecodeString(desc.Annotations["org.opencontainers.image.enc.pubopts"])
+		Expect(err).ToNot(HaveOccurred())
+		var decoded map[string]interface{}
+		Expect(json.Unmarshal(pubopts, &decoded)).To(Succeed())
+		Expect(decoded).To(HaveKeyWithValue("cipher", "AES_256_CTR_HMAC_SHA256"))
+		Expect(decoded).To(HaveKey("hmac"))
+
+		jwe, err := base64.StdEncoding.DecodeString(desc.Annotations["org.opencontainers.image.enc.keys.jwe"])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(json.Unmarshal(jwe, &decoded)).To(Succeed())
+		Expect(decoded).To(HaveKey("ciphertext"))
+		Expect(decoded).ToNot(HaveKey("symkey"))
+	})
+
+	It("can be decrypted by every recipient", func() {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		encrypted, desc := encrypt(layer, rsaKey.Public(), ecKey.Public())
+
+		for _, key := range []crypto.PrivateKey{rsaKey, ecKey} {
+			decrypted, err := decrypt(encrypted, desc, key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decrypted).To(Equal(layer))
+		}
+	})
+
+	Context("when the encrypted layer has been tampered with", func() {
+		It("fails authentication", func() {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			encrypted, desc := encrypt(layer, key.Public())
+			encrypted[100] ^= 1
+
+			_, err = decrypt(encrypted, desc, key)
+			Expect(err).To(MatchError(encryption.ErrAuthenticationFailed))
+		})
+	})
+
+	Context("when the descriptor isn't for an encrypted layer", func() {
+		It("fails", func() {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			encrypted, desc := encrypt(layer, key.Public())
+			desc.MediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+			_, err = decrypt(encrypted, desc, key)
+			Expect(err).To(MatchError(encryption.ErrInvalidDescriptor))
+		})
+	})
+})
+
+var _ = Describe("Interoperability", func() {
+	// testdata/ocicrypt holds a layer encrypted by ocicrypt for an RSA and an
+	// ECDSA P-256 recipient, with the descriptor it produced.
+	DescribeTable("opens layers encrypted by ocicrypt",
+		func(keyFile string) {
+			dir := filepath.Join("testdata", "ocicrypt")
+			keyPEM, err := os.ReadFile(filepath.Join(dir, keyFile))
+			Expect(err).ToNot(HaveOccurred())
+			key, err := encryption.LoadPrivateKey(keyPEM)
+			Expect(err).ToNot(HaveOccurred())
+			descJSON, err := os.ReadFile(filepath.Join(dir, "descriptor.json"))
+			Expect(err).ToNot(HaveOccurred())
+			var desc encryption.Descriptor
+			Expect(json.Unmarshal(descJSON, &desc)).To(Succeed())
+			encrypted, err := os.ReadFile(filepath.Join(dir, "layer.enc"))
+			Expect(err).ToNot(HaveOccurred())
+			layer, err := os.ReadFile(filepath.Join(dir, "layer"))
+			Expect(err).ToNot(HaveOccurred())
+
+			decrypted, err := decrypt(encrypted, desc, key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decrypted).To(Equal(layer))
+		},
+		Entry("with the RSA key", "rsa.pem"),
+		Entry("with the ECDSA key", "ecdsa.pem"),
+	)
+})
+
+var _ = Describe("Keys", func() {
+	It("loads RSA and ECDSA key pairs", func() {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		ecDER, err := x509.MarshalECPrivateKey(ecKey)
+		Expect(err).ToNot(HaveOccurred())
+
+		for _, pair := range []struct {
+			private *pem.Block
+			public  interface{ Equal(crypto.PublicKey) bool }
+		}{
+			{&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, &rsaKey.PublicKey},
+			{&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}, &ecKey.PublicKey},
+		} {
+			private, err := encryption.LoadPrivateKey(pem.EncodeToMemory(pair.private))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(private.(crypto.Signer).Public()).To(Satisfy(pair.public.Equal))
+
+			der, err := x509.MarshalPKIXPublicKey(pair.public)
+			Expect(err).ToNot(HaveOccurred())
+			public, err := encryption.LoadPublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(public).To(Satisfy(pair.public.Equal))
+		}
+	})
+
+	It("rejects ed25519 keys, which can't encrypt", func() {
+		_, err := encryption.LoadPublicKey([]byte("-----BEGIN PUBLIC KEY-----\nMCowBQYDK2VwAyEAGb9ECWmEzf6FQbrBZ9w7lshQhqowtrbLDFw4rXAxZuE=\n-----END PUBLIC KEY-----\n"))
+		Expect(err).To(MatchError(encryption.ErrInvalidKey))
+	})
+})
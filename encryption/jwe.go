@@ -0,0 +1,76 @@
+package encryption
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+var (
+	// keyAlgorithms are the key management algorithms ocicrypt wraps layer
+	// keys with, which are the only ones accepted when unwrapping them.
+	keyAlgorithms = []jose.KeyAlgorithm{
+		jose.RSA_OAEP,
+		jose.RSA_OAEP_256,
+		jose.ECDH_ES_A128KW,
+		jose.ECDH_ES_A192KW,
+		jose.ECDH_ES_A256KW,
+	}
+	contentEncryptions = []jose.ContentEncryption{jose.A256GCM}
+)
+
+// wrapKey encrypts plaintext for every recipient as a JWE, the way
+// ocicrypt's jwe key wrapper does: RSA keys use RSA-OAEP and ECDSA keys
+// ECDH-ES+A256KW to wrap an A256GCM content key.
+func wrapKey(recipients []crypto.PublicKey, plaintext []byte) ([]byte, error) {
+	var joseRecipients []jose.Recipient
+	for _, key := range recipients {
+		switch key.(type) {
+		case *rsa.PublicKey:
+			joseRecipients = append(joseRecipients, jose.Recipient{Algorithm: jose.RSA_OAEP, Key: key})
+		case *ecdsa.PublicKey:
+			joseRecipients = append(joseRecipients, jose.Recipient{Algorithm: jose.ECDH_ES_A256KW, Key: key})
+		default:
+			return nil, fmt.Errorf("%w: unsupported key type %T", ErrInvalidKey, key)
+		}
+	}
+
+	encrypter, err := jose.NewMultiEncrypter(jose.A256GCM, joseRecipients, nil)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encrypter.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(encrypted.FullSerialize()), nil
+}
+
+// unwrapKey decrypts a JWE with the first of its recipients key can
+// decrypt for, returning ErrNoMatchingKey if there are none. A recipient
+// whose content fails authentication can't be told apart from one wrapped
+// for another key, so it is reported the same way.
+func unwrapKey(data []byte, key crypto.PrivateKey) ([]byte, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %T", ErrInvalidKey, key)
+	}
+
+	encrypted, err := jose.ParseEncryptedJSON(string(data), keyAlgorithms, contentEncryptions)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidDescriptor, err)
+	}
+	_, _, plaintext, err := encrypted.DecryptMulti(key)
+	if errors.Is(err, jose.ErrCryptoFailure) {
+		return nil, ErrNoMatchingKey
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidDescriptor, err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"io"
+	"os"
+
+	"code.cloudfoundry.org/diff-exporter/encryption"
+	"code.cloudfoundry.org/diff-exporter/layer"
+)
+
+func loadRecipients(keyFiles []string) ([]crypto.PublicKey, error) {
+	var recipients []crypto.PublicKey
+	for _, keyFile := range keyFiles {
+		pemBytes, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, &stageError{stage: stageEncrypt, err: fmt.Errorf("Error reading encryption key: %w", err)}
+		}
+		key, err := encryption.LoadPublicKey(pemBytes)
+		if err != nil {
+			return nil, &stageError{stage: stageEncrypt, err: fmt.Errorf("Error loading encryption key %s: %w", keyFile, err)}
+		}
+		recipients = append(recipients, key)
+	}
+	return recipients, nil
+}
+
+// encryptingExporter encrypts the layer for its recipients as it is
+// written. The result's digest and size are those of the encrypted layer,
+// since that is what gets stored.
+type encryptingExporter struct {
+	Exporter
+	recipients []crypto.PublicKey
+	descriptor encryption.Descriptor
+}
+
+func (e *encryptingExporter) ExportTo(ctx context.Context, w io.Writer, opts layer.Options) (layer.Result, error) {
+	encrypted, err := encryption.NewWriter(w, e.recipients)
+	if err != nil {
+		return layer.Result{}, &stageError{stage: stageEncrypt, err: fmt.Errorf("Error encrypting layer: %w", err)}
+	}
+	result, err := e.Exporter.ExportTo(ctx, encrypted, opts)
+	if err != nil {
+		return result, err
+	}
+
+	e.descriptor, err = encrypted.Descriptor(result.Digest)
+	if err != nil {
+		return result, &stageError{stage: stageEncrypt, err: fmt.Errorf("Error encrypting layer: %w", err)}
+	}
+	result.Digest = e.descriptor.Digest
+	result.Size = e.descriptor.Size
+	return result, nil
+}
+
+func writeDescriptorFile(descriptorFile string, noClobber bool, desc encryption.Descriptor) error {
+	return writeFileAtomically(descriptorFile, noClobber, func(w io.Writer) error {
+		return writeJSON(w, desc)
+	})
+}
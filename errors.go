@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"code.cloudfoundry.org/diff-exporter/layer"
+	"code.cloudfoundry.org/diff-exporter/wincstate"
+	"golang.org/x/sys/windows"
+)
+
+const (
+	errorFormatText = "text"
+	errorFormatJSON = "json"
+)
+
+// stage is the part of a run that failed, as reported by -errorFormat json.
+type stage string
+
+const (
+	stageFlags     stage = "flags"
+	stageSpec      stage = "spec"
+	stageUnprepare stage = "unprepare"
+	stageReader    stage = "reader"
+	stageReprepare stage = "reprepare"
+	stageWrite     stage = "write"
+	stageQuota     stage = "quota"
+	stageCancel    stage = "cancel"
+	stageSign      stage = "sign"
+	stageVerify    stage = "verify"
+	stageEncrypt   stage = "encrypt"
+	stageDecrypt   stage = "decrypt"
+	stageConvert   stage = "convert"
+	stageJoin      stage = "join"
+	stageDu        stage = "du"
+	stageInternal  stage = "internal"
+)
+
+// Exit codes are stable so callers can react to each kind of failure. Codes
+// 10-19 all belong to the spec stage and say what is wrong with the bundle.
+const (
+	exitFailure             = 1
+	exitFlags               = 2
+	exitBatchFailed         = 3
+	exitConfigNotReadable   = 10
+	exitConfigInvalid       = 11
+	exitNoWindowsSection    = 12
+	exitNoLayerFolders      = 13
+	exitLayerFolderNotFound = 14
+	exitDriverStoreNotFound = 15
+	exitSandboxNotFound     = 16
+	exitStateNotFound       = 17
+	exitInvalidState        = 18
+	exitStaleState          = 19
+	exitUnprepare           = 20
+	exitReprepare           = 21
+	exitReader              = 30
+	exitWrite               = 40
+	exitQuota               = 41
+	exitCancel              = 50
+	exitSign                = 60
+	exitVerify              = 61
+	exitEncrypt             = 62
+	exitDecrypt             = 63
+	exitConvert             = 70
+	exitJoin                = 71
+	exitDu                  = 72
+)
+
+var specExitCodes = []struct {
+	err  error
+	code int
+}{
+	{layer.ErrConfigNotReadable, exitConfigNotReadable},
+	{layer.ErrConfigInvalid, exitConfigInvalid},
+	{layer.ErrNoWindowsSection, exitNoWindowsSection},
+	{layer.ErrNoLayerFolders, exitNoLayerFolders},
+	{layer.ErrLayerFolderNotFound, exitLayerFolderNotFound},
+	{layer.ErrDriverStoreNotFound, exitDriverStoreNotFound},
+	{layer.ErrSandboxNotFound, exitSandboxNotFound},
+	{wincstate.ErrStateNotFound, exitStateNotFound},
+	{wincstate.ErrInvalidState, exitInvalidState},
+	{wincstate.ErrStaleState, exitStaleState},
+}
+
+var layerStages = map[layer.Stage]struct {
+	stage stage
+	code  int
+}{
+	layer.StageUnprepare: {stageUnprepare, exitUnprepare},
+	layer.StageReprepare: {stageReprepare, exitReprepare},
+	layer.StageReader:    {stageReader, exitReader},
+	layer.StageWrite:     {stageWrite, exitWrite},
+}
+
+// stageError attributes a failure outside the layer package to a stage.
+type stageError struct {
+	stage stage
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+func classify(err error) (int, stage) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return exitCancel, stageCancel
+	}
+	if isQuotaError(err) {
+		return exitQuota, stageQuota
+	}
+	for _, spec := range specExitCodes {
+		if errors.Is(err, spec.err) {
+			return spec.code, stageSpec
+		}
+	}
+
+	var se *stageError
+	if errors.As(err, &se) {
+		switch se.stage {
+		case stageFlags:
+			return exitFlags, stageFlags
+		case stageWrite:
+			return exitWrite, stageWrite
+		case stageSign:
+			return exitSign, stageSign
+		case stageVerify:
+			return exitVerify, stageVerify
+		case stageEncrypt:
+			return exitEncrypt, stageEncrypt
+		case stageDecrypt:
+			return exitDecrypt, stageDecrypt
+		case stageConvert:
+			return exitConvert, stageConvert
+		case stageJoin:
+			return exitJoin, stageJoin
+		case stageDu:
+			return exitDu, stageDu
+		}
+	}
+	if s, ok := layerStages[layer.StageOf(err)]; ok {
+		return s.code, s.stage
+	}
+
+	return exitFailure, stageInternal
+}
+
+// isQuotaError reports whether err was caused by running out of disk space
+// or hitting a disk quota while writing the layer.
+func isQuotaError(err error) bool {
+	return errors.Is(err, windows.ERROR_DISK_FULL) ||
+		errors.Is(err, windows.ERROR_HANDLE_DISK_FULL) ||
+		errors.Is(err, windows.ERROR_DISK_QUOTA_EXCEEDED)
+}
+
+type errorReport struct {
+	Code        int    `json:"code"`
+	Stage       stage  `json:"stage"`
+	Message     string `json:"message"`
+	ContainerId string `json:"containerId,omitempty"`
+}
+
+// checkErrorFormat falls back to text for an unknown -errorFormat so the
+// error about it can still be reported.
+func checkErrorFormat(format *string) error {
+	if *format != errorFormatText && *format != errorFormatJSON {
+		unknown := *format
+		*format = errorFormatText
+		return fmt.Errorf("unknown error format %q", unknown)
+	}
+	return nil
+}
+
+// errorReporter prints a fatal error in the requested format and exits with
+// the code for its stage.
+type errorReporter struct {
+	format      string
+	containerId string
+	usage       string
+}
+
+func (r errorReporter) exit(err error) {
+	code, stage := classify(err)
+
+	if r.format == errorFormatJSON {
+		json.NewEncoder(os.Stderr).Encode(errorReport{
+			Code:        code,
+			Stage:       stage,
+			Message:     err.Error(),
+			ContainerId: r.containerId,
+		})
+	} else {
+		fmt.Fprintln(os.Stderr, err.Error())
+		if stage == stageFlags {
+			fmt.Fprintln(os.Stderr, r.usage)
+		}
+	}
+
+	os.Exit(code)
+}
@@ -1,11 +1,32 @@
 package integration_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
 	"os"
 
 	"os/exec"
 	"path/filepath"
+	"strings"
 
+	"code.cloudfoundry.org/diff-exporter/diskusage"
+	"code.cloudfoundry.org/diff-exporter/dryrun"
+	"code.cloudfoundry.org/diff-exporter/encryption"
+	testhelpers "code.cloudfoundry.org/diff-exporter/integration/helpers"
+	"code.cloudfoundry.org/diff-exporter/signing"
+	"code.cloudfoundry.org/diff-exporter/split"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
@@ -66,12 +87,488 @@ var _ = Describe("diff_exporter", func() {
 			Expect(err).ToNot(HaveOccurred())
 			Expect(stdOut.String()).To(ContainSubstring("Files/hello.txt"))
 		})
+
+		It("streams the layer to stdout when the output file is -", func() {
+			stdOut, _, err := helpers.Execute(exec.Command(diffBin, "-outputFile", "-", "-containerId", containerId, "-bundlePath", bundlePath))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(testhelpers.Gz(stdOut.Bytes())).To(BeTrue())
+
+			Expect(os.WriteFile(outputFile, stdOut.Bytes(), 0644)).To(Succeed())
+			tarOut, _, err := helpers.Execute(exec.Command("tar", "tf", outputFile))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tarOut.String()).To(ContainSubstring("Files/hello.txt"))
+		})
+
+		It("writes a disk usage report of the layer", func() {
+			usageFile := filepath.Join(outputDir, "usage.json")
+			_, _, err = helpers.Execute(exec.Command(diffBin, "-outputFile", outputFile, "-containerId", containerId, "-bundlePath", bundlePath, "-usageFile", usageFile))
+			Expect(err).ToNot(HaveOccurred())
+
+			contents, err := os.ReadFile(usageFile)
+			Expect(err).ToNot(HaveOccurred())
+			var report diskusage.Report
+			Expect(json.Unmarshal(contents, &report)).To(Succeed())
+			Expect(report.Depth).To(Equal(diskusage.DefaultDepth))
+			Expect(report.Directories).To(ContainElement(HaveField("Path", "Files")))
+		})
+
+		It("reports what the layer would contain on a dry run without writing it", func() {
+			stdOut, _, err := helpers.Execute(exec.Command(diffBin, "-dryRun", "-reportFormat", "json", "-containerId", containerId, "-bundlePath", bundlePath))
+			Expect(err).ToNot(HaveOccurred())
+
+			var report dryrun.Report
+			Expect(json.Unmarshal(stdOut.Bytes(), &report)).To(Succeed())
+			Expect(report.Added).To(BeNumerically(">=", 1))
+			Expect(report.Directories).To(ContainElement(HaveField("Path", "Files")))
+
+			entries, err := os.ReadDir(outputDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(BeEmpty())
+		})
+	})
+
+	Context("when the output file already exists and -noClobber is set", func() {
+		var outputFile string
+
+		BeforeEach(func() {
+			outputDir, err := os.MkdirTemp("", "diffoutput")
+			Expect(err).To(Succeed())
+
+			outputFile = filepath.Join(outputDir, "some-output-file.tgz")
+			Expect(os.WriteFile(outputFile, []byte("existing layer"), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(filepath.Dir(outputFile))).To(Succeed())
+		})
+
+		It("errors without touching the existing file", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", outputFile, "-containerId", "some-container-id", "-bundlePath", "some-bundle-path", "-noClobber"))
+			Expect(err).To(HaveOccurred())
+			Expect(stdErr.String()).To(ContainSubstring("already exists"))
+
+			content, err := os.ReadFile(outputFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(content)).To(Equal("existing layer"))
+
+			entries, err := os.ReadDir(filepath.Dir(outputFile))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+		})
+	})
+
+	Context("when the bundle is invalid", func() {
+		var bundlePath string
+
+		BeforeEach(func() {
+			var err error
+			bundlePath, err = os.MkdirTemp("", "invalidbundle")
+			Expect(err).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(bundlePath)).To(Succeed())
+		})
+
+		It("exits with a distinct code when config.json is missing", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", filepath.Join(bundlePath, "out.tgz"), "-containerId", "some-container-id", "-bundlePath", bundlePath))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(10))
+			Expect(stdErr.String()).To(ContainSubstring("bundle config.json could not be read"))
+		})
+
+		It("exits with a distinct code when the spec has no windows section", func() {
+			Expect(os.WriteFile(filepath.Join(bundlePath, "config.json"), []byte(`{"ociVersion": "1.0.2"}`), 0644)).To(Succeed())
+
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", filepath.Join(bundlePath, "out.tgz"), "-containerId", "some-container-id", "-bundlePath", bundlePath))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(12))
+			Expect(stdErr.String()).To(ContainSubstring("bundle spec has no windows section"))
+		})
+	})
+
+	Context("when looking up the bundle in winc's state", func() {
+		It("errors when winc has no state for the container", func() {
+			wincRoot, err := os.MkdirTemp("", "wincroot")
+			Expect(err).To(Succeed())
+			defer os.RemoveAll(wincRoot)
+
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", "some-output-file", "-containerId", "some-container-id", "-fromWincState", "-wincRoot", wincRoot))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(17))
+			Expect(stdErr.String()).To(ContainSubstring("container state not found"))
+		})
+	})
+
+	Context("when the spec is read from stdin", func() {
+		It("validates it like a bundle's config.json", func() {
+			cmd := exec.Command(diffBin, "-outputFile", "some-output-file", "-containerId", "some-container-id", "-specFile", "-")
+			cmd.Stdin = strings.NewReader(`{"ociVersion": "1.0.2", "windows": {"layerFolders": []}}`)
+
+			_, stdErr, err := helpers.Execute(cmd)
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(13))
+			Expect(stdErr.String()).To(ContainSubstring("bundle spec has no layer folders"))
+		})
+	})
+
+	Context("when reporting errors as json", func() {
+		It("includes the exit code, stage and container id", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", "some-output-file", "-containerId", "some-container-id", "-bundlePath", "some-missing-bundle-path", "-errorFormat", "json"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(10))
+
+			var report map[string]interface{}
+			Expect(json.Unmarshal(stdErr.Bytes(), &report)).To(Succeed())
+			Expect(report).To(HaveKeyWithValue("code", BeEquivalentTo(10)))
+			Expect(report).To(HaveKeyWithValue("stage", "spec"))
+			Expect(report).To(HaveKeyWithValue("containerId", "some-container-id"))
+			Expect(report).To(HaveKeyWithValue("message", ContainSubstring("bundle config.json could not be read")))
+		})
+
+		It("reports flag errors", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-containerId", "some-container-id", "-errorFormat", "json"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+
+			var report map[string]interface{}
+			Expect(json.Unmarshal(stdErr.Bytes(), &report)).To(Succeed())
+			Expect(report).To(HaveKeyWithValue("stage", "flags"))
+			Expect(report).To(HaveKeyWithValue("message", ContainSubstring("must provide output file")))
+		})
+	})
+
+	Context("when writing metrics", func() {
+		It("records failed exports with their stage", func() {
+			metricsDir, err := os.MkdirTemp("", "metrics")
+			Expect(err).To(Succeed())
+			defer os.RemoveAll(metricsDir)
+			metricsFile := filepath.Join(metricsDir, "diff-exporter.prom")
+
+			_, _, err = helpers.Execute(exec.Command(diffBin, "-outputFile", "some-output-file", "-containerId", "some-container-id", "-bundlePath", "some-missing-bundle-path", "-metricsFile", metricsFile))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(10))
+
+			metrics, err := os.ReadFile(metricsFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(metrics)).To(ContainSubstring(`diff_exporter_export_failures_total{stage="spec"} 1`))
+			Expect(string(metrics)).To(ContainSubstring("diff_exporter_last_export_success 0"))
+		})
+	})
+
+	Context("when verifying a signature", func() {
+		var (
+			keysDir       string
+			layerFile     string
+			publicKey     string
+			signatureFile string
+			payloadFile   string
+		)
+
+		BeforeEach(func() {
+			var err error
+			keysDir, err = os.MkdirTemp("", "signing")
+			Expect(err).To(Succeed())
+
+			pub, key, err := ed25519.GenerateKey(rand.Reader)
+			Expect(err).To(Succeed())
+			der, err := x509.MarshalPKIXPublicKey(pub)
+			Expect(err).To(Succeed())
+			publicKey = filepath.Join(keysDir, "key.pub")
+			Expect(os.WriteFile(publicKey, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)).To(Succeed())
+
+			layerFile = filepath.Join(keysDir, "layer.tgz")
+			Expect(os.WriteFile(layerFile, []byte("some layer"), 0644)).To(Succeed())
+			sum := sha256.Sum256([]byte("some layer"))
+
+			payload, err := signing.NewPayload("sha256:"+hex.EncodeToString(sum[:]), "")
+			Expect(err).To(Succeed())
+			signature, err := signing.Sign(key, payload)
+			Expect(err).To(Succeed())
+			payloadFile = filepath.Join(keysDir, "layer.tgz.payload.json")
+			Expect(os.WriteFile(payloadFile, payload, 0644)).To(Succeed())
+			signatureFile = filepath.Join(keysDir, "layer.tgz.sig")
+			Expect(os.WriteFile(signatureFile, signature, 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(keysDir)).To(Succeed())
+		})
+
+		It("succeeds for the signed layer", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "verify-signature", "-key", publicKey, "-layer", layerFile, "-signature", signatureFile, "-payload", payloadFile))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stdErr.String()).To(ContainSubstring("Verified OK"))
+		})
+
+		It("fails for a different layer", func() {
+			Expect(os.WriteFile(layerFile, []byte("another layer"), 0644)).To(Succeed())
+
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "verify-signature", "-key", publicKey, "-layer", layerFile, "-signature", signatureFile, "-payload", payloadFile))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(61))
+			Expect(stdErr.String()).To(ContainSubstring("payload was signed for a different digest"))
+		})
+	})
+
+	Context("when decrypting a layer", func() {
+		var (
+			keysDir        string
+			privateKey     string
+			descriptorFile string
+			encryptedFile  string
+			outputFile     string
+		)
+
+		writeKey := func(key *ecdsa.PrivateKey) string {
+			der, err := x509.MarshalECPrivateKey(key)
+			Expect(err).To(Succeed())
+			keyFile := filepath.Join(keysDir, key.Curve.Params().Name+".pem")
+			Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)).To(Succeed())
+			return keyFile
+		}
+
+		BeforeEach(func() {
+			var err error
+			keysDir, err = os.MkdirTemp("", "encryption")
+			Expect(err).To(Succeed())
+
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).To(Succeed())
+			privateKey = writeKey(key)
+
+			var encrypted bytes.Buffer
+			w, err := encryption.NewWriter(&encrypted, []crypto.PublicKey{key.Public()})
+			Expect(err).To(Succeed())
+			_, err = w.Write([]byte("some layer"))
+			Expect(err).To(Succeed())
+			sum := sha256.Sum256([]byte("some layer"))
+			desc, err := w.Descriptor("sha256:" + hex.EncodeToString(sum[:]))
+			Expect(err).To(Succeed())
+
+			encryptedFile = filepath.Join(keysDir, "layer.tgz")
+			Expect(os.WriteFile(encryptedFile, encrypted.Bytes(), 0644)).To(Succeed())
+			descriptor, err := json.Marshal(desc)
+			Expect(err).To(Succeed())
+			descriptorFile = filepath.Join(keysDir, "layer.tgz.descriptor.json")
+			Expect(os.WriteFile(descriptorFile, descriptor, 0644)).To(Succeed())
+			outputFile = filepath.Join(keysDir, "decrypted.tgz")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(keysDir)).To(Succeed())
+		})
+
+		It("writes the decrypted layer", func() {
+			_, _, err := helpers.Execute(exec.Command(diffBin, "decrypt", "-key", privateKey, "-descriptor", descriptorFile, "-inputFile", encryptedFile, "-outputFile", outputFile))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.ReadFile(outputFile)).To(Equal([]byte("some layer")))
+		})
+
+		It("fails without writing anything for another recipient's key", func() {
+			other, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+			Expect(err).To(Succeed())
+
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "decrypt", "-key", writeKey(other), "-descriptor", descriptorFile, "-inputFile", encryptedFile, "-outputFile", outputFile))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(63))
+			Expect(stdErr.String()).To(ContainSubstring("layer was not encrypted for this key"))
+			Expect(outputFile).ToNot(BeAnExistingFile())
+		})
+	})
+
+	Context("when joining a split layer", func() {
+		var (
+			partsDir   string
+			partsFile  string
+			outputFile string
+			layerBytes []byte
+		)
+
+		BeforeEach(func() {
+			var err error
+			partsDir, err = os.MkdirTemp("", "parts")
+			Expect(err).To(Succeed())
+
+			layerBytes = bytes.Repeat([]byte("some layer "), 100)
+			var parts []*os.File
+			w := split.NewWriter("layer.tgz", 300, func(index int) (io.Writer, error) {
+				f, err := os.Create(filepath.Join(partsDir, split.PartName("layer.tgz", index)))
+				parts = append(parts, f)
+				return f, err
+			})
+			_, err = w.Write(layerBytes)
+			Expect(err).To(Succeed())
+			for _, f := range parts {
+				Expect(f.Close()).To(Succeed())
+			}
+			manifest, err := json.Marshal(w.Manifest())
+			Expect(err).To(Succeed())
+			partsFile = filepath.Join(partsDir, "layer.tgz.parts.json")
+			Expect(os.WriteFile(partsFile, manifest, 0644)).To(Succeed())
+			outputFile = filepath.Join(partsDir, "joined.tgz")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(partsDir)).To(Succeed())
+		})
+
+		It("writes the joined layer", func() {
+			_, _, err := helpers.Execute(exec.Command(diffBin, "join", "-partsFile", partsFile, "-outputFile", outputFile))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.ReadFile(outputFile)).To(Equal(layerBytes))
+		})
+
+		It("fails without writing anything for a corrupted part", func() {
+			Expect(os.WriteFile(filepath.Join(partsDir, "layer.tgz.part0002"), []byte("corrupted"), 0644)).To(Succeed())
+
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "join", "-partsFile", partsFile, "-outputFile", outputFile))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(71))
+			Expect(stdErr.String()).To(ContainSubstring("part does not match the parts manifest"))
+			Expect(outputFile).ToNot(BeAnExistingFile())
+		})
+
+		It("verifies each part and reports every bad one", func() {
+			Expect(os.WriteFile(filepath.Join(partsDir, "layer.tgz.part0002"), []byte("corrupted"), 0644)).To(Succeed())
+			Expect(os.Remove(filepath.Join(partsDir, "layer.tgz.part0004"))).To(Succeed())
+
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "join", "-partsFile", partsFile, "-verify"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(71))
+			Expect(stdErr.String()).To(ContainSubstring("part 2 (layer.tgz.part0002)"))
+			Expect(stdErr.String()).To(ContainSubstring("Error opening part 4"))
+			Expect(stdErr.String()).ToNot(ContainSubstring("part 1 "))
+		})
+	})
+
+	Context("when reporting the disk usage of a layer", func() {
+		var layerFile string
+
+		BeforeEach(func() {
+			var layerBytes bytes.Buffer
+			t := tar.NewWriter(&layerBytes)
+			Expect(t.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "Files/Windows"})).To(Succeed())
+			Expect(t.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "Files/Windows/big.dll", Size: 5})).To(Succeed())
+			_, err := t.Write([]byte("12345"))
+			Expect(err).To(Succeed())
+			Expect(t.Close()).To(Succeed())
+
+			f, err := os.CreateTemp("", "layer*.tar")
+			Expect(err).To(Succeed())
+			_, err = f.Write(layerBytes.Bytes())
+			Expect(err).To(Succeed())
+			Expect(f.Close()).To(Succeed())
+			layerFile = f.Name()
+		})
+
+		AfterEach(func() {
+			Expect(os.Remove(layerFile)).To(Succeed())
+		})
+
+		It("prints the size of its directories, files and file types", func() {
+			stdOut, _, err := helpers.Execute(exec.Command(diffBin, "du", "-inputFile", layerFile, "-format", "json"))
+			Expect(err).ToNot(HaveOccurred())
+
+			var report diskusage.Report
+			Expect(json.Unmarshal(stdOut.Bytes(), &report)).To(Succeed())
+			Expect(report.Size).To(BeEquivalentTo(5))
+			Expect(report.Directories).To(ContainElement(diskusage.Directory{Path: "Files/Windows", Files: 1, Size: 5}))
+			Expect(report.LargestFiles).To(Equal([]diskusage.File{{Path: "Files/Windows/big.dll", Size: 5}}))
+			Expect(report.Types).To(Equal([]diskusage.Type{{Extension: ".dll", Files: 1, Size: 5}}))
+		})
+
+		It("errors for a negative depth", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "du", "-inputFile", layerFile, "-depth", "-1"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("depth must not be negative"))
+		})
+
+		It("fails for a missing layer", func() {
+			_, _, err := helpers.Execute(exec.Command(diffBin, "du", "-inputFile", layerFile+".missing"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(72))
+		})
+	})
+
+	Context("when converting a layer", func() {
+		var convertDir string
+
+		BeforeEach(func() {
+			var err error
+			convertDir, err = os.MkdirTemp("", "convert")
+			Expect(err).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(convertDir)).To(Succeed())
+		})
+
+		It("errors without an input file", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "convert", "-outputFile", filepath.Join(convertDir, "posix.tar")))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("must provide layer to convert"))
+		})
+
+		It("fails without writing anything for a layer that is not a tar", func() {
+			inputFile := filepath.Join(convertDir, "layer.tar")
+			Expect(os.WriteFile(inputFile, bytes.Repeat([]byte("not a tar"), 100), 0644)).To(Succeed())
+			outputFile := filepath.Join(convertDir, "posix.tar")
+
+			_, _, err := helpers.Execute(exec.Command(diffBin, "convert", "-inputFile", inputFile, "-outputFile", outputFile))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(70))
+			Expect(outputFile).ToNot(BeAnExistingFile())
+		})
+	})
+
+	Context("when exporting a batch", func() {
+		var jobsDir string
+
+		BeforeEach(func() {
+			var err error
+			jobsDir, err = os.MkdirTemp("", "batchjobs")
+			Expect(err).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(jobsDir)).To(Succeed())
+		})
+
+		It("summarizes failed exports and exits non-zero", func() {
+			jobsFile := filepath.Join(jobsDir, "jobs.csv")
+			jobs := fmt.Sprintf("containerId,bundlePath,outputFile\nsome-container-id,%s,%s\n", filepath.Join(jobsDir, "missing-bundle"), filepath.Join(jobsDir, "out.tgz"))
+			Expect(os.WriteFile(jobsFile, []byte(jobs), 0644)).To(Succeed())
+
+			stdOut, _, err := helpers.Execute(exec.Command(diffBin, "batch", "-jobs", jobsFile, "-concurrency", "2"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(3))
+
+			var summary map[string]interface{}
+			Expect(json.Unmarshal(stdOut.Bytes(), &summary)).To(Succeed())
+			Expect(summary).To(HaveKeyWithValue("total", BeEquivalentTo(1)))
+			Expect(summary).To(HaveKeyWithValue("failed", BeEquivalentTo(1)))
+			Expect(summary["results"]).To(ConsistOf(HaveKeyWithValue("error", ContainSubstring("bundle config.json could not be read"))))
+		})
+
+		It("errors on an invalid jobs file", func() {
+			jobsFile := filepath.Join(jobsDir, "jobs.json")
+			Expect(os.WriteFile(jobsFile, []byte(`[{"containerId": "some-container-id"}]`), 0644)).To(Succeed())
+
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "batch", "-jobs", jobsFile))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("must provide bundle path"))
+		})
 	})
 
 	Context("when missing outputFile", func() {
 		It("errors", func() {
 			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-containerId", "some-container-id", "-bundlePath", "some-bundle-path"))
 			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
 			Expect(stdErr.String()).To(ContainSubstring("must provide output file"))
 		})
 	})
@@ -91,4 +588,127 @@ var _ = Describe("diff_exporter", func() {
 			Expect(stdErr.String()).To(ContainSubstring("must provide bundle path"))
 		})
 	})
+
+	Context("when passing parent tarballs without squashing", func() {
+		It("errors", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", "some-output-file", "-containerId", "some-container-id", "-bundlePath", "some-bundle-path", "-squashParents", "parent.tgz"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("-squashParents can only be used with -squash"))
+		})
+	})
+
+	Context("when squashing and exporting parent layers", func() {
+		It("errors", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", "some-output-file", "-containerId", "some-container-id", "-bundlePath", "some-bundle-path", "-squash", "-parentsDir", "some-parents-dir"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("cannot use both -squash and -parentsDir"))
+		})
+	})
+
+	DescribeTable("when naming the sandbox and where sandboxes are kept",
+		func(flag, value string) {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", "some-output-file", "-containerId", "some-container-id", "-bundlePath", "some-bundle-path", "-sandboxPath", "some-sandbox", flag, value))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("cannot use both -sandboxPath and " + flag))
+		},
+		Entry("a driver store", "-driverStore", "some-driver-store"),
+		Entry("a volumes home", "-volumesHome", "some-volumes-home"),
+	)
+
+	DescribeTable("when encrypting the layer and writing an output in the clear",
+		func(flag, value string) {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", "some-output-file", "-containerId", "some-container-id", "-bundlePath", "some-bundle-path", "-encryptionKey", "some-key-file", flag, value))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("cannot use both -encryptionKey and " + flag))
+		},
+		Entry("the parent layers", "-parentsDir", "some-parents-dir"),
+		Entry("the manifest", "-manifestFile", "some-manifest-file"),
+		Entry("the sbom", "-sbomFile", "some-sbom-file"),
+		Entry("the usage report", "-usageFile", "some-usage-file"),
+	)
+
+	Context("when squashing and pruning unchanged files", func() {
+		It("errors", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", "some-output-file", "-containerId", "some-container-id", "-bundlePath", "some-bundle-path", "-squash", "-pruneUnchanged"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("cannot use both -squash and -pruneUnchanged"))
+		})
+	})
+
+	Context("when linking identical files without -hardLinks", func() {
+		It("errors", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", "some-output-file", "-containerId", "some-container-id", "-bundlePath", "some-bundle-path", "-linkIdentical"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("-linkIdentical can only be used with -hardLinks"))
+		})
+	})
+
+	Context("when given an unknown metadata policy", func() {
+		It("errors", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", "some-output-file", "-containerId", "some-container-id", "-bundlePath", "some-bundle-path", "-streamPolicy", "some-policy"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("must be keep, drop or drop:<patterns>"))
+		})
+	})
+
+	Context("when given an unknown reparse policy", func() {
+		It("errors", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", "some-output-file", "-containerId", "some-container-id", "-bundlePath", "some-bundle-path", "-reparsePolicy", "some-policy"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("must be preserve, symlink, dereference or skip"))
+		})
+	})
+
+	Context("when splitting a layer written to stdout", func() {
+		It("errors", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", "-", "-containerId", "some-container-id", "-bundlePath", "some-bundle-path", "-splitSize", "4G"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("cannot split a layer written to stdout"))
+		})
+	})
+
+	Context("when given an invalid split size", func() {
+		It("errors", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", "some-output-file", "-containerId", "some-container-id", "-bundlePath", "some-bundle-path", "-splitSize", "4X"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("must be a positive size in bytes"))
+		})
+	})
+
+	Context("when doing a dry run with an output file", func() {
+		It("errors", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-dryRun", "-outputFile", "some-output-file", "-containerId", "some-container-id", "-bundlePath", "some-bundle-path"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("cannot use both -dryRun and -outputFile"))
+		})
+	})
+
+	Context("when given a usage depth without -usageFile", func() {
+		It("errors", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", "some-output-file", "-containerId", "some-container-id", "-bundlePath", "some-bundle-path", "-usageDepth", "2"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("can only be used with -usageFile"))
+		})
+	})
+
+	Context("when given a report format without -dryRun", func() {
+		It("errors", func() {
+			_, stdErr, err := helpers.Execute(exec.Command(diffBin, "-outputFile", "some-output-file", "-containerId", "some-container-id", "-bundlePath", "some-bundle-path", "-reportFormat", "json"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*exec.ExitError).ExitCode()).To(Equal(2))
+			Expect(stdErr.String()).To(ContainSubstring("-reportFormat can only be used with -dryRun"))
+		})
+	})
 })
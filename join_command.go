@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/diff-exporter/split"
+)
+
+const (
+	joinCommand = "join"
+	joinUsage   = "USAGE: diff-exporter.exe join <-partsFile partsFile> <-outputFile outputFile | -verify> [-noClobber] [-errorFormat text|json]"
+)
+
+type joinConfig struct {
+	partsFile   string
+	outputFile  string
+	verify      bool
+	noClobber   bool
+	errorFormat string
+}
+
+// runJoin joins a layer exported with -splitSize back together, exiting
+// with exitJoin if it can't.
+func runJoin(args []string) {
+	cfg, err := parseJoinFlags(args)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, joinUsage)
+		os.Exit(0)
+	}
+	reporter := errorReporter{format: cfg.errorFormat, usage: joinUsage}
+	if err != nil {
+		reporter.exit(&stageError{stage: stageFlags, err: fmt.Errorf("Error parsing flags: %w", err)})
+	}
+
+	if cfg.verify {
+		err = verifyParts(cfg)
+	} else {
+		err = joinLayer(cfg)
+	}
+	if err != nil {
+		reporter.exit(err)
+	}
+}
+
+func readPartsFile(partsFile string) (split.Manifest, error) {
+	var m split.Manifest
+	manifestJSON, err := os.ReadFile(partsFile)
+	if err != nil {
+		return m, &stageError{stage: stageJoin, err: fmt.Errorf("Error reading parts file: %w", err)}
+	}
+	if err := json.Unmarshal(manifestJSON, &m); err != nil {
+		return m, &stageError{stage: stageJoin, err: fmt.Errorf("Error reading parts file: %w", err)}
+	}
+	return m, nil
+}
+
+// verifyParts checks each part on its own against the parts manifest,
+// reporting every part that is missing or doesn't match rather than only
+// the first.
+func verifyParts(cfg joinConfig) error {
+	m, err := readPartsFile(cfg.partsFile)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(cfg.partsFile)
+	var errs []error
+	for _, part := range m.Parts {
+		f, err := os.Open(filepath.Join(dir, filepath.Base(part.Name)))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error opening part %d: %w", part.Index, err))
+			continue
+		}
+		err = split.VerifyPart(part, f)
+		f.Close()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return &stageError{stage: stageJoin, err: fmt.Errorf("Error verifying parts: %w", errors.Join(errs...))}
+	}
+
+	fmt.Fprintf(os.Stderr, "Verified %d parts\n", len(m.Parts))
+	return nil
+}
+
+// joinLayer only moves the joined layer into place once every part and the
+// whole layer match the parts manifest.
+func joinLayer(cfg joinConfig) error {
+	m, err := readPartsFile(cfg.partsFile)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(cfg.partsFile)
+	return writeFileAtomically(cfg.outputFile, cfg.noClobber, func(w io.Writer) error {
+		err := split.Join(w, m, func(part split.Part) (io.ReadCloser, error) {
+			return os.Open(filepath.Join(dir, filepath.Base(part.Name)))
+		})
+		if err != nil {
+			return &stageError{stage: stageJoin, err: fmt.Errorf("Error joining layer: %w", err)}
+		}
+		return nil
+	})
+}
+
+func parseJoinFlags(args []string) (joinConfig, error) {
+	var cfg joinConfig
+	flags := flag.NewFlagSet("diff-exporter join", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&cfg.partsFile, "partsFile", "", "Parts manifest written with the layer's parts, which are read from the same directory")
+	flags.StringVar(&cfg.outputFile, "outputFile", "", "File to save the joined layer to")
+	flags.BoolVar(&cfg.verify, "verify", false, "Only check each part against the parts file, reporting every bad part, without joining them")
+	flags.BoolVar(&cfg.noClobber, "noClobber", false, "Refuse to overwrite an existing output file")
+	flags.StringVar(&cfg.errorFormat, "errorFormat", errorFormatText, "How to report errors on stderr: text or json")
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if err := checkErrorFormat(&cfg.errorFormat); err != nil {
+		return cfg, err
+	}
+	if cfg.partsFile == "" {
+		return cfg, errors.New("must provide parts file of the layer to join")
+	}
+	if cfg.verify && cfg.outputFile != "" {
+		return cfg, errors.New("cannot use both -verify and -outputFile")
+	}
+	if !cfg.verify && cfg.outputFile == "" {
+		return cfg, errors.New("must provide output file to save joined layer")
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,157 @@
+package layer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Microsoft/hcsshim"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Errors returned when a bundle can't be exported. They are wrapped with
+// details about the offending bundle; use errors.Is to check for them.
+var (
+	ErrConfigNotReadable   = errors.New("bundle config.json could not be read")
+	ErrConfigInvalid       = errors.New("bundle config.json is not a valid runtime spec")
+	ErrNoWindowsSection    = errors.New("bundle spec has no windows section")
+	ErrNoLayerFolders      = errors.New("bundle spec has no layer folders")
+	ErrLayerFolderNotFound = errors.New("layer folder does not exist")
+	ErrDriverStoreNotFound = errors.New("driver store could not be resolved")
+	ErrSandboxNotFound     = errors.New("sandbox does not exist")
+	ErrLayoutConflict      = errors.New("sandbox path can't be combined with a driver store or volumes home")
+)
+
+// Layout locates a container's layers on disk. Any field left empty is
+// derived from the bundle's config.json, so it only needs to be set for
+// stores that don't follow groot's default layout.
+type Layout struct {
+	// Spec is used instead of the bundle's config.json.
+	Spec *specs.Spec
+	// LayerFolders are the container's read-only parent layers, topmost
+	// first. They default to the spec's Windows.LayerFolders.
+	LayerFolders []string
+	// SandboxPath is the container's writable layer. It defaults to the
+	// container ID inside VolumesHome, and can't be set along with
+	// DriverStore or VolumesHome.
+	SandboxPath string
+	// DriverStore is the groot driver store. It defaults to two directories
+	// above the first layer folder.
+	DriverStore string
+	// VolumesHome holds the sandboxes. It defaults to DriverStore\volumes.
+	VolumesHome string
+}
+
+// ReadSpec parses a runtime spec such as a bundle's config.json.
+func ReadSpec(r io.Reader) (*specs.Spec, error) {
+	var bundleSpec specs.Spec
+	if err := json.NewDecoder(r).Decode(&bundleSpec); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrConfigInvalid, err)
+	}
+	return &bundleSpec, nil
+}
+
+func readBundleSpec(bundlePath string) (*specs.Spec, error) {
+	content, err := os.Open(filepath.Join(bundlePath, specConfig))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrConfigNotReadable, err)
+	}
+	defer content.Close()
+
+	return ReadSpec(content)
+}
+
+// validateSpec checks that the spec describes a Windows container's layers.
+func validateSpec(bundleSpec *specs.Spec) error {
+	if bundleSpec.Windows == nil {
+		return ErrNoWindowsSection
+	}
+	if len(bundleSpec.Windows.LayerFolders) == 0 {
+		return ErrNoLayerFolders
+	}
+	return nil
+}
+
+// resolvedLayout is everything the driver needs to read a container's layer.
+type resolvedLayout struct {
+	layerFolders []string
+	driverInfo   hcsshim.DriverInfo
+	layerId      string
+}
+
+// resolveLayout fills in whatever layout wasn't given explicitly and checks
+// that it exists on disk before the container's layer is touched.
+func (e *Exporter) resolveLayout(layout Layout) (resolvedLayout, error) {
+	if layout.SandboxPath != "" && (layout.DriverStore != "" || layout.VolumesHome != "") {
+		return resolvedLayout{}, fmt.Errorf("Error validating layout: %w", ErrLayoutConflict)
+	}
+
+	layerFolders := layout.LayerFolders
+	if len(layerFolders) == 0 {
+		bundleSpec := layout.Spec
+		if bundleSpec == nil {
+			var err error
+			bundleSpec, err = readBundleSpec(e.bundlePath)
+			if err != nil {
+				return resolvedLayout{}, fmt.Errorf("Error reading bundle: %w", err)
+			}
+		}
+		if err := validateSpec(bundleSpec); err != nil {
+			return resolvedLayout{}, fmt.Errorf("Error validating bundle: %w", err)
+		}
+		layerFolders = bundleSpec.Windows.LayerFolders
+	}
+
+	for _, folder := range layerFolders {
+		if err := checkDir(folder); err != nil {
+			return resolvedLayout{}, fmt.Errorf("Error validating bundle: %w: %w", ErrLayerFolderNotFound, err)
+		}
+	}
+
+	if layout.SandboxPath != "" {
+		if err := checkDir(layout.SandboxPath); err != nil {
+			return resolvedLayout{}, fmt.Errorf("Error validating bundle: %w: %w", ErrSandboxNotFound, err)
+		}
+		return resolvedLayout{
+			layerFolders: layerFolders,
+			driverInfo:   hcsshim.DriverInfo{Flavour: 1, HomeDir: filepath.Dir(layout.SandboxPath)},
+			layerId:      filepath.Base(layout.SandboxPath),
+		}, nil
+	}
+
+	volumeStore := layout.VolumesHome
+	if volumeStore == "" {
+		driverStore := layout.DriverStore
+		if driverStore == "" {
+			driverStore = getDriverStore(layerFolders[0])
+		}
+		volumeStore = filepath.Join(driverStore, "volumes")
+	}
+	if err := checkDir(volumeStore); err != nil {
+		return resolvedLayout{}, fmt.Errorf("Error validating bundle: %w: %w", ErrDriverStoreNotFound, err)
+	}
+
+	return resolvedLayout{
+		layerFolders: layerFolders,
+		driverInfo:   hcsshim.DriverInfo{Flavour: 1, HomeDir: volumeStore},
+		layerId:      e.containerId,
+	}, nil
+}
+
+func getDriverStore(layerPath string) string {
+	return filepath.Dir(filepath.Dir(layerPath))
+}
+
+func checkDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
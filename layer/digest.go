@@ -0,0 +1,202 @@
+package layer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+)
+
+const tarBlockSize = 512
+
+// tarDigester hashes the content of each entry of the tar stream written
+// through it. backuptar writes straight to the tar.Writer, so the content
+// can only be seen again on its way out.
+type tarDigester struct {
+	w io.Writer
+
+	// digests holds one digest per entry completed so far, in order,
+	// including the entries backuptar writes for alternate data streams.
+	// Entries without content, such as directories, have an empty digest.
+	digests []string
+
+	header    []byte
+	remaining int64
+	padding   int64
+	content   hash.Hash
+	// extended collects a pax header's records, which may override the
+	// next entry's size.
+	extended *bytes.Buffer
+	paxSize  int64
+}
+
+func newTarDigester(w io.Writer) *tarDigester {
+	return &tarDigester{w: w, paxSize: -1}
+}
+
+func (d *tarDigester) Write(p []byte) (int, error) {
+	if err := d.parse(p); err != nil {
+		return 0, err
+	}
+	return d.w.Write(p)
+}
+
+func (d *tarDigester) parse(p []byte) error {
+	for len(p) > 0 {
+		switch {
+		case d.remaining > 0:
+			n := int64(len(p))
+			if n > d.remaining {
+				n = d.remaining
+			}
+			switch {
+			case d.extended != nil:
+				d.extended.Write(p[:n])
+			case d.content != nil:
+				d.content.Write(p[:n])
+			}
+			d.remaining -= n
+			p = p[n:]
+			if d.remaining == 0 {
+				if err := d.finish(); err != nil {
+					return err
+				}
+			}
+		case d.padding > 0:
+			n := int64(len(p))
+			if n > d.padding {
+				n = d.padding
+			}
+			d.padding -= n
+			p = p[n:]
+		default:
+			n := tarBlockSize - len(d.header)
+			if n > len(p) {
+				n = len(p)
+			}
+			d.header = append(d.header, p[:n]...)
+			p = p[n:]
+			if len(d.header) == tarBlockSize {
+				err := d.start(d.header)
+				d.header = d.header[:0]
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// start begins the entry described by a header block.
+func (d *tarDigester) start(block []byte) error {
+	if bytes.Count(block, []byte{0}) == tarBlockSize {
+		// End of archive.
+		return nil
+	}
+
+	size, err := parseTarNumber(block[124:136])
+	if err != nil {
+		return err
+	}
+	switch block[156] {
+	case 'x':
+		d.extended = new(bytes.Buffer)
+	case 'g', 'L', 'K':
+		// Global pax headers and GNU long names aren't entries themselves.
+	case '1', '2', '3', '4', '5', '6':
+		// Links, devices and directories have no content to hash whatever
+		// their size says.
+		d.paxSize = -1
+		d.digests = append(d.digests, "")
+		size = 0
+	default:
+		if d.paxSize >= 0 {
+			size = d.paxSize
+			d.paxSize = -1
+		}
+		d.content = sha256.New()
+	}
+
+	d.remaining = size
+	d.padding = -size & (tarBlockSize - 1)
+	if size == 0 {
+		return d.finish()
+	}
+	return nil
+}
+
+// finish completes the current entry once all its content has been seen.
+func (d *tarDigester) finish() error {
+	if d.content != nil {
+		d.digests = append(d.digests, "sha256:"+hex.EncodeToString(d.content.Sum(nil)))
+		d.content = nil
+		return nil
+	}
+
+	if d.extended != nil {
+		size, ok, err := paxSize(d.extended.Bytes())
+		d.extended = nil
+		if err != nil {
+			return err
+		}
+		if ok {
+			d.paxSize = size
+		}
+	}
+	return nil
+}
+
+// parseTarNumber parses a tar header's numeric field, which is either octal
+// or, for values too large for it, base-256.
+func parseTarNumber(field []byte) (int64, error) {
+	if len(field) > 0 && field[0]&0x80 != 0 {
+		var n int64
+		for i, b := range field {
+			if i == 0 {
+				b &= 0x7f
+			}
+			n = n<<8 | int64(b)
+		}
+		return n, nil
+	}
+
+	s := string(bytes.Trim(field, " \x00"))
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 8, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid tar header number %q: %w", s, err)
+	}
+	return n, nil
+}
+
+// paxSize returns the size record of a pax header, whose records are of the
+// form "<length> <key>=<value>\n".
+func paxSize(records []byte) (int64, bool, error) {
+	for len(records) > 0 {
+		space := bytes.IndexByte(records, ' ')
+		if space < 0 {
+			return 0, false, fmt.Errorf("invalid pax record")
+		}
+		length, err := strconv.Atoi(string(records[:space]))
+		if err != nil || length <= space || length > len(records) {
+			return 0, false, fmt.Errorf("invalid pax record")
+		}
+		record := records[space+1 : length-1]
+		records = records[length:]
+
+		if value, ok := bytes.CutPrefix(record, []byte("size=")); ok {
+			size, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return 0, false, fmt.Errorf("invalid pax size %q: %w", value, err)
+			}
+			return size, true, nil
+		}
+	}
+	return 0, false, nil
+}
@@ -0,0 +1,34 @@
+package layer
+
+import (
+	winio "github.com/Microsoft/go-winio"
+	"github.com/Microsoft/hcsshim"
+)
+
+// Driver is the subset of the host's layer storage APIs the exporter uses.
+type Driver interface {
+	UnprepareLayer(info hcsshim.DriverInfo, layerId string) error
+	PrepareLayer(info hcsshim.DriverInfo, layerId string, parentLayerPaths []string) error
+	NewLayerReader(info hcsshim.DriverInfo, layerId string, parentLayerPaths []string) (hcsshim.LayerReader, error)
+	// RunWithBackupPrivilege runs fn on a thread holding SeBackupPrivilege,
+	// which is required to create and read from a layer reader.
+	RunWithBackupPrivilege(fn func() error) error
+}
+
+type hcsDriver struct{}
+
+func (hcsDriver) UnprepareLayer(info hcsshim.DriverInfo, layerId string) error {
+	return hcsshim.UnprepareLayer(info, layerId)
+}
+
+func (hcsDriver) PrepareLayer(info hcsshim.DriverInfo, layerId string, parentLayerPaths []string) error {
+	return hcsshim.PrepareLayer(info, layerId, parentLayerPaths)
+}
+
+func (hcsDriver) NewLayerReader(info hcsshim.DriverInfo, layerId string, parentLayerPaths []string) (hcsshim.LayerReader, error) {
+	return hcsshim.NewLayerReader(info, layerId, parentLayerPaths)
+}
+
+func (hcsDriver) RunWithBackupPrivilege(fn func() error) error {
+	return winio.RunWithPrivilege(winio.SeBackupPrivilege, fn)
+}
@@ -0,0 +1,75 @@
+package fakes
+
+import (
+	"sync"
+
+	"github.com/Microsoft/hcsshim"
+)
+
+// Driver is a fake layer.Driver that records the order in which it is called.
+type Driver struct {
+	mu    sync.Mutex
+	calls []string
+
+	UnprepareLayerError error
+	PrepareLayerError   error
+	Reader              hcsshim.LayerReader
+	NewLayerReaderError error
+	// Layers holds the entries of other layers by layer ID, e.g. the
+	// container's parents. Each read of one gets a new reader.
+	Layers map[string][]LayerEntry
+
+	UnprepareLayerInfo    hcsshim.DriverInfo
+	PrepareLayerInfo      hcsshim.DriverInfo
+	PrepareLayerParents   []string
+	NewLayerReaderInfo    hcsshim.DriverInfo
+	NewLayerReaderParents []string
+}
+
+func (d *Driver) UnprepareLayer(info hcsshim.DriverInfo, layerId string) error {
+	d.record("UnprepareLayer " + layerId)
+	d.UnprepareLayerInfo = info
+	return d.UnprepareLayerError
+}
+
+func (d *Driver) PrepareLayer(info hcsshim.DriverInfo, layerId string, parentLayerPaths []string) error {
+	d.record("PrepareLayer " + layerId)
+	d.PrepareLayerInfo = info
+	d.PrepareLayerParents = parentLayerPaths
+	return d.PrepareLayerError
+}
+
+func (d *Driver) NewLayerReader(info hcsshim.DriverInfo, layerId string, parentLayerPaths []string) (hcsshim.LayerReader, error) {
+	d.record("NewLayerReader " + layerId)
+	d.NewLayerReaderInfo = info
+	d.NewLayerReaderParents = parentLayerPaths
+	if d.NewLayerReaderError != nil {
+		return nil, d.NewLayerReaderError
+	}
+	if entries, ok := d.Layers[layerId]; ok {
+		return &LayerReader{Entries: entries}, nil
+	}
+	if r, ok := d.Reader.(*LayerReader); ok {
+		// The container's layer may be read more than once.
+		r.next, r.current = 0, nil
+		r.onClose = func() { d.record("LayerReader.Close") }
+	}
+	return d.Reader, nil
+}
+
+func (d *Driver) RunWithBackupPrivilege(fn func() error) error {
+	return fn()
+}
+
+// Calls returns the methods called so far, in order.
+func (d *Driver) Calls() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.calls...)
+}
+
+func (d *Driver) record(call string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls = append(d.calls, call)
+}
@@ -0,0 +1,224 @@
+package fakes
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"syscall"
+
+	winio "github.com/Microsoft/go-winio"
+)
+
+// LayerEntry is a path returned by LayerReader. A nil FileInfo is a whiteout.
+type LayerEntry struct {
+	Name     string
+	Size     int64
+	FileInfo *winio.FileBasicInfo
+	// Stream is the entry's content as a Win32 backup stream, see BackupStream.
+	Stream []byte
+	// Links is the number of hard links to the entry's file, 1 if unset,
+	// and FileID identifies the file they share.
+	Links  uint32
+	FileID winio.FileIDInfo
+}
+
+// LayerReader is a fake hcsshim.LayerReader serving Entries in order.
+type LayerReader struct {
+	Entries []LayerEntry
+	// NextError is returned by Next once Entries are exhausted instead of io.EOF.
+	NextError  error
+	CloseError error
+	Closed     bool
+
+	next    int
+	current *bytes.Reader
+	onClose func()
+}
+
+func (r *LayerReader) Next() (string, int64, *winio.FileBasicInfo, error) {
+	if r.next >= len(r.Entries) {
+		if r.NextError != nil {
+			return "", 0, nil, r.NextError
+		}
+		return "", 0, nil, io.EOF
+	}
+	entry := r.Entries[r.next]
+	r.next++
+	// Like hcsshim's, the backup stream starts after the file attributes.
+	r.current = bytes.NewReader(append(make([]byte, 4), entry.Stream...))
+	if _, err := r.current.Seek(4, io.SeekStart); err != nil {
+		return "", 0, nil, err
+	}
+	return entry.Name, entry.Size, entry.FileInfo, nil
+}
+
+func (r *LayerReader) LinkInfo() (uint32, *winio.FileIDInfo, error) {
+	if r.next == 0 {
+		return 0, nil, errors.New("no current file")
+	}
+	entry := r.Entries[r.next-1]
+	if entry.Links == 0 {
+		return 1, &entry.FileID, nil
+	}
+	return entry.Links, &entry.FileID, nil
+}
+
+func (r *LayerReader) Read(b []byte) (int, error) {
+	if r.current == nil {
+		return 0, io.EOF
+	}
+	return r.current.Read(b)
+}
+
+// Seek seeks within the current entry's stream, like hcsshim's reader does
+// for regular files.
+func (r *LayerReader) Seek(offset int64, whence int) (int64, error) {
+	if r.current == nil {
+		return 0, errors.New("no current file")
+	}
+	return r.current.Seek(offset, whence)
+}
+
+func (r *LayerReader) Close() error {
+	r.Closed = true
+	if r.onClose != nil {
+		r.onClose()
+	}
+	return r.CloseError
+}
+
+// BackupStream encodes data as the Win32 backup stream of a regular file.
+func BackupStream(data []byte) []byte {
+	var buf bytes.Buffer
+	w := winio.NewBackupStreamWriter(&buf)
+	if err := w.WriteHeader(&winio.BackupHeader{Id: winio.BackupData, Size: int64(len(data))}); err != nil {
+		panic(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// HardLink returns a regular file entry holding data that is one of links
+// hard links to the file identified by id.
+func HardLink(name string, data []byte, id byte, links uint32) LayerEntry {
+	entry := File(name, data)
+	entry.Links = links
+	entry.FileID.FileID[0] = id
+	return entry
+}
+
+// FileWithEAs returns a regular file entry holding data whose backup stream
+// carries eas ahead of the data, as Windows writes it.
+func FileWithEAs(name string, data []byte, eas []winio.ExtendedAttribute) LayerEntry {
+	encoded, err := winio.EncodeExtendedAttributes(eas)
+	if err != nil {
+		panic(err)
+	}
+
+	var buf bytes.Buffer
+	w := winio.NewBackupStreamWriter(&buf)
+	if err := w.WriteHeader(&winio.BackupHeader{Id: winio.BackupEaData, Size: int64(len(encoded))}); err != nil {
+		panic(err)
+	}
+	if _, err := w.Write(encoded); err != nil {
+		panic(err)
+	}
+
+	entry := File(name, data)
+	entry.Stream = append(buf.Bytes(), entry.Stream...)
+	return entry
+}
+
+// FileWithSecurity returns a regular file entry holding data whose backup
+// stream carries the security descriptor sd ahead of the data, as Windows
+// writes it.
+func FileWithSecurity(name string, data []byte, sd []byte) LayerEntry {
+	var buf bytes.Buffer
+	w := winio.NewBackupStreamWriter(&buf)
+	if err := w.WriteHeader(&winio.BackupHeader{Id: winio.BackupSecurity, Size: int64(len(sd))}); err != nil {
+		panic(err)
+	}
+	if _, err := w.Write(sd); err != nil {
+		panic(err)
+	}
+
+	entry := File(name, data)
+	entry.Stream = append(buf.Bytes(), entry.Stream...)
+	return entry
+}
+
+// AlternateStream is a named alternate data stream of a file.
+type AlternateStream struct {
+	Name string
+	Data []byte
+}
+
+// FileWithStreams returns a regular file entry holding data whose backup
+// stream carries streams after the data, as Windows writes it.
+func FileWithStreams(name string, data []byte, streams ...AlternateStream) LayerEntry {
+	entry := File(name, data)
+	buf := bytes.NewBuffer(entry.Stream)
+	w := winio.NewBackupStreamWriter(buf)
+	for _, stream := range streams {
+		if err := w.WriteHeader(&winio.BackupHeader{Id: winio.BackupAlternateData, Name: ":" + stream.Name + ":$DATA", Size: int64(len(stream.Data))}); err != nil {
+			panic(err)
+		}
+		if _, err := w.Write(stream.Data); err != nil {
+			panic(err)
+		}
+	}
+	entry.Stream = buf.Bytes()
+	return entry
+}
+
+// File returns a regular file entry holding data.
+func File(name string, data []byte) LayerEntry {
+	return LayerEntry{
+		Name:     name,
+		Size:     int64(len(data)),
+		FileInfo: &winio.FileBasicInfo{FileAttributes: syscall.FILE_ATTRIBUTE_NORMAL},
+		Stream:   BackupStream(data),
+	}
+}
+
+// Symlink returns a file symlink entry pointing to target.
+func Symlink(name, target string) LayerEntry {
+	return reparsePoint(name, &winio.ReparsePoint{Target: target}, syscall.FILE_ATTRIBUTE_REPARSE_POINT)
+}
+
+// Junction returns a directory junction entry pointing to target.
+func Junction(name, target string) LayerEntry {
+	return reparsePoint(name, &winio.ReparsePoint{Target: target, IsMountPoint: true}, syscall.FILE_ATTRIBUTE_REPARSE_POINT|syscall.FILE_ATTRIBUTE_DIRECTORY)
+}
+
+func reparsePoint(name string, rp *winio.ReparsePoint, attributes uint32) LayerEntry {
+	data := winio.EncodeReparsePoint(rp)
+	var buf bytes.Buffer
+	w := winio.NewBackupStreamWriter(&buf)
+	if err := w.WriteHeader(&winio.BackupHeader{Id: winio.BackupReparseData, Size: int64(len(data))}); err != nil {
+		panic(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		panic(err)
+	}
+	return LayerEntry{
+		Name:     name,
+		FileInfo: &winio.FileBasicInfo{FileAttributes: attributes},
+		Stream:   buf.Bytes(),
+	}
+}
+
+// Directory returns a directory entry.
+func Directory(name string) LayerEntry {
+	return LayerEntry{
+		Name:     name,
+		FileInfo: &winio.FileBasicInfo{FileAttributes: syscall.FILE_ATTRIBUTE_DIRECTORY},
+	}
+}
+
+// Whiteout returns an entry for a path deleted in the layer.
+func Whiteout(name string) LayerEntry {
+	return LayerEntry{Name: name}
+}
@@ -2,121 +2,487 @@ package layer
 
 import (
 	"compress/gzip"
-	"encoding/json"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
-	"os"
 	"path/filepath"
+	"syscall"
 
 	"archive/tar"
 
-	winio "github.com/Microsoft/go-winio"
-	"github.com/Microsoft/go-winio/backuptar"
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
 	"github.com/Microsoft/hcsshim"
-	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/windows"
 )
 
-const (
-	specConfig     = "config.json"
-	whiteoutPrefix = ".wh."
-)
+const specConfig = "config.json"
 
 type Exporter struct {
 	containerId string
 	bundlePath  string
+	driver      Driver
 }
 
 func New(containerId string, bundlePath string) *Exporter {
+	return NewWithDriver(containerId, bundlePath, hcsDriver{})
+}
+
+func NewWithDriver(containerId string, bundlePath string, driver Driver) *Exporter {
 	return &Exporter{
 		containerId: containerId,
 		bundlePath:  bundlePath,
+		driver:      driver,
 	}
 }
 
+// Export unprepares the container's layer and returns it as a gzipped tar
+// stream. Errors hit while streaming are returned from the reader.
 func (e *Exporter) Export() (io.ReadCloser, error) {
-	// read config.json from bundle directory
-	content, err := os.ReadFile(filepath.Join(e.bundlePath, specConfig))
+	layout, err := e.unprepare(Layout{})
 	if err != nil {
-		return nil, fmt.Errorf("Error reading bundle config.json: %s", err.Error())
+		return nil, err
+	}
+
+	archive, w := io.Pipe()
+	go func() {
+		_, err := e.exportLayer(context.Background(), layout, w, Options{})
+		w.CloseWithError(err)
+	}()
+
+	return archive, nil
+}
+
+// ExportTo unprepares the container's layer and writes it to w, returning
+// once the whole layer has been written or ctx is done.
+func (e *Exporter) ExportTo(ctx context.Context, w io.Writer, opts Options) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
 	}
 
-	// parse bundle spec
-	var bundleSpec specs.Spec
-	err = json.Unmarshal(content, &bundleSpec)
+	layout, err := e.resolveLayout(opts.Layout)
 	if err != nil {
-		return nil, fmt.Errorf("Error unmarshaling bundle: %s", err.Error())
+		return Result{}, withStage(StageSpec, err)
+	}
+	if opts.Squash {
+		if err := checkParentHives(layout.layerFolders, opts.ParentTarballs); err != nil {
+			return Result{}, withStage(StageReader, err)
+		}
+	}
+	if err := e.unprepareLayer(layout); err != nil {
+		return Result{}, err
 	}
 
-	// setup driver info
-	driverStore := getDriverStore(bundleSpec.Windows.LayerFolders[0])
-	volumeStore := filepath.Join(driverStore, "volumes")
-	driverInfo := hcsshim.DriverInfo{Flavour: 1, HomeDir: volumeStore}
+	return e.exportLayer(ctx, layout, w, opts)
+}
 
-	// unprepare layer
-	err = hcsshim.UnprepareLayer(driverInfo, e.containerId)
+func (e *Exporter) unprepare(layout Layout) (resolvedLayout, error) {
+	resolved, err := e.resolveLayout(layout)
 	if err != nil {
-		return nil, fmt.Errorf("Error unpreparing layer: %s", err.Error())
+		return resolvedLayout{}, withStage(StageSpec, err)
 	}
-
-	return exportLayer(e.containerId, bundleSpec.Windows.LayerFolders, driverInfo)
+	return resolved, e.unprepareLayer(resolved)
 }
 
-func getDriverStore(layerPath string) string {
-	return filepath.Dir(filepath.Dir(layerPath))
+func (e *Exporter) unprepareLayer(layout resolvedLayout) error {
+	err := e.driver.UnprepareLayer(layout.driverInfo, layout.layerId)
+	if err != nil {
+		return withStage(StageUnprepare, fmt.Errorf("Error unpreparing layer: %s", err.Error()))
+	}
+	return nil
 }
 
-func exportLayer(cid string, parentLayerPaths []string, driverInfo hcsshim.DriverInfo) (io.ReadCloser, error) {
-	archive, w := io.Pipe()
-	go func() {
-		err := winio.RunWithPrivilege(winio.SeBackupPrivilege, func() error {
-			r, err := hcsshim.NewLayerReader(driverInfo, cid, parentLayerPaths)
-			if err != nil {
-				return err
-			}
+func (e *Exporter) exportLayer(ctx context.Context, layout resolvedLayout, w io.Writer, opts Options) (Result, error) {
+	var result Result
+	err := e.driver.RunWithBackupPrivilege(func() error {
+		if opts.Squash {
+			var err error
+			result, err = squashLayers(ctx, e.squashSources(layout, opts), stageWriter{w}, opts)
+			return err
+		}
 
-			err = writeTarFromLayer(r, w)
-			cerr := r.Close()
-			if err == nil {
-				err = cerr
-			}
+		r, err := e.driver.NewLayerReader(layout.driverInfo, layout.layerId, layout.layerFolders)
+		if err != nil {
 			return err
-		})
-		w.CloseWithError(err)
-	}()
+		}
 
-	return archive, nil
+		result, err = writeTarFromLayer(ctx, r, stageWriter{w}, opts, layout.layerFolders)
+		cerr := r.Close()
+		if err == nil {
+			err = cerr
+		}
+		return err
+	})
+	err = withStage(StageReader, err)
+
+	if opts.Reprepare {
+		perr := e.driver.PrepareLayer(layout.driverInfo, layout.layerId, layout.layerFolders)
+		if perr != nil {
+			perr = withStage(StageReprepare, fmt.Errorf("Error re-preparing layer: %s", perr.Error()))
+			if err == nil {
+				return result, perr
+			}
+			return result, fmt.Errorf("%w (%s)", err, perr.Error())
+		}
+	}
+	return result, err
 }
 
-func writeTarFromLayer(r hcsshim.LayerReader, w io.Writer) error {
-	g := gzip.NewWriter(w)
-	t := tar.NewWriter(g)
+// writeTarFromLayer writes the entries read from r as a tar stream to w.
+// parents are the container's parent layer folders, which entries are looked
+// up in to tell whether they were added or modified.
+func writeTarFromLayer(ctx context.Context, r hcsshim.LayerReader, w io.Writer, opts Options, parents []string) (Result, error) {
+	var result Result
+
+	output, err := newLayerOutput(w, opts)
+	if err != nil {
+		return result, err
+	}
+	t := output.t
+	links := newHardLinks(opts)
+	filter := newMetadataFilter(opts)
+	var files *layerFiles
+	var deref []dereference
+	if opts.Reparse == ReparseDereference {
+		files = newLayerFiles()
+	}
+	layerStream, stream := newCountingReader(r)
 	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
 		name, size, fileInfo, err := r.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			return result, err
 		}
-		if fileInfo == nil {
+
+		entry := Entry{Name: filepath.ToSlash(name), Size: size, FileInfo: fileInfo, Whiteout: fileInfo == nil}
+		var parentFile string
+		if opts.needsChange() {
+			inParent := false
+			if !entry.Whiteout {
+				parentFile, inParent = findInParents(name, parents)
+			}
+			entry.Change = changeOf(entry.Whiteout, inParent)
+		}
+		if !opts.keep(entry) || (isReparsePoint(fileInfo) && opts.Reparse == ReparseSkip) {
+			files.addOther(entry.Name)
+			result.Skipped++
+			continue
+		}
+		if opts.DryRun {
+			if entry.Whiteout {
+				result.Whiteouts++
+			}
+			result.Entries++
+			if opts.OnEntry != nil {
+				opts.OnEntry(entry)
+			}
+			continue
+		}
+		// Preserved reparse points are written by backuptar like any other
+		// entry once their target has been checked.
+		if isReparsePoint(fileInfo) {
+			target, err := reparseTarget(entry.Name, stream)
+			if err != nil {
+				return result, err
+			}
+			// Only links to files can be dereferenced, so links to
+			// directories are written as symlinks instead.
+			dirLink := opts.Reparse == ReparseDereference && fileInfo.FileAttributes&syscall.FILE_ATTRIBUTE_DIRECTORY != 0
+			switch {
+			case opts.Reparse == ReparseSymlink || dirLink:
+				output.startEntry()
+				if err := t.WriteHeader(symlinkHeader(entry.Name, target, fileInfo)); err != nil {
+					return result, err
+				}
+				files.addOther(entry.Name)
+				result.Entries++
+				if dirLink {
+					result.DirectoryLinks++
+				}
+				if opts.OnEntry != nil {
+					opts.OnEntry(entry)
+				}
+				continue
+			case opts.Reparse == ReparseDereference:
+				deref = append(deref, dereference{entry: entry, target: target})
+				files.addOther(entry.Name)
+				continue
+			}
+		}
+		if opts.PruneUnchanged && entry.Change == ChangeModified {
+			same, err := unchanged(stream, size, fileInfo, parentFile)
+			if err != nil {
+				return result, err
+			}
+			if same {
+				result.Pruned++
+				result.PrunedBytes += size
+				continue
+			}
+		}
+
+		if links != nil && !entry.Whiteout {
+			target, ok, err := links.match(r, stream, size, fileInfo)
+			if err != nil {
+				return result, err
+			}
+			if ok {
+				hdr := &tar.Header{Typeflag: tar.TypeLink, Name: entry.Name, Linkname: target.name}
+				if err := t.WriteHeader(hdr); err != nil {
+					return result, err
+				}
+				entry.Link = target.name
+				entry.Digest = target.digest
+				files.addFile(entry.Name, target)
+				result.Entries++
+				result.Links++
+				result.LinkedBytes += size
+				if opts.OnEntry != nil {
+					opts.OnEntry(entry)
+				}
+				continue
+			}
+		}
+
+		output.startEntry()
+		if entry.Whiteout {
 			// Write a whiteout file.
 			hdr := &tar.Header{
-				Name: filepath.ToSlash(filepath.Join(filepath.Dir(name), whiteoutPrefix+filepath.Base(name))),
+				Name: filepath.ToSlash(filepath.Join(filepath.Dir(name), layerfmt.WhiteoutPrefix+filepath.Base(name))),
 			}
 			err := t.WriteHeader(hdr)
 			if err != nil {
-				return err
+				return result, err
 			}
+			files.addOther(entry.Name)
+			result.Whiteouts++
 		} else {
-			err = backuptar.WriteTarFileFromBackupStream(t, r, name, size, fileInfo)
+			err = filter.writeBackupStream(t, stream, name, size, fileInfo)
 			if err != nil {
-				return err
+				return result, err
+			}
+			entry.Digest = output.entryDigest()
+			if links != nil {
+				links.add(linkTarget{name: entry.Name, digest: entry.Digest})
+			}
+			if isRegular(fileInfo) {
+				files.addFile(entry.Name, linkTarget{name: entry.Name, digest: entry.Digest})
+			} else {
+				files.addOther(entry.Name)
 			}
 		}
+		result.Entries++
+
+		if opts.OnEntry != nil {
+			opts.OnEntry(entry)
+		}
 	}
-	err := t.Close()
-	if err != nil {
+
+	if err := writeDereferenced(deref, files, output, filter, parents, opts, &result); err != nil {
+		return result, err
+	}
+
+	result.BytesRead = layerStream.n
+	if opts.DryRun {
+		return result, nil
+	}
+	filter.record(&result)
+	err = output.close(&result)
+	return result, err
+}
+
+// layerOutput is the tar writer an exported layer is written through, along
+// with the compression, hashing and counting done on the way to w.
+type layerOutput struct {
+	t *tar.Writer
+
+	digest     hash.Hash
+	out        *countingWriter
+	compressor io.WriteCloser
+	tarStream  *countingWriter
+	digester   *tarDigester
+}
+
+func newLayerOutput(w io.Writer, opts Options) (*layerOutput, error) {
+	o := &layerOutput{digest: sha256.New()}
+	o.out = &countingWriter{w: io.MultiWriter(w, o.digest)}
+
+	switch opts.Compression {
+	case CompressionGzip:
+		level := opts.CompressionLevel
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		g, err := gzip.NewWriterLevel(o.out, level)
+		if err != nil {
+			return nil, err
+		}
+		o.compressor = g
+	case CompressionNone:
+		o.compressor = nopWriteCloser{o.out}
+	default:
+		return nil, fmt.Errorf("unknown compression %d", opts.Compression)
+	}
+
+	o.tarStream = &countingWriter{w: o.compressor}
+	if opts.Tee != nil {
+		o.tarStream.w = io.MultiWriter(o.compressor, stageWriter{opts.Tee})
+	}
+	var tarOut io.Writer = o.tarStream
+	if opts.DigestEntries {
+		o.digester = newTarDigester(o.tarStream)
+		tarOut = o.digester
+	}
+	o.t = tar.NewWriter(tarOut)
+	return o, nil
+}
+
+// startEntry must be called before each entry is written.
+func (o *layerOutput) startEntry() {
+	if o.digester != nil {
+		o.digester.digests = o.digester.digests[:0]
+	}
+}
+
+// entryDigest returns the digest of the content of the entry just written,
+// if entries are being digested.
+func (o *layerOutput) entryDigest() string {
+	// Any further digests belong to the file's alternate data streams.
+	if o.digester != nil && len(o.digester.digests) > 0 {
+		return o.digester.digests[0]
+	}
+	return ""
+}
+
+// close finishes the stream, recording its digest and sizes in result.
+func (o *layerOutput) close(result *Result) error {
+	if err := o.t.Close(); err != nil {
+		return err
+	}
+	if err := o.compressor.Close(); err != nil {
 		return err
 	}
-	return g.Close()
+
+	result.Digest = "sha256:" + hex.EncodeToString(o.digest.Sum(nil))
+	result.Size = o.out.n
+	result.UncompressedSize = o.tarStream.n
+	return nil
+}
+
+// changeOf tells whether an entry was added, modified or deleted in the
+// container.
+func changeOf(whiteout, inParent bool) Change {
+	switch {
+	case whiteout:
+		return ChangeDeleted
+	case inParent:
+		return ChangeModified
+	default:
+		return ChangeAdded
+	}
+}
+
+// findInParents returns the topmost parent layer's version of name. It stops
+// at the first parent that deleted name, as the layers below it are hidden.
+func findInParents(name string, parents []string) (string, bool) {
+	for _, parent := range parents {
+		path := filepath.Join(parent, name)
+		tombstone, err := isTombstone(path)
+		if err != nil {
+			continue
+		}
+		if tombstone {
+			return "", false
+		}
+		return path, true
+	}
+	return "", false
+}
+
+// isTombstone tells whether path is where a read-only layer records that it
+// deleted a file from the layers below it. It fails if path doesn't exist.
+func isTombstone(path string) (bool, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return false, err
+	}
+	var data windows.Win32finddata
+	h, err := windows.FindFirstFile(p, &data)
+	if err != nil {
+		return false, err
+	}
+	windows.FindClose(h)
+	return data.FileAttributes&windows.FILE_ATTRIBUTE_REPARSE_POINT != 0 && data.Reserved0 == reparseTagTombstone, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// newCountingReader also returns the reader to read from, which stays
+// seekable when r is since backuptar only keeps a file's extended attributes
+// when it can seek back to its data.
+func newCountingReader(r io.Reader) (*countingReader, io.Reader) {
+	c := &countingReader{r: r}
+	if s, ok := r.(io.Seeker); ok {
+		return c, countingReadSeeker{countingReader: c, Seeker: s}
+	}
+	return c, c
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReadSeeker struct {
+	*countingReader
+	io.Seeker
+}
+
+// rewindable returns a function seeking stream back to where it is now, so
+// it can be read again. The layer reader's backup streams don't start at
+// offset 0.
+func rewindable(stream io.Reader) (func() error, bool) {
+	seeker, ok := stream.(io.Seeker)
+	if !ok {
+		return nil, false
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, false
+	}
+	return func() error {
+		_, err := seeker.Seek(start, io.SeekStart)
+		return err
+	}, true
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
 }
@@ -0,0 +1,1129 @@
+package layer_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"code.cloudfoundry.org/diff-exporter/layer"
+	"code.cloudfoundry.org/diff-exporter/layer/fakes"
+	winio "github.com/Microsoft/go-winio"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/windows"
+)
+
+var _ = Describe("Exporter", func() {
+	var (
+		driverStore  string
+		bundlePath   string
+		layerFolders []string
+		reader       *fakes.LayerReader
+		driver       *fakes.Driver
+		exporter     *layer.Exporter
+		output       *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		var err error
+		driverStore, err = os.MkdirTemp("", "driverstore")
+		Expect(err).ToNot(HaveOccurred())
+
+		layerFolders = []string{
+			filepath.Join(driverStore, "layers", "top"),
+			filepath.Join(driverStore, "layers", "base"),
+		}
+		for _, folder := range layerFolders {
+			Expect(os.MkdirAll(folder, 0755)).To(Succeed())
+		}
+		Expect(os.MkdirAll(filepath.Join(driverStore, "volumes"), 0755)).To(Succeed())
+
+		bundlePath = filepath.Join(driverStore, "bundle")
+		writeBundle(bundlePath, specs.Spec{Windows: &specs.Windows{LayerFolders: layerFolders}})
+
+		reader = &fakes.LayerReader{
+			Entries: []fakes.LayerEntry{
+				fakes.Directory(`Files\dir`),
+				fakes.File(`Files\dir\hello.txt`, []byte("hello")),
+				fakes.Whiteout(`Files\deleted.txt`),
+			},
+		}
+		driver = &fakes.Driver{Reader: reader}
+		exporter = layer.NewWithDriver("some-container-id", bundlePath, driver)
+		output = new(bytes.Buffer)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(driverStore)).To(Succeed())
+	})
+
+	Describe("ExportTo", func() {
+		It("unprepares the container's layer in the driver store's volumes", func() {
+			_, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(driver.UnprepareLayerInfo.HomeDir).To(Equal(filepath.Join(driverStore, "volumes")))
+			Expect(driver.NewLayerReaderInfo.HomeDir).To(Equal(filepath.Join(driverStore, "volumes")))
+			Expect(driver.NewLayerReaderParents).To(Equal(layerFolders))
+			Expect(driver.Calls()).To(Equal([]string{
+				"UnprepareLayer some-container-id",
+				"NewLayerReader some-container-id",
+				"LayerReader.Close",
+			}))
+		})
+
+		It("writes the layer as a gzipped tar with whiteouts for deleted files", func() {
+			_, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+			Expect(err).ToNot(HaveOccurred())
+
+			entries := readTar(gunzip(output.Bytes()))
+			Expect(entries).To(Equal(map[string]string{
+				"Files/dir":             "",
+				"Files/dir/hello.txt":   "hello",
+				"Files/.wh.deleted.txt": "",
+			}))
+		})
+
+		It("describes the written layer in the result", func() {
+			result, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+			Expect(err).ToNot(HaveOccurred())
+
+			sum := sha256.Sum256(output.Bytes())
+			Expect(result.Digest).To(Equal("sha256:" + hex.EncodeToString(sum[:])))
+			Expect(result.Size).To(Equal(int64(output.Len())))
+			Expect(result.UncompressedSize).To(Equal(int64(len(gunzip(output.Bytes())))))
+			Expect(result.BytesRead).To(BeNumerically(">=", len(fakes.BackupStream([]byte("hello")))))
+			Expect(result.Entries).To(Equal(3))
+			Expect(result.Whiteouts).To(Equal(1))
+			Expect(result.Skipped).To(Equal(0))
+		})
+
+		It("keeps the extended attributes of files", func() {
+			eas := []winio.ExtendedAttribute{{Name: "user.test", Value: []byte("value")}}
+			reader.Entries = []fakes.LayerEntry{fakes.FileWithEAs(`Files\hello.txt`, []byte("hello"), eas)}
+
+			_, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+			Expect(err).ToNot(HaveOccurred())
+
+			hdr, err := tar.NewReader(bytes.NewReader(gunzip(output.Bytes()))).Next()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hdr.PAXRecords).To(HaveKey("MSWINDOWS.xattr.user.test"))
+		})
+
+		Context("with metadata policies", func() {
+			BeforeEach(func() {
+				eas := []winio.ExtendedAttribute{{Name: "user.keep", Value: []byte("value")}, {Name: "user.drop", Value: []byte("value")}}
+				reader.Entries = []fakes.LayerEntry{
+					fakes.FileWithEAs(`Files\hello.txt`, []byte("hello"), eas),
+					fakes.FileWithStreams(`Files\setup.exe`, []byte("setup"),
+						fakes.AlternateStream{Name: "Zone.Identifier", Data: []byte("[ZoneTransfer]")},
+						fakes.AlternateStream{Name: "kept", Data: []byte("kept")},
+					),
+				}
+			})
+
+			It("keeps every stream and attribute by default", func() {
+				result, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(tarNames(gunzip(output.Bytes()))).To(ContainElements("Files/setup.exe:Zone.Identifier", "Files/setup.exe:kept"))
+				Expect(result.DroppedStreams).To(Equal(0))
+				Expect(result.DroppedEAs).To(Equal(0))
+			})
+
+			It("drops alternate data streams and extended attributes matching a pattern", func() {
+				result, err := exporter.ExportTo(context.Background(), output, layer.Options{
+					AlternateDataStreams: layer.MetadataPolicy{Drop: []string{"zone.identifier"}},
+					ExtendedAttributes:   layer.MetadataPolicy{Drop: []string{"user.d*"}},
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				content := gunzip(output.Bytes())
+				Expect(readTar(content)).To(Equal(map[string]string{
+					"Files/hello.txt":      "hello",
+					"Files/setup.exe":      "setup",
+					"Files/setup.exe:kept": "kept",
+				}))
+				hdr, err := tar.NewReader(bytes.NewReader(content)).Next()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(hdr.PAXRecords).To(HaveKey("MSWINDOWS.xattr.user.keep"))
+				Expect(hdr.PAXRecords).ToNot(HaveKey("MSWINDOWS.xattr.user.drop"))
+				Expect(result.DroppedStreams).To(Equal(1))
+				Expect(result.DroppedEAs).To(Equal(1))
+			})
+
+			It("drops all of them", func() {
+				result, err := exporter.ExportTo(context.Background(), output, layer.Options{
+					AlternateDataStreams: layer.MetadataPolicy{DropAll: true},
+					ExtendedAttributes:   layer.MetadataPolicy{DropAll: true},
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				content := gunzip(output.Bytes())
+				Expect(tarNames(content)).To(Equal([]string{"Files/hello.txt", "Files/setup.exe"}))
+				hdr, err := tar.NewReader(bytes.NewReader(content)).Next()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(hdr.PAXRecords).ToNot(HaveKey(HavePrefix("MSWINDOWS.xattr.")))
+				Expect(result.DroppedStreams).To(Equal(2))
+				Expect(result.DroppedEAs).To(Equal(2))
+			})
+		})
+
+		Context("with reparse points", func() {
+			BeforeEach(func() {
+				reader.Entries = append(reader.Entries,
+					fakes.Symlink(`Files\dir\absolute`, `C:\dir\hello.txt`),
+					fakes.Symlink(`Files\dir\relative`, `hello.txt`),
+				)
+			})
+
+			It("preserves them by default", func() {
+				_, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+				Expect(err).ToNot(HaveOccurred())
+
+				headers := tarHeaders(gunzip(output.Bytes()))
+				Expect(headers["Files/dir/absolute"].Typeflag).To(Equal(byte(tar.TypeSymlink)))
+				Expect(headers["Files/dir/absolute"].Linkname).To(Equal(`\??\C:\dir\hello.txt`))
+				Expect(headers["Files/dir/absolute"].PAXRecords).To(HaveKey("MSWINDOWS.fileattr"))
+			})
+
+			It("writes them as plain symlinks relative to the link", func() {
+				_, err := exporter.ExportTo(context.Background(), output, layer.Options{Reparse: layer.ReparseSymlink})
+				Expect(err).ToNot(HaveOccurred())
+
+				headers := tarHeaders(gunzip(output.Bytes()))
+				for _, name := range []string{"Files/dir/absolute", "Files/dir/relative"} {
+					Expect(headers[name].Typeflag).To(Equal(byte(tar.TypeSymlink)))
+					Expect(headers[name].Linkname).To(Equal("hello.txt"))
+					Expect(headers[name].PAXRecords).To(BeEmpty())
+				}
+			})
+
+			It("dereferences them to files in the layer", func() {
+				var seen []layer.Entry
+				opts := layer.Options{Reparse: layer.ReparseDereference, OnEntry: func(entry layer.Entry) { seen = append(seen, entry) }}
+				result, err := exporter.ExportTo(context.Background(), output, opts)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(tarLinks(gunzip(output.Bytes()))).To(Equal(map[string]string{
+					"Files/dir/absolute": "Files/dir/hello.txt",
+					"Files/dir/relative": "Files/dir/hello.txt",
+				}))
+				Expect(result.Entries).To(Equal(5))
+				Expect(seen[4].Link).To(Equal("Files/dir/hello.txt"))
+			})
+
+			It("dereferences them to files in the parent layers", func() {
+				Expect(os.MkdirAll(filepath.Join(layerFolders[1], "Files"), 0755)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(layerFolders[1], "Files", "base.txt"), []byte("base"), 0644)).To(Succeed())
+				reader.Entries = append(reader.Entries, fakes.Symlink(`Files\dir\parent`, `..\base.txt`))
+
+				_, err := exporter.ExportTo(context.Background(), output, layer.Options{Reparse: layer.ReparseDereference})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(readTar(gunzip(output.Bytes()))).To(HaveKeyWithValue("Files/dir/parent", "base"))
+			})
+
+			It("fails to dereference them to anything but a file", func() {
+				reader.Entries = append(reader.Entries, fakes.Symlink(`Files\dir\deleted`, `C:\deleted.txt`))
+
+				_, err := exporter.ExportTo(context.Background(), output, layer.Options{Reparse: layer.ReparseDereference})
+				Expect(err).To(MatchError(layer.ErrReparseTargetNotFile))
+			})
+
+			It("skips them", func() {
+				reader.Entries = append(reader.Entries, fakes.Junction(`Files\data`, `D:\data`))
+
+				result, err := exporter.ExportTo(context.Background(), output, layer.Options{Reparse: layer.ReparseSkip})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(tarNames(gunzip(output.Bytes()))).To(Equal([]string{"Files/dir", "Files/dir/hello.txt", "Files/.wh.deleted.txt"}))
+				Expect(result.Skipped).To(Equal(3))
+			})
+
+			It("writes junctions as symlinks when dereferencing", func() {
+				reader.Entries = append(reader.Entries, fakes.Junction(`Files\link`, `C:\dir`))
+
+				result, err := exporter.ExportTo(context.Background(), output, layer.Options{Reparse: layer.ReparseDereference})
+				Expect(err).ToNot(HaveOccurred())
+
+				headers := tarHeaders(gunzip(output.Bytes()))
+				Expect(headers["Files/link"].Typeflag).To(Equal(byte(tar.TypeSymlink)))
+				Expect(headers["Files/link"].Linkname).To(Equal("dir"))
+				Expect(result.DirectoryLinks).To(Equal(1))
+			})
+
+			DescribeTable("fails when they point outside the layer",
+				func(policy layer.ReparsePolicy, target string) {
+					reader.Entries = append(reader.Entries, fakes.Junction(`Files\dir\outside`, target))
+
+					_, err := exporter.ExportTo(context.Background(), output, layer.Options{Reparse: policy})
+					Expect(err).To(MatchError(layer.ErrReparseTargetOutsideLayer))
+					Expect(err).To(MatchError(ContainSubstring("Files/dir/outside")))
+				},
+				Entry("preserving a link to another drive", layer.ReparsePreserve, `D:\data`),
+				Entry("preserving a link above the layer's root", layer.ReparsePreserve, `..\..\..\data`),
+				Entry("dereferencing a link to a share", layer.ReparseDereference, `\\server\share`),
+				Entry("another drive", layer.ReparseSymlink, `D:\data`),
+				Entry("a share", layer.ReparseSymlink, `\\server\share`),
+				Entry("a volume", layer.ReparseSymlink, `\\?\Volume{00000000-0000-0000-0000-000000000000}\`),
+				Entry("above the layer's root", layer.ReparseSymlink, `..\..\..\data`),
+			)
+		})
+
+		It("copies the uncompressed tar stream to Tee", func() {
+			tee := new(bytes.Buffer)
+			_, err := exporter.ExportTo(context.Background(), output, layer.Options{Tee: tee})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(tee.Bytes()).To(Equal(gunzip(output.Bytes())))
+		})
+
+		It("writes an uncompressed tar when compression is disabled", func() {
+			result, err := exporter.ExportTo(context.Background(), output, layer.Options{Compression: layer.CompressionNone})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(readTar(output.Bytes())).To(HaveKeyWithValue("Files/dir/hello.txt", "hello"))
+			Expect(result.UncompressedSize).To(Equal(result.Size))
+		})
+
+		It("rejects an invalid compression level", func() {
+			_, err := exporter.ExportTo(context.Background(), output, layer.Options{CompressionLevel: 42})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("skips entries rejected by a filter", func() {
+			noWhiteouts := func(entry layer.Entry) bool { return !entry.Whiteout }
+
+			result, err := exporter.ExportTo(context.Background(), output, layer.Options{Filters: []layer.Filter{noWhiteouts}})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(readTar(gunzip(output.Bytes()))).ToNot(HaveKey("Files/.wh.deleted.txt"))
+			Expect(result.Entries).To(Equal(2))
+			Expect(result.Skipped).To(Equal(1))
+		})
+
+		It("calls OnEntry for every written entry", func() {
+			var seen []layer.Entry
+			opts := layer.Options{OnEntry: func(entry layer.Entry) { seen = append(seen, entry) }}
+
+			_, err := exporter.ExportTo(context.Background(), output, opts)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(seen).To(HaveLen(3))
+			Expect(seen[1].Name).To(Equal("Files/dir/hello.txt"))
+			Expect(seen[1].Size).To(Equal(int64(5)))
+			Expect(seen[2]).To(Equal(layer.Entry{Name: "Files/deleted.txt", Whiteout: true, Change: layer.ChangeDeleted}))
+		})
+
+		It("tells added entries from those modified in a parent layer", func() {
+			Expect(os.MkdirAll(filepath.Join(layerFolders[1], "Files", "dir"), 0755)).To(Succeed())
+
+			var seen []layer.Entry
+			opts := layer.Options{OnEntry: func(entry layer.Entry) { seen = append(seen, entry) }}
+
+			_, err := exporter.ExportTo(context.Background(), output, opts)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(seen[0].Change).To(Equal(layer.ChangeModified))
+			Expect(seen[1].Change).To(Equal(layer.ChangeAdded))
+			Expect(seen[2].Change).To(Equal(layer.ChangeDeleted))
+		})
+
+		It("tells entries deleted in a parent layer and added back as added", func() {
+			Expect(os.MkdirAll(filepath.Join(layerFolders[0], "Files", "dir"), 0755)).To(Succeed())
+			writeTombstone(filepath.Join(layerFolders[0], "Files", "dir", "hello.txt"))
+			Expect(os.MkdirAll(filepath.Join(layerFolders[1], "Files", "dir"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(layerFolders[1], "Files", "dir", "hello.txt"), []byte("hello"), 0644)).To(Succeed())
+
+			var seen []layer.Entry
+			opts := layer.Options{OnEntry: func(entry layer.Entry) { seen = append(seen, entry) }}
+
+			_, err := exporter.ExportTo(context.Background(), output, opts)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(seen[0].Change).To(Equal(layer.ChangeModified))
+			Expect(seen[1].Change).To(Equal(layer.ChangeAdded))
+		})
+
+		Context("when doing a dry run", func() {
+			It("reports the entries without reading or writing them", func() {
+				var seen []string
+				opts := layer.Options{DryRun: true, OnEntry: func(entry layer.Entry) { seen = append(seen, entry.Name) }}
+
+				result, err := exporter.ExportTo(context.Background(), output, opts)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(output.Len()).To(BeZero())
+				Expect(seen).To(Equal([]string{"Files/dir", "Files/dir/hello.txt", "Files/deleted.txt"}))
+				Expect(result).To(Equal(layer.Result{Entries: 3, Whiteouts: 1}))
+			})
+
+			It("applies filters", func() {
+				noWhiteouts := func(entry layer.Entry) bool { return !entry.Whiteout }
+
+				result, err := exporter.ExportTo(context.Background(), output, layer.Options{DryRun: true, Filters: []layer.Filter{noWhiteouts}})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result).To(Equal(layer.Result{Entries: 2, Skipped: 1}))
+			})
+		})
+
+		Context("when pruning unchanged files", func() {
+			BeforeEach(func() {
+				reader.Entries = append(reader.Entries, fakes.File(`Files\dir\changed.txt`, []byte("after")))
+				Expect(os.MkdirAll(filepath.Join(layerFolders[1], "Files", "dir"), 0755)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(layerFolders[1], "Files", "dir", "hello.txt"), []byte("hello"), 0644)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(layerFolders[1], "Files", "dir", "changed.txt"), []byte("befor"), 0644)).To(Succeed())
+			})
+
+			It("drops files rewritten with the content they have in a parent layer", func() {
+				result, err := exporter.ExportTo(context.Background(), output, layer.Options{PruneUnchanged: true})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(readTar(gunzip(output.Bytes()))).To(Equal(map[string]string{
+					"Files/dir":             "",
+					"Files/dir/changed.txt": "after",
+					"Files/.wh.deleted.txt": "",
+				}))
+				Expect(result.Pruned).To(Equal(1))
+				Expect(result.PrunedBytes).To(Equal(int64(5)))
+			})
+
+			It("keeps files whose security descriptor changed", func() {
+				sd, err := winio.SddlToSecurityDescriptor("O:SYG:SYD:P(A;;FA;;;SY)")
+				Expect(err).ToNot(HaveOccurred())
+				reader.Entries[1] = fakes.FileWithSecurity(`Files\dir\hello.txt`, []byte("hello"), sd)
+
+				result, err := exporter.ExportTo(context.Background(), output, layer.Options{PruneUnchanged: true})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(readTar(gunzip(output.Bytes()))).To(HaveKeyWithValue("Files/dir/hello.txt", "hello"))
+				Expect(result.Pruned).To(Equal(0))
+			})
+
+			It("keeps files whose extended attributes changed", func() {
+				reader.Entries[1] = fakes.FileWithEAs(`Files\dir\hello.txt`, []byte("hello"), []winio.ExtendedAttribute{{Name: "USER.NOTE", Value: []byte("note")}})
+
+				result, err := exporter.ExportTo(context.Background(), output, layer.Options{PruneUnchanged: true})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(result.Pruned).To(Equal(0))
+			})
+
+			It("keeps files that dropped an alternate data stream of the parent's", func() {
+				Expect(os.WriteFile(filepath.Join(layerFolders[1], "Files", "dir", "hello.txt:stream"), []byte("stream"), 0644)).To(Succeed())
+
+				result, err := exporter.ExportTo(context.Background(), output, layer.Options{PruneUnchanged: true})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(result.Pruned).To(Equal(0))
+			})
+
+			It("keeps them unless asked to prune", func() {
+				result, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(readTar(gunzip(output.Bytes()))).To(HaveKeyWithValue("Files/dir/hello.txt", "hello"))
+				Expect(result.Pruned).To(Equal(0))
+			})
+		})
+
+		Context("when writing hard links", func() {
+			BeforeEach(func() {
+				reader.Entries = append(reader.Entries,
+					fakes.HardLink(`Files\a\app.dll`, []byte("dll"), 1, 2),
+					fakes.HardLink(`Files\b\app.dll`, []byte("dll"), 1, 2),
+					fakes.File(`Files\c\app.dll`, []byte("dll")),
+				)
+			})
+
+			It("writes later links to a file as tar hard links", func() {
+				var seen []layer.Entry
+				opts := layer.Options{HardLinks: true, DigestEntries: true, OnEntry: func(entry layer.Entry) { seen = append(seen, entry) }}
+				result, err := exporter.ExportTo(context.Background(), output, opts)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(tarLinks(gunzip(output.Bytes()))).To(Equal(map[string]string{"Files/b/app.dll": "Files/a/app.dll"}))
+				Expect(readTar(gunzip(output.Bytes()))).To(HaveKeyWithValue("Files/c/app.dll", "dll"))
+				Expect(result.Links).To(Equal(1))
+				Expect(result.LinkedBytes).To(Equal(int64(3)))
+
+				sum := sha256.Sum256([]byte("dll"))
+				Expect(seen[4].Link).To(Equal("Files/a/app.dll"))
+				Expect(seen[4].Digest).To(Equal("sha256:" + hex.EncodeToString(sum[:])))
+			})
+
+			It("also links identical files when asked to", func() {
+				result, err := exporter.ExportTo(context.Background(), output, layer.Options{HardLinks: true, LinkIdentical: true})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(tarLinks(gunzip(output.Bytes()))).To(Equal(map[string]string{
+					"Files/b/app.dll": "Files/a/app.dll",
+					"Files/c/app.dll": "Files/a/app.dll",
+				}))
+				Expect(result.Links).To(Equal(2))
+			})
+
+			It("doesn't link files with different attributes", func() {
+				reader.Entries[len(reader.Entries)-1].FileInfo = &winio.FileBasicInfo{FileAttributes: syscall.FILE_ATTRIBUTE_READONLY}
+				_, err := exporter.ExportTo(context.Background(), output, layer.Options{HardLinks: true, LinkIdentical: true})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(tarLinks(gunzip(output.Bytes()))).ToNot(HaveKey("Files/c/app.dll"))
+			})
+
+			It("writes every file's content by default", func() {
+				result, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(tarLinks(gunzip(output.Bytes()))).To(BeEmpty())
+				Expect(readTar(gunzip(output.Bytes()))).To(HaveKeyWithValue("Files/b/app.dll", "dll"))
+				Expect(result.Links).To(Equal(0))
+			})
+		})
+
+		It("digests the content of files when asked to", func() {
+			var seen []layer.Entry
+			opts := layer.Options{DigestEntries: true, OnEntry: func(entry layer.Entry) { seen = append(seen, entry) }}
+
+			_, err := exporter.ExportTo(context.Background(), output, opts)
+			Expect(err).ToNot(HaveOccurred())
+
+			sum := sha256.Sum256([]byte("hello"))
+			Expect(seen[0].Digest).To(BeEmpty())
+			Expect(seen[1].Digest).To(Equal("sha256:" + hex.EncodeToString(sum[:])))
+			Expect(seen[2].Digest).To(BeEmpty())
+		})
+
+		It("doesn't digest files by default", func() {
+			var seen []layer.Entry
+			opts := layer.Options{OnEntry: func(entry layer.Entry) { seen = append(seen, entry) }}
+
+			_, err := exporter.ExportTo(context.Background(), output, opts)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(seen[1].Digest).To(BeEmpty())
+		})
+
+		It("stops when the context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			opts := layer.Options{OnEntry: func(layer.Entry) { cancel() }}
+
+			_, err := exporter.ExportTo(ctx, output, opts)
+			Expect(err).To(MatchError(context.Canceled))
+			Expect(reader.Closed).To(BeTrue())
+		})
+
+		Context("when unpreparing the layer fails", func() {
+			BeforeEach(func() {
+				driver.UnprepareLayerError = errors.New("couldn't unprepare")
+			})
+
+			It("errors without reading the layer", func() {
+				_, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+				Expect(err).To(MatchError(ContainSubstring("couldn't unprepare")))
+				Expect(driver.Calls()).To(Equal([]string{"UnprepareLayer some-container-id"}))
+			})
+		})
+
+		Context("when reading the layer fails", func() {
+			BeforeEach(func() {
+				reader.NextError = errors.New("couldn't read")
+			})
+
+			It("errors and closes the reader", func() {
+				_, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+				Expect(err).To(MatchError("couldn't read"))
+				Expect(reader.Closed).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("squashing", func() {
+		BeforeEach(func() {
+			driver.Layers = map[string][]fakes.LayerEntry{
+				"top": {
+					fakes.Directory(`Files\dir`),
+					fakes.File(`Files\dir\top.txt`, []byte("top")),
+					fakes.Whiteout(`Files\old`),
+				},
+				"base": {
+					fakes.Directory(`Files`),
+					fakes.Directory(`Files\dir`),
+					fakes.File(`Files\dir\hello.txt`, []byte("base")),
+					fakes.File(`Files\dir\TOP.txt`, []byte("base")),
+					fakes.File(`Files\deleted.txt`, []byte("base")),
+					fakes.Directory(`Files\old`),
+					fakes.File(`Files\old\file.txt`, []byte("base")),
+					fakes.File(`Files\kept.txt`, []byte("base")),
+				},
+			}
+		})
+
+		It("flattens the diff and its parent layers, applying whiteouts", func() {
+			result, err := exporter.ExportTo(context.Background(), output, layer.Options{Squash: true})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(readTar(gunzip(output.Bytes()))).To(Equal(map[string]string{
+				"Files":               "",
+				"Files/dir":           "",
+				"Files/dir/hello.txt": "hello",
+				"Files/dir/top.txt":   "top",
+				"Files/kept.txt":      "base",
+			}))
+			Expect(result.Entries).To(Equal(5))
+			Expect(result.Whiteouts).To(Equal(0))
+		})
+
+		It("writes directories before their content", func() {
+			_, err := exporter.ExportTo(context.Background(), output, layer.Options{Squash: true})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(tarNames(gunzip(output.Bytes()))).To(Equal([]string{
+				"Files", "Files/dir", "Files/kept.txt", "Files/dir/top.txt", "Files/dir/hello.txt",
+			}))
+		})
+
+		It("reads every layer twice, topmost first to index it and bottom up to write it", func() {
+			_, err := exporter.ExportTo(context.Background(), output, layer.Options{Squash: true})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(driver.Calls()).To(Equal([]string{
+				"UnprepareLayer some-container-id",
+				"NewLayerReader some-container-id",
+				"LayerReader.Close",
+				"NewLayerReader top",
+				"NewLayerReader base",
+				"NewLayerReader base",
+				"NewLayerReader top",
+				"NewLayerReader some-container-id",
+				"LayerReader.Close",
+			}))
+		})
+
+		Context("with registry hives", func() {
+			BeforeEach(func() {
+				// The container's diff has a delta for every hive Windows
+				// wrote to while it ran.
+				reader.Entries = append(reader.Entries,
+					fakes.Directory(`Hives`),
+					fakes.File(`Hives\Software_Delta`, []byte("container")),
+					fakes.File(`Hives\System_Delta`, []byte("container")),
+				)
+			})
+
+			It("keeps the container's deltas when the parents have none", func() {
+				_, err := exporter.ExportTo(context.Background(), output, layer.Options{Squash: true})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(readTar(gunzip(output.Bytes()))).To(SatisfyAll(
+					HaveKeyWithValue("Hives/Software_Delta", "container"),
+					HaveKeyWithValue("Hives/System_Delta", "container"),
+				))
+			})
+
+			It("refuses a parent layer with deltas before unpreparing the container", func() {
+				hives := filepath.Join(layerFolders[0], "Hives")
+				Expect(os.MkdirAll(hives, 0755)).To(Succeed())
+				for _, hive := range []string{"Software_Delta", "System_Delta", "DefaultUser_Delta"} {
+					Expect(os.WriteFile(filepath.Join(hives, hive), []byte("top"), 0644)).To(Succeed())
+					driver.Layers["top"] = append(driver.Layers["top"], fakes.File(`Hives\`+hive, []byte("top")))
+				}
+
+				_, err := exporter.ExportTo(context.Background(), output, layer.Options{Squash: true})
+				Expect(err).To(MatchError(layer.ErrSquashHiveDeltas))
+				Expect(layer.StageOf(err)).To(Equal(layer.StageReader))
+				Expect(driver.Calls()).To(BeEmpty())
+			})
+
+			It("refuses a parent tarball with deltas before unpreparing the container", func() {
+				tarball := filepath.Join(driverStore, "parent.tar")
+				var parent bytes.Buffer
+				t := tar.NewWriter(&parent)
+				Expect(t.WriteHeader(&tar.Header{Name: "Hives", Typeflag: tar.TypeDir})).To(Succeed())
+				Expect(t.WriteHeader(&tar.Header{Name: "Hives/Software_Delta", Typeflag: tar.TypeReg, Size: 6})).To(Succeed())
+				_, err := t.Write([]byte("parent"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.Close()).To(Succeed())
+				Expect(os.WriteFile(tarball, parent.Bytes(), 0644)).To(Succeed())
+
+				_, err = exporter.ExportTo(context.Background(), output, layer.Options{Squash: true, ParentTarballs: []string{tarball}})
+				Expect(err).To(MatchError(layer.ErrSquashHiveDeltas))
+				Expect(err).To(MatchError(ContainSubstring("Hives/Software_Delta")))
+				Expect(driver.Calls()).To(BeEmpty())
+			})
+		})
+
+		It("marks every entry as added", func() {
+			var changes []layer.Change
+			_, err := exporter.ExportTo(context.Background(), output, layer.Options{
+				Squash:  true,
+				OnEntry: func(entry layer.Entry) { changes = append(changes, entry.Change) },
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(HaveLen(5))
+			Expect(changes).To(HaveEach(layer.ChangeAdded))
+		})
+
+		Context("with parent tarballs", func() {
+			var tarball string
+
+			BeforeEach(func() {
+				tarball = filepath.Join(driverStore, "parent.tgz")
+				var parent bytes.Buffer
+				g := gzip.NewWriter(&parent)
+				t := tar.NewWriter(g)
+				Expect(t.WriteHeader(&tar.Header{Name: "Files/dir", Typeflag: tar.TypeDir})).To(Succeed())
+				// A file's alternate data streams follow it.
+				for _, file := range []struct{ name, content string }{
+					{"Files/dir/hello.txt", "parent"},
+					{"Files/deleted.txt", "parent"},
+					{"Files/parent.txt", "parent"},
+					{"Files/parent.txt:stream", "stream"},
+				} {
+					Expect(t.WriteHeader(&tar.Header{Name: file.name, Typeflag: tar.TypeReg, Size: int64(len(file.content))})).To(Succeed())
+					_, err := t.Write([]byte(file.content))
+					Expect(err).ToNot(HaveOccurred())
+				}
+				Expect(t.Close()).To(Succeed())
+				Expect(g.Close()).To(Succeed())
+				Expect(os.WriteFile(tarball, parent.Bytes(), 0644)).To(Succeed())
+			})
+
+			It("squashes the diff with them instead of the layer folders", func() {
+				_, err := exporter.ExportTo(context.Background(), output, layer.Options{Squash: true, ParentTarballs: []string{tarball}})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(readTar(gunzip(output.Bytes()))).To(Equal(map[string]string{
+					"Files/dir":               "",
+					"Files/dir/hello.txt":     "hello",
+					"Files/parent.txt":        "parent",
+					"Files/parent.txt:stream": "stream",
+				}))
+				Expect(driver.Calls()).ToNot(ContainElement("NewLayerReader top"))
+			})
+
+			It("applies the alternate data stream policy to them", func() {
+				result, err := exporter.ExportTo(context.Background(), output, layer.Options{
+					Squash:               true,
+					ParentTarballs:       []string{tarball},
+					AlternateDataStreams: layer.MetadataPolicy{Drop: []string{"stream"}},
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(tarNames(gunzip(output.Bytes()))).ToNot(ContainElement("Files/parent.txt:stream"))
+				Expect(result.DroppedStreams).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("ExportParentTo", func() {
+		BeforeEach(func() {
+			driver.Layers = map[string][]fakes.LayerEntry{
+				"top": {fakes.File(`Files\top.txt`, []byte("top"))},
+			}
+		})
+
+		It("writes the parent layer without touching the container's layer", func() {
+			result, err := exporter.ExportParentTo(context.Background(), output, 0, layer.Options{})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(readTar(gunzip(output.Bytes()))).To(Equal(map[string]string{"Files/top.txt": "top"}))
+			Expect(result.Entries).To(Equal(1))
+			Expect(driver.Calls()).To(Equal([]string{"NewLayerReader top"}))
+		})
+
+		It("reads the parent with the layers below it as its parents", func() {
+			_, err := exporter.ExportParentTo(context.Background(), output, 0, layer.Options{})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(driver.NewLayerReaderInfo.HomeDir).To(Equal(filepath.Join(driverStore, "layers")))
+			Expect(driver.NewLayerReaderParents).To(Equal(layerFolders[1:]))
+		})
+
+		It("errors for a parent the container doesn't have", func() {
+			_, err := exporter.ExportParentTo(context.Background(), output, 2, layer.Options{})
+			Expect(err).To(MatchError(ContainSubstring("no parent layer 2")))
+		})
+
+		It("lists the parents topmost first", func() {
+			Expect(exporter.ParentLayers(layer.Layout{})).To(Equal(layerFolders))
+		})
+	})
+
+	Describe("failure stages", func() {
+		It("attributes bundle errors to the spec stage", func() {
+			exporter = layer.NewWithDriver("some-container-id", filepath.Join("testdata", "bundles", "no-windows"), driver)
+
+			_, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+			Expect(layer.StageOf(err)).To(Equal(layer.StageSpec))
+		})
+
+		It("attributes unprepare errors to the unprepare stage", func() {
+			driver.UnprepareLayerError = errors.New("couldn't unprepare")
+
+			_, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+			Expect(layer.StageOf(err)).To(Equal(layer.StageUnprepare))
+		})
+
+		It("attributes layer reader errors to the reader stage", func() {
+			reader.NextError = errors.New("couldn't read")
+
+			_, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+			Expect(layer.StageOf(err)).To(Equal(layer.StageReader))
+		})
+
+		It("attributes errors from the writer to the write stage", func() {
+			writeErr := errors.New("disk on fire")
+
+			_, err := exporter.ExportTo(context.Background(), failingWriter{writeErr}, layer.Options{Compression: layer.CompressionNone})
+			Expect(err).To(MatchError(writeErr))
+			Expect(layer.StageOf(err)).To(Equal(layer.StageWrite))
+		})
+
+		It("attributes re-prepare errors to the reprepare stage", func() {
+			driver.PrepareLayerError = errors.New("couldn't prepare")
+
+			_, err := exporter.ExportTo(context.Background(), output, layer.Options{Reprepare: true})
+			Expect(layer.StageOf(err)).To(Equal(layer.StageReprepare))
+		})
+	})
+
+	DescribeTable("invalid bundles",
+		func(fixture string, expected error) {
+			exporter = layer.NewWithDriver("some-container-id", filepath.Join("testdata", "bundles", fixture), driver)
+
+			_, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+			Expect(err).To(MatchError(expected))
+			Expect(driver.Calls()).To(BeEmpty())
+		},
+		Entry("without a config.json", "does-not-exist", layer.ErrConfigNotReadable),
+		Entry("with malformed json", "not-json", layer.ErrConfigInvalid),
+		Entry("without a windows section", "no-windows", layer.ErrNoWindowsSection),
+		Entry("without layer folders", "no-layer-folders", layer.ErrNoLayerFolders),
+		Entry("with a missing layer folder", "missing-layer-folder", layer.ErrLayerFolderNotFound),
+		Entry("with a layer folder that is a file", "layer-folder-is-file", layer.ErrLayerFolderNotFound),
+		Entry("without a volumes directory in the driver store", "no-driver-store", layer.ErrDriverStoreNotFound),
+	)
+
+	Describe("explicit layouts", func() {
+		BeforeEach(func() {
+			exporter = layer.NewWithDriver("some-container-id", "", driver)
+		})
+
+		It("uses a spec instead of the bundle's config.json", func() {
+			opts := layer.Options{Layout: layer.Layout{Spec: &specs.Spec{Windows: &specs.Windows{LayerFolders: layerFolders}}}}
+
+			_, err := exporter.ExportTo(context.Background(), output, opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(driver.NewLayerReaderParents).To(Equal(layerFolders))
+			Expect(driver.NewLayerReaderInfo.HomeDir).To(Equal(filepath.Join(driverStore, "volumes")))
+		})
+
+		It("uses layer folders without a spec", func() {
+			opts := layer.Options{Layout: layer.Layout{LayerFolders: layerFolders[1:]}}
+
+			_, err := exporter.ExportTo(context.Background(), output, opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(driver.NewLayerReaderParents).To(Equal(layerFolders[1:]))
+			Expect(driver.Calls()).To(ContainElement("UnprepareLayer some-container-id"))
+		})
+
+		It("finds the sandbox in an explicit driver store", func() {
+			otherStore := filepath.Join(driverStore, "other-store")
+			Expect(os.MkdirAll(filepath.Join(otherStore, "volumes"), 0755)).To(Succeed())
+			opts := layer.Options{Layout: layer.Layout{LayerFolders: layerFolders, DriverStore: otherStore}}
+
+			_, err := exporter.ExportTo(context.Background(), output, opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(driver.UnprepareLayerInfo.HomeDir).To(Equal(filepath.Join(otherStore, "volumes")))
+		})
+
+		It("finds the sandbox in an explicit volumes home", func() {
+			volumesHome := filepath.Join(driverStore, "sandboxes")
+			Expect(os.MkdirAll(volumesHome, 0755)).To(Succeed())
+			opts := layer.Options{Layout: layer.Layout{LayerFolders: layerFolders, VolumesHome: volumesHome}}
+
+			_, err := exporter.ExportTo(context.Background(), output, opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(driver.UnprepareLayerInfo.HomeDir).To(Equal(volumesHome))
+		})
+
+		It("reads an explicit sandbox path", func() {
+			sandbox := filepath.Join(driverStore, "sandboxes", "some-sandbox")
+			Expect(os.MkdirAll(sandbox, 0755)).To(Succeed())
+			opts := layer.Options{Layout: layer.Layout{LayerFolders: layerFolders, SandboxPath: sandbox}, Reprepare: true}
+
+			_, err := exporter.ExportTo(context.Background(), output, opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(driver.UnprepareLayerInfo.HomeDir).To(Equal(filepath.Dir(sandbox)))
+			Expect(driver.Calls()).To(Equal([]string{
+				"UnprepareLayer some-sandbox",
+				"NewLayerReader some-sandbox",
+				"LayerReader.Close",
+				"PrepareLayer some-sandbox",
+			}))
+		})
+
+		It("errors when the sandbox does not exist", func() {
+			opts := layer.Options{Layout: layer.Layout{LayerFolders: layerFolders, SandboxPath: filepath.Join(driverStore, "missing")}}
+
+			_, err := exporter.ExportTo(context.Background(), output, opts)
+			Expect(err).To(MatchError(layer.ErrSandboxNotFound))
+			Expect(driver.Calls()).To(BeEmpty())
+		})
+
+		DescribeTable("errors when the sandbox path is given along with where sandboxes are kept",
+			func(layout layer.Layout) {
+				layout.LayerFolders = layerFolders
+				layout.SandboxPath = filepath.Join(driverStore, "sandboxes", "some-sandbox")
+
+				_, err := exporter.ExportTo(context.Background(), output, layer.Options{Layout: layout})
+				Expect(err).To(MatchError(layer.ErrLayoutConflict))
+				Expect(driver.Calls()).To(BeEmpty())
+			},
+			Entry("a driver store", layer.Layout{DriverStore: `C:\other-store`}),
+			Entry("a volumes home", layer.Layout{VolumesHome: `C:\sandboxes`}),
+		)
+
+		It("errors when an explicit layer folder does not exist", func() {
+			opts := layer.Options{Layout: layer.Layout{LayerFolders: []string{filepath.Join(driverStore, "layers", "missing")}}}
+
+			_, err := exporter.ExportTo(context.Background(), output, opts)
+			Expect(err).To(MatchError(layer.ErrLayerFolderNotFound))
+			Expect(driver.Calls()).To(BeEmpty())
+		})
+
+		It("errors without a bundle, spec or layer folders", func() {
+			_, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+			Expect(err).To(MatchError(layer.ErrConfigNotReadable))
+		})
+	})
+
+	Describe("ReadSpec", func() {
+		It("parses a runtime spec", func() {
+			spec, err := layer.ReadSpec(strings.NewReader(`{"windows": {"layerFolders": ["C:\\layers\\base"]}}`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(spec.Windows.LayerFolders).To(Equal([]string{`C:\layers\base`}))
+		})
+
+		It("errors on malformed json", func() {
+			_, err := layer.ReadSpec(strings.NewReader(`{"windows":`))
+			Expect(err).To(MatchError(layer.ErrConfigInvalid))
+		})
+	})
+
+	Describe("re-preparing the layer", func() {
+		var opts layer.Options
+
+		BeforeEach(func() {
+			opts = layer.Options{Reprepare: true}
+		})
+
+		It("prepares the layer with the bundle's layer folders after the reader is closed", func() {
+			_, err := exporter.ExportTo(context.Background(), output, opts)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(driver.Calls()).To(Equal([]string{
+				"UnprepareLayer some-container-id",
+				"NewLayerReader some-container-id",
+				"LayerReader.Close",
+				"PrepareLayer some-container-id",
+			}))
+			Expect(driver.PrepareLayerInfo).To(Equal(driver.UnprepareLayerInfo))
+			Expect(driver.PrepareLayerParents).To(Equal(layerFolders))
+		})
+
+		It("does not prepare the layer unless asked to", func() {
+			_, err := exporter.ExportTo(context.Background(), output, layer.Options{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(driver.Calls()).ToNot(ContainElement("PrepareLayer some-container-id"))
+		})
+
+		Context("when reading the layer fails", func() {
+			BeforeEach(func() {
+				reader.NextError = errors.New("couldn't read")
+			})
+
+			It("still prepares the layer after closing the reader", func() {
+				_, err := exporter.ExportTo(context.Background(), output, opts)
+				Expect(err).To(MatchError("couldn't read"))
+				Expect(driver.Calls()).To(Equal([]string{
+					"UnprepareLayer some-container-id",
+					"NewLayerReader some-container-id",
+					"LayerReader.Close",
+					"PrepareLayer some-container-id",
+				}))
+			})
+		})
+
+		Context("when creating the layer reader fails", func() {
+			BeforeEach(func() {
+				driver.NewLayerReaderError = errors.New("no reader")
+			})
+
+			It("still prepares the layer", func() {
+				_, err := exporter.ExportTo(context.Background(), output, opts)
+				Expect(err).To(MatchError("no reader"))
+				Expect(driver.Calls()).To(Equal([]string{
+					"UnprepareLayer some-container-id",
+					"NewLayerReader some-container-id",
+					"PrepareLayer some-container-id",
+				}))
+			})
+		})
+
+		Context("when unpreparing the layer fails", func() {
+			BeforeEach(func() {
+				driver.UnprepareLayerError = errors.New("couldn't unprepare")
+			})
+
+			It("leaves the layer alone", func() {
+				_, err := exporter.ExportTo(context.Background(), output, opts)
+				Expect(err).To(HaveOccurred())
+				Expect(driver.Calls()).To(Equal([]string{"UnprepareLayer some-container-id"}))
+			})
+		})
+
+		Context("when preparing the layer fails", func() {
+			BeforeEach(func() {
+				driver.PrepareLayerError = errors.New("couldn't prepare")
+			})
+
+			It("returns the error", func() {
+				_, err := exporter.ExportTo(context.Background(), output, opts)
+				Expect(err).To(MatchError(ContainSubstring("couldn't prepare")))
+			})
+
+			It("reports it alongside an export failure", func() {
+				reader.NextError = errors.New("couldn't read")
+
+				_, err := exporter.ExportTo(context.Background(), output, opts)
+				Expect(err).To(MatchError(ContainSubstring("couldn't read")))
+				Expect(err).To(MatchError(ContainSubstring("couldn't prepare")))
+			})
+		})
+	})
+
+	Describe("Export", func() {
+		It("streams the same gzipped tar", func() {
+			stream, err := exporter.Export()
+			Expect(err).ToNot(HaveOccurred())
+			defer stream.Close()
+
+			content, err := io.ReadAll(stream)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(readTar(gunzip(content))).To(HaveKeyWithValue("Files/dir/hello.txt", "hello"))
+		})
+	})
+})
+
+type failingWriter struct {
+	err error
+}
+
+func (f failingWriter) Write([]byte) (int, error) {
+	return 0, f.err
+}
+
+// writeTombstone marks path as deleted from the layers below, as a read-only
+// layer does.
+func writeTombstone(path string) {
+	f, err := os.Create(path)
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	defer f.Close()
+
+	// A REPARSE_DATA_BUFFER with the tombstone tag and no data.
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint32(buf, 0xA000001F)
+	var returned uint32
+	err = windows.DeviceIoControl(windows.Handle(f.Fd()), windows.FSCTL_SET_REPARSE_POINT, &buf[0], uint32(len(buf)), nil, 0, &returned, nil)
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+}
+
+func writeBundle(bundlePath string, spec specs.Spec) {
+	ExpectWithOffset(1, os.MkdirAll(bundlePath, 0755)).To(Succeed())
+	config, err := json.Marshal(&spec)
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	ExpectWithOffset(1, os.WriteFile(filepath.Join(bundlePath, "config.json"), config, 0644)).To(Succeed())
+}
+
+func gunzip(data []byte) []byte {
+	g, err := gzip.NewReader(bytes.NewReader(data))
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	content, err := io.ReadAll(g)
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	return content
+}
+
+func tarNames(data []byte) []string {
+	var names []string
+	t := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		names = append(names, hdr.Name)
+	}
+	return names
+}
+
+func tarHeaders(data []byte) map[string]*tar.Header {
+	headers := map[string]*tar.Header{}
+	t := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		headers[hdr.Name] = hdr
+	}
+	return headers
+}
+
+func tarLinks(data []byte) map[string]string {
+	links := map[string]string{}
+	t := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		if hdr.Typeflag == tar.TypeLink {
+			links[hdr.Name] = hdr.Linkname
+		}
+	}
+	return links
+}
+
+func readTar(data []byte) map[string]string {
+	entries := map[string]string{}
+	t := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		content, err := io.ReadAll(t)
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		entries[hdr.Name] = string(content)
+	}
+	return entries
+}
@@ -0,0 +1,131 @@
+// Package layerfmt holds what the packages reading and reporting on exported
+// layers share with the layer package. Unlike it, it builds on every
+// platform, so exported layers can be inspected anywhere.
+package layerfmt
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	// Root is the folder of a layer holding the container's system drive.
+	// The layer's other folders hold its registry hives.
+	Root = "Files"
+	// WhiteoutPrefix marks the entries of paths deleted in the layer.
+	WhiteoutPrefix = ".wh."
+)
+
+// Change is how an entry differs from the container's parent layers.
+type Change string
+
+const (
+	ChangeAdded    Change = "added"
+	ChangeModified Change = "modified"
+	ChangeDeleted  Change = "deleted"
+)
+
+// Entry is a single path of a layer, as the reports on layers count it.
+type Entry struct {
+	// Path is the slash separated path inside the layer, e.g.
+	// Files/hello.txt.
+	Path   string
+	Change Change
+	// Size is the size of a file's data.
+	Size     int64
+	Dir      bool
+	Whiteout bool
+}
+
+// ValidContainerId tells whether id is a single path element, as container
+// ids name the folders their layers and state are kept in.
+func ValidContainerId(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\:`)
+}
+
+// Decompress returns the tar stream of a layer read from r, which may be
+// gzipped, and whether it was.
+func Decompress(r io.Reader) (io.Reader, bool, error) {
+	buffered := bufio.NewReader(r)
+	if magic, _ := buffered.Peek(2); !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return buffered, false, nil
+	}
+	g, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, false, err
+	}
+	return g, true, nil
+}
+
+// ResolveLink returns the path inside the layer that target, the Windows or
+// slash separated target of the link name, points to. Absolute targets must
+// be on the container's system drive, and no target may leave the layer's
+// Root, so it returns false for any other target.
+func ResolveLink(name, target string) (string, bool) {
+	nt := false
+	for _, prefix := range []string{`\??\`, `\\?\`} {
+		if strings.HasPrefix(target, prefix) {
+			target = target[len(prefix):]
+			nt = true
+		}
+	}
+
+	var resolved string
+	switch {
+	case len(target) >= 2 && target[1] == ':':
+		if !strings.EqualFold(target[:1], "C") {
+			return "", false
+		}
+		resolved = path.Join(Root, "/", toSlash(target[2:]))
+	case nt || strings.HasPrefix(target, `\\`):
+		return "", false
+	case strings.HasPrefix(target, `\`) || strings.HasPrefix(target, "/"):
+		resolved = path.Join(Root, toSlash(target))
+	default:
+		resolved = path.Join(path.Dir(name), toSlash(target))
+	}
+
+	if resolved != Root && !strings.HasPrefix(resolved, Root+"/") {
+		return "", false
+	}
+	return resolved, true
+}
+
+// RelativeLink returns target, a path inside the layer, relative to the
+// link name, so that the link stays inside wherever the layer is extracted.
+func RelativeLink(name, target string) string {
+	from := strings.Split(path.Dir(name), "/")
+	to := strings.Split(target, "/")
+	i := 0
+	for i < len(from) && i < len(to) && strings.EqualFold(from[i], to[i]) {
+		i++
+	}
+	linkname := path.Join(strings.Repeat("../", len(from)-i), strings.Join(to[i:], "/"))
+	if linkname == "" {
+		linkname = "."
+	}
+	return linkname
+}
+
+func toSlash(p string) string {
+	return strings.ReplaceAll(p, `\`, "/")
+}
+
+// FormatSize formats size in bytes with a binary unit, e.g. 1.5 GiB.
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,13 @@
+package layerfmt_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestLayerfmt(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Layerfmt Suite")
+}
@@ -0,0 +1,98 @@
+package layerfmt_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ValidContainerId", func() {
+	It("accepts a single path element", func() {
+		Expect(layerfmt.ValidContainerId("some-container")).To(BeTrue())
+	})
+
+	DescribeTable("rejects anything else",
+		func(id string) {
+			Expect(layerfmt.ValidContainerId(id)).To(BeFalse())
+		},
+		Entry("an empty id", ""),
+		Entry("the current directory", "."),
+		Entry("the parent directory", ".."),
+		Entry("a backslash", `..\other-layer`),
+		Entry("a slash", "../other-layer"),
+		Entry("a drive", `C:`),
+	)
+})
+
+var _ = Describe("Decompress", func() {
+	It("reads a plain layer as it is", func() {
+		r, gzipped, err := layerfmt.Decompress(bytes.NewReader([]byte("plain tar")))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(gzipped).To(BeFalse())
+		Expect(io.ReadAll(r)).To(Equal([]byte("plain tar")))
+	})
+
+	It("decompresses a gzipped layer", func() {
+		var compressed bytes.Buffer
+		g := gzip.NewWriter(&compressed)
+		_, err := g.Write([]byte("gzipped tar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(g.Close()).To(Succeed())
+
+		r, gzipped, err := layerfmt.Decompress(&compressed)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(gzipped).To(BeTrue())
+		Expect(io.ReadAll(r)).To(Equal([]byte("gzipped tar")))
+	})
+})
+
+var _ = Describe("ResolveLink", func() {
+	DescribeTable("resolves targets inside the layer",
+		func(target, resolved string) {
+			actual, ok := layerfmt.ResolveLink("Files/dir/link", target)
+			Expect(ok).To(BeTrue())
+			Expect(actual).To(Equal(resolved))
+		},
+		Entry("an NT path", `\??\C:\Windows\System32`, "Files/Windows/System32"),
+		Entry("a drive path", `c:\dir\hello.txt`, "Files/dir/hello.txt"),
+		Entry("a rooted path", `\Windows`, "Files/Windows"),
+		Entry("a rooted slash separated path", "/Windows", "Files/Windows"),
+		Entry("a relative path", `..\other\bin`, "Files/other/bin"),
+		Entry("the system drive's root", `C:\`, "Files"),
+	)
+
+	DescribeTable("refuses targets outside the layer",
+		func(target string) {
+			_, ok := layerfmt.ResolveLink("Files/dir/link", target)
+			Expect(ok).To(BeFalse())
+		},
+		Entry("another drive", `\??\D:\data`),
+		Entry("a UNC path", `\\server\share`),
+		Entry("a volume", `\??\Volume{0b2cf4f6-1f6c-4e3a-9b5f-3c7e7a1f1c2d}\`),
+		Entry("a relative path above the root", `..\..\Hives`),
+	)
+})
+
+var _ = Describe("RelativeLink", func() {
+	DescribeTable("points from the link to its target",
+		func(target, linkname string) {
+			Expect(layerfmt.RelativeLink("Files/Program Files/app/link", target)).To(Equal(linkname))
+		},
+		Entry("a sibling", "Files/Program Files/app/bin", "bin"),
+		Entry("a directory above", "Files/Windows/System32", "../../Windows/System32"),
+		Entry("a path differing in case", "files/program files/App/bin", "bin"),
+		Entry("the link's directory", "Files/Program Files/app", "."),
+	)
+})
+
+var _ = Describe("FormatSize", func() {
+	It("formats sizes with binary units", func() {
+		Expect(layerfmt.FormatSize(1023)).To(Equal("1023 B"))
+		Expect(layerfmt.FormatSize(1536)).To(Equal("1.5 KiB"))
+		Expect(layerfmt.FormatSize(5 << 30)).To(Equal("5.0 GiB"))
+	})
+})
@@ -0,0 +1,98 @@
+package layer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"syscall"
+
+	winio "github.com/Microsoft/go-winio"
+	"github.com/Microsoft/hcsshim"
+)
+
+// linkTarget is a file already written to the layer that later entries can
+// be written as hard links to.
+type linkTarget struct {
+	name   string
+	digest string
+}
+
+// hardLinks finds the files of a layer that are hard links to a file already
+// written to it, or optionally that are identical to one.
+type hardLinks struct {
+	identical bool
+	byID      map[winio.FileIDInfo]linkTarget
+	byContent map[string]linkTarget
+
+	// The current entry's keys, recorded by add once it has been written.
+	id      *winio.FileIDInfo
+	content string
+}
+
+func newHardLinks(opts Options) *hardLinks {
+	if !opts.HardLinks {
+		return nil
+	}
+	return &hardLinks{
+		identical: opts.LinkIdentical,
+		byID:      map[winio.FileIDInfo]linkTarget{},
+		byContent: map[string]linkTarget{},
+	}
+}
+
+// match returns the file already written that r's current entry can be
+// written as a link to. stream is the entry's backup stream, which is
+// rewound after being hashed so the entry can still be written.
+func (l *hardLinks) match(r hcsshim.LayerReader, stream io.Reader, size int64, fileInfo *winio.FileBasicInfo) (linkTarget, bool, error) {
+	l.id, l.content = nil, ""
+	if fileInfo.FileAttributes&(syscall.FILE_ATTRIBUTE_DIRECTORY|syscall.FILE_ATTRIBUTE_REPARSE_POINT) != 0 {
+		return linkTarget{}, false, nil
+	}
+
+	links, id, err := r.LinkInfo()
+	if err != nil {
+		return linkTarget{}, false, err
+	}
+	if links > 1 {
+		if target, ok := l.byID[*id]; ok {
+			return target, true, nil
+		}
+		l.id = id
+	}
+
+	if !l.identical || size == 0 {
+		return linkTarget{}, false, nil
+	}
+	rewind, ok := rewindable(stream)
+	if !ok {
+		return linkTarget{}, false, nil
+	}
+	// A link shares everything but the name with its target, so the whole
+	// backup stream is compared rather than just the data.
+	digest := sha256.New()
+	_, err = io.Copy(digest, stream)
+	if rerr := rewind(); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return linkTarget{}, false, err
+	}
+	content := fmt.Sprintf("%x:%s", fileInfo.FileAttributes, hex.EncodeToString(digest.Sum(nil)))
+	if target, ok := l.byContent[content]; ok {
+		return target, true, nil
+	}
+	l.content = content
+	return linkTarget{}, false, nil
+}
+
+// add records the current entry, once it has been written, as a target for
+// later links.
+func (l *hardLinks) add(target linkTarget) {
+	if l.id != nil {
+		l.byID[*l.id] = target
+	}
+	if l.content != "" {
+		l.byContent[l.content] = target
+	}
+}
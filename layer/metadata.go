@@ -0,0 +1,244 @@
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"path"
+	"strings"
+
+	winio "github.com/Microsoft/go-winio"
+	"github.com/Microsoft/go-winio/backuptar"
+)
+
+// eaPrefix starts the PAX records backuptar writes a file's extended
+// attributes to.
+const eaPrefix = "MSWINDOWS.xattr."
+
+// MetadataPolicy says which of a file's alternate data streams, or which of
+// its extended attributes, are left out of the layer. The zero value keeps
+// them all.
+type MetadataPolicy struct {
+	// DropAll leaves out every one of them.
+	DropAll bool
+	// Drop leaves out those whose name matches one of these path.Match
+	// patterns, ignoring case, e.g. Zone.Identifier.
+	Drop []string
+}
+
+func (p MetadataPolicy) keepsAll() bool {
+	return !p.DropAll && len(p.Drop) == 0
+}
+
+func (p MetadataPolicy) drops(name string) bool {
+	if p.DropAll {
+		return true
+	}
+	name = strings.ToLower(name)
+	for _, pattern := range p.Drop {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// metadataFilter leaves the alternate data streams and extended attributes
+// dropped by Options' policies out of the entries written through it, and
+// counts them. A nil filter keeps everything.
+type metadataFilter struct {
+	streams MetadataPolicy
+	eas     MetadataPolicy
+
+	droppedStreams int
+	droppedEAs     int
+}
+
+func newMetadataFilter(opts Options) *metadataFilter {
+	if opts.AlternateDataStreams.keepsAll() && opts.ExtendedAttributes.keepsAll() {
+		return nil
+	}
+	return &metadataFilter{streams: opts.AlternateDataStreams, eas: opts.ExtendedAttributes}
+}
+
+// record adds what the filter dropped to result.
+func (f *metadataFilter) record(result *Result) {
+	if f == nil {
+		return
+	}
+	result.DroppedStreams += f.droppedStreams
+	result.DroppedEAs += f.droppedEAs
+}
+
+// writeBackupStream writes a file to t from its backup stream, like
+// backuptar.WriteTarFileFromBackupStream, without the metadata f drops.
+func (f *metadataFilter) writeBackupStream(t *tar.Writer, stream io.Reader, name string, size int64, fileInfo *winio.FileBasicInfo) error {
+	if f == nil {
+		return backuptar.WriteTarFileFromBackupStream(t, stream, name, size, fileInfo)
+	}
+
+	filtered := &filteredStream{filter: f, r: stream}
+	filtered.rewind, _ = rewindable(stream)
+	err := backuptar.WriteTarFileFromBackupStream(t, filtered, name, size, fileInfo)
+	f.droppedStreams += filtered.streams
+	f.droppedEAs += filtered.eas
+	return err
+}
+
+// tarHeader returns hdr without the extended attributes f drops.
+func (f *metadataFilter) tarHeader(hdr *tar.Header) *tar.Header {
+	if f == nil || f.eas.keepsAll() {
+		return hdr
+	}
+
+	filtered := *hdr
+	filtered.PAXRecords = map[string]string{}
+	for key, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, eaPrefix); ok && f.eas.drops(name) {
+			f.droppedEAs++
+			continue
+		}
+		filtered.PAXRecords[key] = value
+	}
+	return &filtered
+}
+
+// dropsStream reports whether the tar entry holding one of file's alternate
+// data streams should be left out.
+func (f *metadataFilter) dropsStream(stream, file *tar.Header) bool {
+	if f == nil || !f.streams.drops(strings.TrimPrefix(stream.Name, file.Name+":")) {
+		return false
+	}
+	f.droppedStreams++
+	return true
+}
+
+// filteredStream is a backup stream without the alternate data streams and
+// extended attributes its filter drops.
+type filteredStream struct {
+	filter *metadataFilter
+	r      io.Reader
+	rewind func() error
+
+	br      *winio.BackupStreamReader
+	pending bytes.Buffer
+	copying bool
+	pos     int64
+
+	// What has been dropped since the stream was last rewound.
+	streams int
+	eas     int
+}
+
+func (s *filteredStream) Read(p []byte) (int, error) {
+	n, err := s.read(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *filteredStream) read(p []byte) (int, error) {
+	if s.br == nil {
+		s.br = winio.NewBackupStreamReader(s.r)
+	}
+	for {
+		if s.pending.Len() > 0 {
+			return s.pending.Read(p)
+		}
+		if s.copying {
+			n, err := s.br.Read(p)
+			if err == io.EOF {
+				s.copying = false
+				if n == 0 {
+					continue
+				}
+				err = nil
+			}
+			return n, err
+		}
+
+		hdr, err := s.br.Next()
+		if err != nil {
+			return 0, err
+		}
+		var data []byte
+		switch hdr.Id {
+		case winio.BackupAlternateData:
+			if s.filter.streams.drops(strings.TrimSuffix(strings.TrimPrefix(hdr.Name, ":"), ":$DATA")) {
+				s.streams++
+				continue
+			}
+		case winio.BackupEaData:
+			if s.filter.eas.keepsAll() {
+				break
+			}
+			if data, err = s.filterEAs(); err != nil {
+				return 0, err
+			}
+			if data == nil {
+				continue
+			}
+			hdr.Size = int64(len(data))
+		}
+
+		if err := winio.NewBackupStreamWriter(&s.pending).WriteHeader(hdr); err != nil {
+			return 0, err
+		}
+		if data != nil {
+			s.pending.Write(data)
+		} else {
+			s.copying = true
+		}
+	}
+}
+
+// filterEAs reads the current stream of extended attributes and encodes the
+// ones that are kept, returning nil if none are.
+func (s *filteredStream) filterEAs() ([]byte, error) {
+	data, err := io.ReadAll(s.br)
+	if err != nil {
+		return nil, err
+	}
+	eas, err := winio.DecodeExtendedAttributes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []winio.ExtendedAttribute
+	for _, ea := range eas {
+		if s.filter.eas.drops(ea.Name) {
+			s.eas++
+			continue
+		}
+		kept = append(kept, ea)
+	}
+	if len(kept) == 0 {
+		return nil, nil
+	}
+	return winio.EncodeExtendedAttributes(kept)
+}
+
+// Seek only supports what backuptar needs to read the stream twice: skipping
+// forward and rewinding to the start.
+func (s *filteredStream) Seek(offset int64, whence int) (int64, error) {
+	if s.rewind == nil {
+		return 0, errors.New("backup stream is not seekable")
+	}
+	switch {
+	case offset >= 0 && whence == io.SeekCurrent:
+		_, err := io.CopyN(io.Discard, s, offset)
+		return s.pos, err
+	case offset == 0 && whence == io.SeekStart:
+		if err := s.rewind(); err != nil {
+			return 0, err
+		}
+		s.br = nil
+		s.pending.Reset()
+		s.copying = false
+		s.pos = 0
+		s.streams, s.eas = 0, 0
+		return 0, nil
+	default:
+		return 0, errors.New("unsupported seek in filtered backup stream")
+	}
+}
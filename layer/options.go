@@ -0,0 +1,177 @@
+package layer
+
+import (
+	"io"
+
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
+	winio "github.com/Microsoft/go-winio"
+)
+
+// Compression selects how the exported tar stream is compressed.
+type Compression int
+
+const (
+	CompressionGzip Compression = iota
+	CompressionNone
+)
+
+// Change is how an entry differs from the container's parent layers.
+type Change = layerfmt.Change
+
+const (
+	ChangeAdded    = layerfmt.ChangeAdded
+	ChangeModified = layerfmt.ChangeModified
+	ChangeDeleted  = layerfmt.ChangeDeleted
+)
+
+// Entry is a single path read from the container's layer.
+type Entry struct {
+	// Name is the slash separated path inside the layer, e.g. Files/hello.txt.
+	Name string
+	Size int64
+	// FileInfo is nil for whiteouts.
+	FileInfo *winio.FileBasicInfo
+	// Whiteout is set when Name was deleted in the container.
+	Whiteout bool
+	// Change is ChangeDeleted for whiteouts, ChangeModified when Name exists
+	// in one of the parent layers and ChangeAdded otherwise, including when
+	// a parent deleted it from the layers below. It is only set when Filters,
+	// OnEntry or PruneUnchanged are.
+	Change Change
+	// Digest is the sha256 of a regular file's content in "sha256:<hex>"
+	// form. It is only set on entries passed to OnEntry when
+	// Options.DigestEntries is set. Links have their target's digest.
+	Digest string
+	// Link is set when the entry was written as a hard link to the earlier
+	// entry it names.
+	Link string
+}
+
+// Filter reports whether an entry should be written to the exported layer.
+type Filter func(Entry) bool
+
+// Options controls how a layer is exported. The zero value produces the same
+// gzipped tar as Export.
+type Options struct {
+	// Layout overrides where the container's layers are found.
+	Layout Layout
+
+	Compression Compression
+	// CompressionLevel is a compress/gzip level. Zero uses gzip.DefaultCompression.
+	CompressionLevel int
+
+	// Filters are applied in order; an entry is skipped as soon as one of
+	// them returns false.
+	Filters []Filter
+
+	// OnEntry is called after each entry has been written to the layer.
+	OnEntry func(Entry)
+	// DigestEntries hashes the content of each file as it is written, for
+	// Entry.Digest.
+	DigestEntries bool
+
+	// Tee receives a copy of the uncompressed tar stream as it is written,
+	// e.g. to inspect the layer's content without reading it back.
+	Tee io.Writer
+
+	// PruneUnchanged drops files the container rewrote without changing
+	// their content, attributes, alternate data streams, extended attributes
+	// or security descriptor, comparing them with the version in the topmost
+	// parent layer that has them.
+	PruneUnchanged bool
+
+	// HardLinks writes files that are hard links to a file already written
+	// as tar hard links to it instead of writing their content again.
+	HardLinks bool
+	// LinkIdentical also writes files whose content, attributes and streams
+	// are identical to a file already written as hard links to it. The
+	// files then share the first one's timestamps once the layer is
+	// imported. It only applies with HardLinks.
+	LinkIdentical bool
+
+	// AlternateDataStreams and ExtendedAttributes say which of each file's
+	// alternate data streams and extended attributes to leave out, e.g. the
+	// Zone.Identifier stream Windows adds to downloaded files.
+	AlternateDataStreams MetadataPolicy
+	ExtendedAttributes   MetadataPolicy
+
+	// Reparse says how symlinks and junctions are written. Their targets
+	// must be inside the layer unless they are skipped. It doesn't apply
+	// with Squash.
+	Reparse ReparsePolicy
+
+	// Squash flattens the container's diff and all of its parent layers into
+	// a single layer holding the container's whole filesystem. Whiteouts are
+	// applied instead of written and every entry is ChangeAdded.
+	Squash bool
+	// ParentTarballs are exported parent layers, topmost first, to squash
+	// the diff with instead of reading the layer folders. They may be
+	// gzipped.
+	ParentTarballs []string
+
+	// DryRun walks the layer, counting the entries Filters keep in Result and
+	// passing them to OnEntry, without reading their content or writing
+	// anything to w. Result's digest and sizes are left empty. PruneUnchanged
+	// and HardLinks need the content of files so they are ignored, as are
+	// the targets of reparse points, and it doesn't apply with Squash. The
+	// layer is still unprepared, so set Reprepare to leave the container as
+	// it was.
+	DryRun bool
+
+	// Reprepare prepares the container's layer again once the layer reader
+	// has been closed, whether or not the export succeeded, so the container
+	// stays usable after its diff has been taken.
+	Reprepare bool
+}
+
+// Result describes an exported layer.
+type Result struct {
+	// Digest is the sha256 of the bytes written, in "sha256:<hex>" form.
+	Digest string
+	// Size is the number of bytes written.
+	Size int64
+	// UncompressedSize is the size of the tar stream before compression.
+	UncompressedSize int64
+	// BytesRead is the number of bytes read from the layer's backup streams,
+	// counting the first pass made over files to collect their extended
+	// attributes.
+	BytesRead int64
+
+	// Entries is the number of entries written, including whiteouts.
+	Entries   int
+	Whiteouts int
+	// Skipped is the number of entries dropped by Filters, or as reparse
+	// points by ReparseSkip.
+	Skipped int
+	// Pruned is the number of unchanged files dropped by PruneUnchanged, and
+	// PrunedBytes the size of their content.
+	Pruned      int
+	PrunedBytes int64
+	// Links is the number of entries written as hard links by HardLinks,
+	// and LinkedBytes the size of the content they didn't write again.
+	Links       int
+	LinkedBytes int64
+	// DirectoryLinks is the number of junctions and directory symlinks
+	// written as plain symlinks by ReparseDereference, which only
+	// dereferences links to files.
+	DirectoryLinks int
+	// DroppedStreams and DroppedEAs are the number of alternate data
+	// streams and extended attributes left out by the metadata policies.
+	DroppedStreams int
+	DroppedEAs     int
+}
+
+// needsChange tells whether anything looks at Entry.Change, which takes a
+// lookup in the parent layers for every entry.
+func (o Options) needsChange() bool {
+	return len(o.Filters) > 0 || o.OnEntry != nil || o.PruneUnchanged
+}
+
+func (o Options) keep(entry Entry) bool {
+	for _, filter := range o.Filters {
+		if !filter(entry) {
+			return false
+		}
+	}
+	return true
+}
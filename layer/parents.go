@@ -0,0 +1,66 @@
+package layer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/Microsoft/hcsshim"
+)
+
+// ParentLayers returns the folders of the container's read-only parent
+// layers, topmost first.
+func (e *Exporter) ParentLayers(layout Layout) ([]string, error) {
+	resolved, err := e.resolveLayout(layout)
+	if err != nil {
+		return nil, withStage(StageSpec, err)
+	}
+	return resolved.layerFolders, nil
+}
+
+// ExportParentTo writes the i'th of the container's read-only parent
+// layers, topmost first, to w. The container's own layer is left alone, so
+// opts.Reprepare and opts.Squash don't apply. Entries are added or modified
+// relative to the layers below the parent.
+func (e *Exporter) ExportParentTo(ctx context.Context, w io.Writer, i int, opts Options) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	layerFolders, err := e.ParentLayers(opts.Layout)
+	if err != nil {
+		return Result{}, err
+	}
+	if i < 0 || i >= len(layerFolders) {
+		return Result{}, fmt.Errorf("container has no parent layer %d", i)
+	}
+
+	parent := parentLayer(e.driver, layerFolders, i)
+	var result Result
+	err = e.driver.RunWithBackupPrivilege(func() error {
+		r, err := e.driver.NewLayerReader(parent.info, parent.layerId, parent.parents)
+		if err != nil {
+			return err
+		}
+
+		result, err = writeTarFromLayer(ctx, r, stageWriter{w}, opts, parent.parents)
+		cerr := r.Close()
+		if err == nil {
+			err = cerr
+		}
+		return err
+	})
+	return result, withStage(StageReader, err)
+}
+
+// parentLayer reads the i'th of the container's read-only parent layers,
+// whose own parents are the folders below it.
+func parentLayer(driver Driver, layerFolders []string, i int) folderLayer {
+	return folderLayer{
+		driver:  driver,
+		info:    hcsshim.DriverInfo{Flavour: 1, HomeDir: filepath.Dir(layerFolders[i])},
+		layerId: filepath.Base(layerFolders[i]),
+		parents: layerFolders[i+1:],
+	}
+}
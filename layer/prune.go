@@ -0,0 +1,101 @@
+package layer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	winio "github.com/Microsoft/go-winio"
+)
+
+// ignoredAttributes change whenever a file is rewritten, whatever its
+// content.
+const ignoredAttributes = syscall.FILE_ATTRIBUTE_ARCHIVE | syscall.FILE_ATTRIBUTE_NORMAL
+
+// unchanged reports whether a regular file the container modified has the
+// same content, attributes, alternate data streams, extended attributes and
+// security descriptor as parentFile, the version it shadows. stream is the
+// file's backup stream, which is rewound afterwards so the file can still be
+// written. Files that can't be compared, such as those with sparse regions,
+// count as changed.
+func unchanged(stream io.Reader, size int64, fileInfo *winio.FileBasicInfo, parentFile string) (bool, error) {
+	rewind, ok := rewindable(stream)
+	if !ok || fileInfo.FileAttributes&(syscall.FILE_ATTRIBUTE_DIRECTORY|syscall.FILE_ATTRIBUTE_REPARSE_POINT) != 0 {
+		return false, nil
+	}
+
+	parent, err := os.Lstat(parentFile)
+	if err != nil || !parent.Mode().IsRegular() || parent.Size() != size {
+		return false, nil
+	}
+	if attrs, ok := parent.Sys().(*syscall.Win32FileAttributeData); !ok || attrs.FileAttributes&^ignoredAttributes != fileInfo.FileAttributes&^ignoredAttributes {
+		return false, nil
+	}
+
+	digest, err := backupDigest(stream)
+	if rerr := rewind(); err == nil {
+		err = rerr
+	}
+	if err != nil || digest.sum == nil {
+		return false, err
+	}
+
+	parentDigest, err := fileBackupDigest(parentFile, digest.security)
+	if err != nil || parentDigest.sum == nil {
+		return false, err
+	}
+	return bytes.Equal(digest.sum, parentDigest.sum), nil
+}
+
+// streamsDigest is the hash of every stream of a file's backup stream.
+type streamsDigest struct {
+	// sum is nil when the file has sparse regions, which can't be compared.
+	sum []byte
+	// security is set when the backup stream holds a security descriptor.
+	security bool
+}
+
+// backupDigest hashes each stream of a backup stream along with its kind and
+// name, so that files only match when all of their streams do.
+func backupDigest(stream io.Reader) (streamsDigest, error) {
+	var digest streamsDigest
+	h := sha256.New()
+	br := winio.NewBackupStreamReader(stream)
+	for {
+		hdr, err := br.Next()
+		if err == io.EOF {
+			digest.sum = h.Sum(nil)
+			return digest, nil
+		}
+		if err != nil {
+			return streamsDigest{}, err
+		}
+		switch hdr.Id {
+		case winio.BackupSparseBlock:
+			return streamsDigest{}, nil
+		case winio.BackupSecurity:
+			digest.security = true
+		}
+		fmt.Fprintf(h, "%d %q %d\n", hdr.Id, hdr.Name, hdr.Size)
+		if _, err := io.Copy(h, br); err != nil {
+			return streamsDigest{}, err
+		}
+	}
+}
+
+// fileBackupDigest hashes the backup stream of the file at path, with its
+// security descriptor if security is set.
+func fileBackupDigest(path string, security bool) (streamsDigest, error) {
+	f, err := winio.OpenForBackup(path, syscall.GENERIC_READ, syscall.FILE_SHARE_READ, syscall.OPEN_EXISTING)
+	if err != nil {
+		return streamsDigest{}, err
+	}
+	defer f.Close()
+
+	r := winio.NewBackupFileReader(f, security)
+	defer r.Close()
+	return backupDigest(r)
+}
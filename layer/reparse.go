@@ -0,0 +1,214 @@
+package layer
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
+	winio "github.com/Microsoft/go-winio"
+)
+
+// ReparsePolicy says how reparse points, i.e. symlinks and junctions, are
+// written to the layer.
+type ReparsePolicy int
+
+const (
+	// ReparsePreserve writes them as backuptar does, as tar symlinks to
+	// their Windows target carrying their Windows metadata.
+	ReparsePreserve ReparsePolicy = iota
+	// ReparseSymlink writes them as plain tar symlinks relative to the
+	// link, for consumers other than Windows.
+	ReparseSymlink
+	// ReparseDereference writes the file they point to in their place, and
+	// links to directories as ReparseSymlink does.
+	ReparseDereference
+	// ReparseSkip leaves them out.
+	ReparseSkip
+)
+
+// reparseTagTombstone is IO_REPARSE_TAG_WCI_TOMBSTONE, the tag of the empty
+// reparse points read-only layers keep in place of files they deleted.
+const reparseTagTombstone = 0xA000001F
+
+var (
+	ErrReparseTargetOutsideLayer = errors.New("reparse point target is outside the layer")
+	ErrReparseTargetNotFile      = errors.New("reparse point target is not a file in the layer or its parents")
+)
+
+func isReparsePoint(fileInfo *winio.FileBasicInfo) bool {
+	return fileInfo != nil && fileInfo.FileAttributes&syscall.FILE_ATTRIBUTE_REPARSE_POINT != 0
+}
+
+func isRegular(fileInfo *winio.FileBasicInfo) bool {
+	return fileInfo != nil && fileInfo.FileAttributes&(syscall.FILE_ATTRIBUTE_DIRECTORY|syscall.FILE_ATTRIBUTE_REPARSE_POINT) == 0
+}
+
+// reparseTarget returns the path inside the layer that the reparse point
+// name, whose backup stream is stream, points to. Absolute targets must be
+// on the container's system drive, and no target may leave the layer's root.
+func reparseTarget(name string, stream io.Reader) (string, error) {
+	rp, err := reparsePoint(stream)
+	if err != nil {
+		return "", err
+	}
+	target, ok := layerfmt.ResolveLink(name, rp.Target)
+	if !ok {
+		return "", fmt.Errorf("%w: %s points to %s", ErrReparseTargetOutsideLayer, name, rp.Target)
+	}
+	return target, nil
+}
+
+// reparsePoint reads the reparse point an entry's backup stream holds, and
+// rewinds the stream so the entry can still be written.
+func reparsePoint(stream io.Reader) (*winio.ReparsePoint, error) {
+	rewind, ok := rewindable(stream)
+	if !ok {
+		return nil, errors.New("cannot read the reparse point of an unseekable backup stream")
+	}
+
+	rp, err := decodeReparsePoint(stream)
+	if rerr := rewind(); err == nil {
+		err = rerr
+	}
+	return rp, err
+}
+
+func decodeReparsePoint(stream io.Reader) (*winio.ReparsePoint, error) {
+	br := winio.NewBackupStreamReader(stream)
+	for {
+		hdr, err := br.Next()
+		if err == io.EOF {
+			return nil, errors.New("backup stream has no reparse data")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Id == winio.BackupReparseData {
+			data, err := io.ReadAll(br)
+			if err != nil {
+				return nil, err
+			}
+			return winio.DecodeReparsePoint(data)
+		}
+	}
+}
+
+// symlinkHeader is a plain tar symlink from name to target, both paths
+// inside the layer, which points to target relative to name so that it
+// stays inside wherever the layer is extracted.
+func symlinkHeader(name, target string, fileInfo *winio.FileBasicInfo) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: layerfmt.RelativeLink(name, target),
+		Mode:     0777,
+		ModTime:  time.Unix(0, fileInfo.LastWriteTime.Nanoseconds()),
+	}
+}
+
+// dereference is a reparse point to write as the file it points to once the
+// whole layer has been read, as the file may come later in it.
+type dereference struct {
+	entry  Entry
+	target string
+}
+
+// layerFiles records what each path of the layer being written is, to
+// resolve the reparse points dereferenced to them.
+type layerFiles struct {
+	// files are the regular files written, and what to link to for them.
+	files map[string]linkTarget
+	// others are every other path seen in the layer.
+	others map[string]bool
+}
+
+func newLayerFiles() *layerFiles {
+	return &layerFiles{files: map[string]linkTarget{}, others: map[string]bool{}}
+}
+
+// layerFiles are only recorded when dereferencing, so their methods do
+// nothing on a nil *layerFiles.
+func (l *layerFiles) addFile(name string, target linkTarget) {
+	if l != nil {
+		l.files[strings.ToLower(name)] = target
+	}
+}
+
+func (l *layerFiles) addOther(name string) {
+	if l != nil {
+		l.others[strings.ToLower(name)] = true
+	}
+}
+
+// writeDereferenced writes each reparse point in deref as the file it points
+// to: as a hard link to it when the file is in the layer, or as a copy of
+// the topmost version of it in parents.
+func writeDereferenced(deref []dereference, files *layerFiles, output *layerOutput, filter *metadataFilter, parents []string, opts Options, result *Result) error {
+	for _, d := range deref {
+		entry := d.entry
+		key := strings.ToLower(d.target)
+
+		output.startEntry()
+		if target, ok := files.files[key]; ok {
+			hdr := &tar.Header{Typeflag: tar.TypeLink, Name: entry.Name, Linkname: target.name}
+			if err := output.t.WriteHeader(hdr); err != nil {
+				return err
+			}
+			entry.Link = target.name
+			entry.Digest = target.digest
+		} else {
+			parentFile, ok := findInParents(filepath.FromSlash(d.target), parents)
+			if files.others[key] || !ok {
+				return fmt.Errorf("%w: %s points to %s", ErrReparseTargetNotFile, entry.Name, d.target)
+			}
+			size, fileInfo, err := writeParentFile(output.t, filter, entry.Name, parentFile)
+			if err != nil {
+				return err
+			}
+			entry.Size = size
+			entry.FileInfo = fileInfo
+			entry.Digest = output.entryDigest()
+		}
+		result.Entries++
+
+		if opts.OnEntry != nil {
+			opts.OnEntry(entry)
+		}
+	}
+	return nil
+}
+
+// writeParentFile writes the regular file parentFile, from one of the
+// container's parent layers, to t as name.
+func writeParentFile(t *tar.Writer, filter *metadataFilter, name, parentFile string) (int64, *winio.FileBasicInfo, error) {
+	f, err := winio.OpenForBackup(parentFile, syscall.GENERIC_READ, syscall.FILE_SHARE_READ, syscall.OPEN_EXISTING)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	fileInfo, err := winio.GetFileBasicInfo(f)
+	if err != nil {
+		return 0, nil, err
+	}
+	if fileInfo.FileAttributes&(syscall.FILE_ATTRIBUTE_DIRECTORY|syscall.FILE_ATTRIBUTE_REPARSE_POINT) != 0 {
+		return 0, nil, fmt.Errorf("%w: %s points to %s", ErrReparseTargetNotFile, name, parentFile)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	br := winio.NewBackupFileReader(f, true)
+	defer br.Close()
+	if err := filter.writeBackupStream(t, br, name, stat.Size(), fileInfo); err != nil {
+		return 0, nil, err
+	}
+	return stat.Size(), fileInfo, nil
+}
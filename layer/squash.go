@@ -0,0 +1,527 @@
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
+	winio "github.com/Microsoft/go-winio"
+	"github.com/Microsoft/go-winio/backuptar"
+	"github.com/Microsoft/hcsshim"
+)
+
+// ErrSquashHiveDeltas is returned when more than one of the layers being
+// squashed changes the same registry hive. Each layer's changes are a delta
+// against the hive below it, which can't be merged without loading the
+// hives, and keeping only the topmost delta would lose the others. As the
+// container's diff has deltas for the hives Windows writes to while it runs,
+// only containers whose parents have no deltas, i.e. ones run straight on a
+// base layer, can be squashed.
+var ErrSquashHiveDeltas = errors.New("cannot squash layers that each change the same registry hive")
+
+// hivesDir is the folder of a layer holding its registry hives.
+const hivesDir = "Hives"
+
+// squashLayer is one of the layers being squashed. Each is read twice: once
+// to find which layer has the topmost version of every path, and again to
+// write those versions out.
+type squashLayer interface {
+	open() (squashReader, error)
+}
+
+type squashReader interface {
+	// next advances to the layer's next entry.
+	next() (squashEntry, error)
+	// header returns the current entry's tar header.
+	header() (*tar.Header, error)
+	// write writes the current entry, with the alternate data streams and
+	// extended attributes filter keeps.
+	write(t *tar.Writer, filter *metadataFilter) error
+	bytesRead() int64
+	close() error
+}
+
+type squashEntry struct {
+	Entry
+	dir bool
+}
+
+// key identifies a path across layers. Windows paths are case insensitive.
+func (e squashEntry) key() string {
+	return strings.ToLower(strings.TrimSuffix(e.Name, "/"))
+}
+
+// squashPath is the topmost version of a path.
+type squashPath struct {
+	layer int
+	dir   bool
+	entry Entry
+	// header is only kept for directories, which are written where they
+	// first appear rather than in their topmost layer.
+	header *tar.Header
+}
+
+type squashIndex struct {
+	paths map[string]squashPath
+	// whiteouts holds the topmost layer deleting each path.
+	whiteouts map[string]int
+}
+
+// hidden reports whether the version of key in layer was deleted or
+// replaced by a file in a layer above it.
+func (x *squashIndex) hidden(key string, layer int) bool {
+	for p := key; ; {
+		if w, ok := x.whiteouts[p]; ok && w < layer {
+			return true
+		}
+		if p != key {
+			if top, ok := x.paths[p]; ok && !top.dir && top.layer < layer {
+				return true
+			}
+		}
+		i := strings.LastIndexByte(p, '/')
+		if i < 0 {
+			return false
+		}
+		p = p[:i]
+	}
+}
+
+// squashLayers writes a single layer holding what layers, topmost first,
+// add up to. Layers are written bottom up so directories always come before
+// their content, and the whiteouts are applied rather than written.
+//
+// Reading every layer twice is deliberate, although for layer folders each
+// pass has hcsshim export the layer again. Writing the bottom layer needs
+// the index of every layer above it, and the layer readers can only be read
+// through once, so the alternative would be to spool each layer to disk,
+// which costs as much as the second export.
+func squashLayers(ctx context.Context, layers []squashLayer, w io.Writer, opts Options) (Result, error) {
+	var result Result
+
+	index, bytesRead, err := indexLayers(ctx, layers)
+	result.BytesRead = bytesRead
+	if err != nil {
+		return result, err
+	}
+
+	output, err := newLayerOutput(w, opts)
+	if err != nil {
+		return result, err
+	}
+	filter := newMetadataFilter(opts)
+	written := map[string]bool{}
+	for i := len(layers) - 1; i >= 0; i-- {
+		r, err := layers[i].open()
+		if err != nil {
+			return result, err
+		}
+		err = squashLayerInto(ctx, r, i, index, written, output, filter, opts, &result)
+		result.BytesRead += r.bytesRead()
+		cerr := r.close()
+		if err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+
+	filter.record(&result)
+	err = output.close(&result)
+	return result, err
+}
+
+func squashLayerInto(ctx context.Context, r squashReader, layer int, index *squashIndex, written map[string]bool, output *layerOutput, filter *metadataFilter, opts Options, result *Result) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		e, err := r.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		key := e.key()
+		if e.Whiteout || index.hidden(key, layer) {
+			continue
+		}
+
+		top := index.paths[key]
+		entry := top.entry
+		entry.Change = ChangeAdded
+		if e.dir {
+			if !top.dir || written[key] {
+				continue
+			}
+			written[key] = true
+		} else if top.layer != layer {
+			continue
+		}
+		if !opts.keep(entry) {
+			result.Skipped++
+			continue
+		}
+
+		output.startEntry()
+		if e.dir {
+			err = output.t.WriteHeader(filter.tarHeader(top.header))
+		} else {
+			err = r.write(output.t, filter)
+		}
+		if err != nil {
+			return err
+		}
+		entry.Digest = output.entryDigest()
+		result.Entries++
+
+		if opts.OnEntry != nil {
+			opts.OnEntry(entry)
+		}
+	}
+}
+
+// indexLayers finds the topmost version of every path in layers and the
+// topmost layer deleting it.
+func indexLayers(ctx context.Context, layers []squashLayer) (*squashIndex, int64, error) {
+	index := &squashIndex{paths: map[string]squashPath{}, whiteouts: map[string]int{}}
+	var bytesRead int64
+	for i, l := range layers {
+		r, err := l.open()
+		if err != nil {
+			return nil, bytesRead, err
+		}
+		err = indexLayer(ctx, r, i, index)
+		bytesRead += r.bytesRead()
+		cerr := r.close()
+		if err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, bytesRead, err
+		}
+	}
+	return index, bytesRead, nil
+}
+
+func indexLayer(ctx context.Context, r squashReader, layer int, index *squashIndex) error {
+	// A layer's whiteouts only delete paths in the layers below it, never
+	// its own, so they are applied once the whole layer has been seen.
+	var whiteouts []string
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		e, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		key := e.key()
+		if e.Whiteout {
+			whiteouts = append(whiteouts, key)
+			continue
+		}
+		if top, ok := index.paths[key]; ok {
+			if isHiveDelta(key) && !top.dir {
+				return fmt.Errorf("%w: %s", ErrSquashHiveDeltas, e.Name)
+			}
+			continue
+		}
+
+		p := squashPath{layer: layer, dir: e.dir, entry: e.Entry}
+		if e.dir {
+			if p.header, err = r.header(); err != nil {
+				return err
+			}
+		}
+		index.paths[key] = p
+	}
+
+	for _, key := range whiteouts {
+		if _, ok := index.whiteouts[key]; !ok {
+			index.whiteouts[key] = layer
+		}
+	}
+	return nil
+}
+
+// isHiveDelta reports whether key is one of a layer's registry deltas,
+// Hives/*_Delta.
+func isHiveDelta(key string) bool {
+	return strings.HasPrefix(key, "hives/") && strings.HasSuffix(key, "_delta")
+}
+
+// checkParentHives fails with ErrSquashHiveDeltas if any of the parent
+// layers has a registry delta, which the container's diff would clash with.
+// It runs before the container's layer is unprepared, so a squash that
+// can't succeed leaves the container alone.
+func checkParentHives(layerFolders, parentTarballs []string) error {
+	if len(parentTarballs) > 0 {
+		for _, tarball := range parentTarballs {
+			if err := checkTarballHives(tarball); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, folder := range layerFolders {
+		hives, err := os.ReadDir(filepath.Join(folder, hivesDir))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading parent layer hives: %w", err)
+		}
+		for _, hive := range hives {
+			if isHiveDelta(strings.ToLower(hivesDir + "/" + hive.Name())) {
+				return fmt.Errorf("%w: %s", ErrSquashHiveDeltas, filepath.Join(folder, hivesDir, hive.Name()))
+			}
+		}
+	}
+	return nil
+}
+
+func checkTarballHives(tarball string) (err error) {
+	r, err := tarballLayer{path: tarball}.open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := r.close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	for {
+		e, err := r.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !e.Whiteout && isHiveDelta(e.key()) {
+			return fmt.Errorf("%w: %s in %s", ErrSquashHiveDeltas, e.Name, tarball)
+		}
+	}
+}
+
+// squashSources returns the container's diff and the layers to squash it
+// with, topmost first.
+func (e *Exporter) squashSources(layout resolvedLayout, opts Options) []squashLayer {
+	layers := []squashLayer{folderLayer{driver: e.driver, info: layout.driverInfo, layerId: layout.layerId, parents: layout.layerFolders}}
+	if len(opts.ParentTarballs) > 0 {
+		for _, tarball := range opts.ParentTarballs {
+			layers = append(layers, tarballLayer{path: tarball})
+		}
+		return layers
+	}
+	for i := range layout.layerFolders {
+		layers = append(layers, parentLayer(e.driver, layout.layerFolders, i))
+	}
+	return layers
+}
+
+// folderLayer is a layer read from disk by the driver.
+type folderLayer struct {
+	driver  Driver
+	info    hcsshim.DriverInfo
+	layerId string
+	parents []string
+}
+
+func (l folderLayer) open() (squashReader, error) {
+	r, err := l.driver.NewLayerReader(l.info, l.layerId, l.parents)
+	if err != nil {
+		return nil, err
+	}
+	counter, stream := newCountingReader(r)
+	return &folderReader{r: r, counter: counter, stream: stream}, nil
+}
+
+type folderReader struct {
+	r       hcsshim.LayerReader
+	counter *countingReader
+	stream  io.Reader
+
+	name     string
+	size     int64
+	fileInfo *winio.FileBasicInfo
+}
+
+func (r *folderReader) next() (squashEntry, error) {
+	name, size, fileInfo, err := r.r.Next()
+	if err != nil {
+		return squashEntry{}, err
+	}
+	r.name, r.size, r.fileInfo = name, size, fileInfo
+	return squashEntry{
+		Entry: Entry{Name: filepath.ToSlash(name), Size: size, FileInfo: fileInfo, Whiteout: fileInfo == nil},
+		dir:   fileInfo != nil && fileInfo.FileAttributes&syscall.FILE_ATTRIBUTE_DIRECTORY != 0,
+	}, nil
+}
+
+func (r *folderReader) header() (*tar.Header, error) {
+	var buf bytes.Buffer
+	t := tar.NewWriter(&buf)
+	if err := r.write(t, nil); err != nil {
+		return nil, err
+	}
+	if err := t.Close(); err != nil {
+		return nil, err
+	}
+	return tar.NewReader(&buf).Next()
+}
+
+func (r *folderReader) write(t *tar.Writer, filter *metadataFilter) error {
+	return filter.writeBackupStream(t, r.stream, r.name, r.size, r.fileInfo)
+}
+
+func (r *folderReader) bytesRead() int64 {
+	return r.counter.n
+}
+
+func (r *folderReader) close() error {
+	return r.r.Close()
+}
+
+// tarballLayer is a layer previously exported to a tar file, which may be
+// gzipped.
+type tarballLayer struct {
+	path string
+}
+
+func (l tarballLayer) open() (squashReader, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	counter := &countingReader{r: f}
+	r, _, err := layerfmt.Decompress(counter)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &tarballReader{f: f, counter: counter, t: tar.NewReader(r)}, nil
+}
+
+// tarballReader treats a file's alternate data streams, which backuptar
+// writes as entries of their own right after it, as part of the file.
+type tarballReader struct {
+	f       *os.File
+	counter *countingReader
+	t       *tar.Reader
+
+	current *tar.Header
+	// pending is the header read past the current entry's streams.
+	pending *tar.Header
+	eof     bool
+}
+
+func (r *tarballReader) next() (squashEntry, error) {
+	for {
+		hdr, err := r.read()
+		if err != nil {
+			return squashEntry{}, err
+		}
+		if r.current != nil && isStreamOf(hdr, r.current) {
+			continue
+		}
+		r.current = hdr
+		break
+	}
+
+	dir, base := path.Split(strings.TrimSuffix(r.current.Name, "/"))
+	if strings.HasPrefix(base, layerfmt.WhiteoutPrefix) {
+		return squashEntry{Entry: Entry{Name: dir + strings.TrimPrefix(base, layerfmt.WhiteoutPrefix), Whiteout: true}}, nil
+	}
+	_, size, fileInfo, err := backuptar.FileInfoFromHeader(r.current)
+	if err != nil {
+		return squashEntry{}, err
+	}
+	return squashEntry{
+		Entry: Entry{Name: strings.TrimSuffix(r.current.Name, "/"), Size: size, FileInfo: fileInfo},
+		dir:   r.current.Typeflag == tar.TypeDir,
+	}, nil
+}
+
+func (r *tarballReader) read() (*tar.Header, error) {
+	if r.pending != nil {
+		hdr := r.pending
+		r.pending = nil
+		return hdr, nil
+	}
+	if r.eof {
+		return nil, io.EOF
+	}
+	return r.t.Next()
+}
+
+func (r *tarballReader) header() (*tar.Header, error) {
+	hdr := *r.current
+	return &hdr, nil
+}
+
+func (r *tarballReader) write(t *tar.Writer, filter *metadataFilter) error {
+	if err := copyTarEntry(t, filter.tarHeader(r.current), r.t); err != nil {
+		return err
+	}
+	for {
+		hdr, err := r.t.Next()
+		if err == io.EOF {
+			r.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !isStreamOf(hdr, r.current) {
+			r.pending = hdr
+			return nil
+		}
+		if filter.dropsStream(hdr, r.current) {
+			continue
+		}
+		if err := copyTarEntry(t, hdr, r.t); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *tarballReader) bytesRead() int64 {
+	return r.counter.n
+}
+
+func (r *tarballReader) close() error {
+	return r.f.Close()
+}
+
+// isStreamOf reports whether hdr is one of file's alternate data streams.
+func isStreamOf(hdr, file *tar.Header) bool {
+	return hdr.Typeflag == tar.TypeReg && strings.HasPrefix(hdr.Name, file.Name+":")
+}
+
+func copyTarEntry(t *tar.Writer, hdr *tar.Header, r io.Reader) error {
+	if err := t.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(t, r)
+	return err
+}
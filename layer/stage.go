@@ -0,0 +1,62 @@
+package layer
+
+import (
+	"errors"
+	"io"
+)
+
+// Stage is the part of an export that failed.
+type Stage string
+
+const (
+	StageSpec      Stage = "spec"
+	StageUnprepare Stage = "unprepare"
+	StageReader    Stage = "reader"
+	StageWrite     Stage = "write"
+	StageReprepare Stage = "reprepare"
+)
+
+// ExportError is returned by ExportTo and from the reader returned by Export
+// to say which stage of the export failed.
+type ExportError struct {
+	Stage Stage
+	Err   error
+}
+
+func (e *ExportError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExportError) Unwrap() error {
+	return e.Err
+}
+
+// StageOf returns the stage at which err happened, or "" if err did not come
+// from an export.
+func StageOf(err error) Stage {
+	var exportErr *ExportError
+	if errors.As(err, &exportErr) {
+		return exportErr.Stage
+	}
+	return ""
+}
+
+// withStage attributes err to stage unless an earlier stage already claimed it.
+func withStage(stage Stage, err error) error {
+	if err == nil || StageOf(err) != "" {
+		return err
+	}
+	return &ExportError{Stage: stage, Err: err}
+}
+
+// stageWriter attributes errors from the caller's writer to StageWrite, so
+// they can be told apart from errors reading the layer once tar and gzip
+// have passed them back up.
+type stageWriter struct {
+	w io.Writer
+}
+
+func (s stageWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	return n, withStage(StageWrite, err)
+}
@@ -1,71 +1,715 @@
 package main
 
 import (
+	"context"
+	"crypto"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"code.cloudfoundry.org/diff-exporter/diskusage"
 	"code.cloudfoundry.org/diff-exporter/layer"
+	"code.cloudfoundry.org/diff-exporter/manifest"
+	"code.cloudfoundry.org/diff-exporter/metrics"
+	"code.cloudfoundry.org/diff-exporter/sbom"
+	"code.cloudfoundry.org/diff-exporter/wincstate"
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// stdoutFile is the -outputFile value that streams the layer to stdout.
+	stdoutFile = "-"
+	// stdinFile is the -specFile value that reads the spec from stdin.
+	stdinFile = "-"
 )
 
 type Exporter interface {
-	Export() (io.ReadCloser, error)
+	ExportTo(ctx context.Context, w io.Writer, opts layer.Options) (layer.Result, error)
+}
+
+type config struct {
+	outputFile    string
+	containerId   string
+	bundlePath    string
+	specFile      string
+	layerFolders  stringList
+	sandboxPath   string
+	driverStore   string
+	volumesHome   string
+	fromState     bool
+	wincRoot      string
+	noClobber     bool
+	reprepare     bool
+	prune         bool
+	hardLinks     bool
+	linkIdentical bool
+	streamPolicy  metadataPolicy
+	eaPolicy      metadataPolicy
+	reparse       reparsePolicy
+	squash        bool
+	squashParents stringList
+	parentsDir    string
+	errorFormat   string
+	metricsFile   string
+	manifestFile  string
+	sbomFile      string
+
+	signingKey         string
+	signatureFile      string
+	payloadFile        string
+	signatureReference string
+
+	encryptionKeys stringList
+	descriptorFile string
+
+	splitSize byteSize
+	partsFile string
+
+	dryRun       bool
+	reportFormat string
+
+	usageFile   string
+	usageDepth  int
+	usageTop    int
+	usageFormat string
 }
 
+const usage = "USAGE: diff-exporter.exe <-outputFile outputFile | -dryRun [-reportFormat text|json]> <-containerId containerId> <-bundlePath bundlePath | -fromWincState | -specFile specFile | -layerFolders layerFolders> [-wincRoot wincRoot] [-sandboxPath sandboxPath] [-driverStore driverStore] [-volumesHome volumesHome] [-noClobber] [-reprepare] [-pruneUnchanged] [-hardLinks [-linkIdentical]] [-streamPolicy keep|drop|drop:patterns] [-eaPolicy keep|drop|drop:patterns] [-reparsePolicy preserve|symlink|dereference|skip] [-squash [-squashParents parentTarballs]] [-parentsDir parentsDir] [-errorFormat text|json] [-metricsFile metricsFile] [-manifestFile manifestFile] [-sbomFile sbomFile] [-signingKey keyFile [-signatureFile signatureFile] [-payloadFile payloadFile] [-signatureReference reference]] [-encryptionKey publicKeyFile... [-descriptorFile descriptorFile]] [-splitSize size [-partsFile partsFile]] [-usageFile usageFile [-usageDepth depth] [-usageTop count] [-usageFormat text|json]]"
+
 func main() {
-	outputFile, containerId, bundlePath, err := parseFlags()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case batchCommand:
+			runBatch(os.Args[2:])
+			return
+		case serveCommand:
+			runServe(os.Args[2:])
+			return
+		case verifySignatureCommand:
+			runVerifySignature(os.Args[2:])
+			return
+		case decryptCommand:
+			runDecrypt(os.Args[2:])
+			return
+		case joinCommand:
+			runJoin(os.Args[2:])
+			return
+		case duCommand:
+			runDu(os.Args[2:])
+			return
+		case convertCommand:
+			runConvert(os.Args[2:])
+			return
+		}
+	}
+
+	cfg, err := parseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(0)
+	}
+	reporter := errorReporter{format: cfg.errorFormat, containerId: cfg.containerId, usage: usage}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error parsing flags: %s\n", err.Error())
-		fmt.Fprintf(os.Stderr, "USAGE: diff-exporter.exe <-outputFile outputFile> <-containerId containerId> <-bundlePath bundlePath>\n")
-		os.Exit(1)
+		reporter.exit(&stageError{stage: stageFlags, err: fmt.Errorf("Error parsing flags: %w", err)})
 	}
 
-	exporter := layer.New(containerId, bundlePath)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if err := writeTgzFile(exporter, outputFile); err != nil {
-		fmt.Fprintf(os.Stderr, "Error writing tar.gz file: %s", err.Error())
-		os.Exit(1)
+	start := time.Now()
+	result, err := export(ctx, cfg)
+	if cfg.metricsFile != "" {
+		recorder := metrics.NewRecorder()
+		recorder.Record(exportMetrics(result, time.Since(start), err))
+		if merr := writeMetricsFile(cfg.metricsFile, recorder); merr != nil {
+			if err == nil {
+				reporter.exit(&stageError{stage: stageWrite, err: fmt.Errorf("Error writing metrics file: %w", merr)})
+			}
+			fmt.Fprintf(os.Stderr, "Error writing metrics file: %s\n", merr.Error())
+		}
+	}
+	if err != nil {
+		reporter.exit(err)
 	}
 }
 
-func writeTgzFile(exporter Exporter, outputFile string) error {
-	tgzStream, err := exporter.Export()
+// export exports the container's layer as configured by the flags. When it
+// fails, the result still counts what was read and written up to then, for
+// the metrics.
+func export(ctx context.Context, cfg config) (layer.Result, error) {
+	if cfg.fromState {
+		var err error
+		cfg.bundlePath, err = wincstate.BundlePath(cfg.wincRoot, cfg.containerId)
+		if err != nil {
+			return layer.Result{}, fmt.Errorf("Error looking up bundle: %w", err)
+		}
+	}
+
+	layout, err := cfg.layout()
 	if err != nil {
-		return fmt.Errorf("Error exporting layer: %s", err.Error())
+		return layer.Result{}, fmt.Errorf("Error reading spec file: %w", err)
+	}
+
+	var signingKey crypto.Signer
+	if cfg.signingKey != "" {
+		signingKey, err = loadSigningKey(cfg.signingKey)
+		if err != nil {
+			return layer.Result{}, err
+		}
 	}
-	defer tgzStream.Close()
 
-	outFd, err := os.Create(outputFile)
+	layerExporter := layer.New(cfg.containerId, cfg.bundlePath)
+	var exporter Exporter = layerExporter
+	var encrypter *encryptingExporter
+	if len(cfg.encryptionKeys) > 0 {
+		recipients, err := loadRecipients(cfg.encryptionKeys)
+		if err != nil {
+			return layer.Result{}, err
+		}
+		encrypter = &encryptingExporter{Exporter: exporter, recipients: recipients}
+		exporter = encrypter
+	}
+	opts := layer.Options{Layout: layout, Reprepare: cfg.reprepare, PruneUnchanged: cfg.prune, HardLinks: cfg.hardLinks, LinkIdentical: cfg.linkIdentical, AlternateDataStreams: layer.MetadataPolicy(cfg.streamPolicy), ExtendedAttributes: layer.MetadataPolicy(cfg.eaPolicy), Reparse: layer.ReparsePolicy(cfg.reparse), Squash: cfg.squash, ParentTarballs: cfg.squashParents}
+
+	var du *diskusage.Report
+	if cfg.usageFile != "" {
+		du = diskusage.New(diskusage.Options{Depth: cfg.usageDepth, Top: cfg.usageTop})
+		recordUsage(&opts, du)
+	}
+
+	if cfg.dryRun {
+		result, err := dryRun(ctx, layerExporter, opts, cfg.reportFormat)
+		if err == nil && du != nil {
+			err = writeUsageFile(cfg, du)
+		}
+		return result, err
+	}
+
+	var changes *manifest.Manifest
+	if cfg.manifestFile != "" {
+		changes = manifest.New()
+		recordManifest(&opts, changes)
+	}
+
+	var waitForSBOM func(error) (*sbom.Document, error)
+	if cfg.sbomFile != "" {
+		waitForSBOM = scanSBOM(&opts)
+	}
+
+	var result layer.Result
+	if cfg.splitSize > 0 {
+		result, err = writeSplitFiles(ctx, exporter, opts, cfg)
+	} else {
+		result, err = writeTgzFile(ctx, exporter, opts, cfg.outputFile, cfg.noClobber)
+	}
+	var doc *sbom.Document
+	var sbomErr error
+	if waitForSBOM != nil {
+		doc, sbomErr = waitForSBOM(err)
+	}
 	if err != nil {
-		return fmt.Errorf("Error creating output file: %s", err.Error())
+		return result, fmt.Errorf("Error writing tar.gz file: %w", err)
+	}
+	if cfg.prune {
+		fmt.Fprintf(os.Stderr, "Pruned %d unchanged files (%d bytes)\n", result.Pruned, result.PrunedBytes)
+	}
+	if result.DirectoryLinks > 0 {
+		fmt.Fprintf(os.Stderr, "Wrote %d links to directories as symlinks\n", result.DirectoryLinks)
+	}
+	if cfg.streamPolicy.dropsAny() || cfg.eaPolicy.dropsAny() {
+		fmt.Fprintf(os.Stderr, "Dropped %d alternate data streams and %d extended attributes\n", result.DroppedStreams, result.DroppedEAs)
 	}
-	defer outFd.Close()
 
-	_, err = io.Copy(outFd, tgzStream)
+	if encrypter != nil {
+		if err := writeDescriptorFile(cfg.descriptorFile, cfg.noClobber, encrypter.descriptor); err != nil {
+			return result, fmt.Errorf("Error writing descriptor file: %w", err)
+		}
+	}
+	if cfg.parentsDir != "" {
+		if err := writeParentLayers(ctx, layerExporter, opts, cfg, result); err != nil {
+			return result, err
+		}
+	}
+
+	if changes != nil {
+		if err := writeManifestFile(cfg.manifestFile, cfg.noClobber, changes, result); err != nil {
+			return result, fmt.Errorf("Error writing manifest file: %w", err)
+		}
+	}
+	if du != nil {
+		if err := writeUsageFile(cfg, du); err != nil {
+			return result, err
+		}
+	}
+	if waitForSBOM != nil {
+		if sbomErr != nil {
+			return result, fmt.Errorf("Error generating sbom: %w", sbomErr)
+		}
+		if err := writeSBOMFile(cfg.sbomFile, cfg.noClobber, doc, cfg.containerId, result); err != nil {
+			return result, fmt.Errorf("Error writing sbom file: %w", err)
+		}
+	}
+	if signingKey != nil {
+		if err := writeSignatureFiles(cfg, signingKey, result); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// writeTgzFile writes the exported layer to outputFile, or to stdout if it
+// is -. A failed export never leaves a truncated layer behind.
+func writeTgzFile(ctx context.Context, exporter Exporter, opts layer.Options, outputFile string, noClobber bool) (layer.Result, error) {
+	if outputFile == stdoutFile {
+		return writeTgzStream(ctx, exporter, opts, os.Stdout)
+	}
+
+	var result layer.Result
+	err := writeFileAtomically(outputFile, noClobber, func(w io.Writer) error {
+		var err error
+		result, err = writeTgzStream(ctx, exporter, opts, w)
+		return err
+	})
+	return result, err
+}
+
+// writeFileAtomically writes path through a temporary file next to it which
+// is only renamed into place once write has succeeded and the file has been
+// synced, so readers never see a partially written file.
+func writeFileAtomically(path string, noClobber bool, write func(io.Writer) error) error {
+	if noClobber {
+		if err := checkNotExists(path); err != nil {
+			return &stageError{stage: stageWrite, err: err}
+		}
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
 	if err != nil {
-		return fmt.Errorf("Error copying tar stream: %s", err.Error())
+		return &stageError{stage: stageWrite, err: fmt.Errorf("Error creating temporary file: %w", err)}
+	}
+	tmpFile := f.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			f.Close()
+			os.Remove(tmpFile)
+		}
+	}()
+
+	if err := write(f); err != nil {
+		return err
 	}
 
+	if err := f.Sync(); err != nil {
+		return &stageError{stage: stageWrite, err: fmt.Errorf("Error syncing file: %w", err)}
+	}
+	if err := f.Close(); err != nil {
+		return &stageError{stage: stageWrite, err: fmt.Errorf("Error closing file: %w", err)}
+	}
+
+	if err := renameFile(tmpFile, path, noClobber); err != nil {
+		return &stageError{stage: stageWrite, err: err}
+	}
+	committed = true
+
 	return nil
 }
 
-func parseFlags() (string, string, string, error) {
-	outputFile := flag.String("outputFile", "", "File to save exported layer")
-	containerId := flag.String("containerId", "", "Container ID to use")
-	bundlePath := flag.String("bundlePath", "", "Path to the root of the bundle directory to use")
-	flag.Parse()
+// writeTgzStream writes the exported layer to w. Everything else the tool
+// prints goes to stderr so w only ever receives the layer.
+func writeTgzStream(ctx context.Context, exporter Exporter, opts layer.Options, w io.Writer) (layer.Result, error) {
+	result, err := exporter.ExportTo(ctx, w, opts)
+	if err != nil {
+		return result, fmt.Errorf("Error exporting layer: %w", err)
+	}
+
+	return result, nil
+}
+
+// renameFile moves from into place at to. With noClobber the rename itself
+// fails if to exists, where os.Rename would replace it on Windows, so a file
+// created since checkNotExists looked is never overwritten.
+func renameFile(from, to string, noClobber bool) error {
+	if !noClobber {
+		if err := os.Rename(from, to); err != nil {
+			return fmt.Errorf("Error renaming file: %w", err)
+		}
+		return nil
+	}
+
+	fromPtr, err := windows.UTF16PtrFromString(from)
+	if err != nil {
+		return fmt.Errorf("Error renaming file: %w", err)
+	}
+	toPtr, err := windows.UTF16PtrFromString(to)
+	if err != nil {
+		return fmt.Errorf("Error renaming file: %w", err)
+	}
+	err = windows.MoveFileEx(fromPtr, toPtr, 0)
+	if errors.Is(err, windows.ERROR_ALREADY_EXISTS) || errors.Is(err, windows.ERROR_FILE_EXISTS) {
+		return fmt.Errorf("output file %s already exists", to)
+	}
+	if err != nil {
+		return fmt.Errorf("Error renaming file: %w", &os.LinkError{Op: "rename", Old: from, New: to, Err: err})
+	}
+	return nil
+}
 
-	if *outputFile == "" {
-		return "", "", "", errors.New("must provide output file to save exported layer")
+func checkNotExists(path string) error {
+	_, err := os.Lstat(path)
+	if err == nil {
+		return fmt.Errorf("output file %s already exists", path)
 	}
-	if *containerId == "" {
-		return "", "", "", errors.New("must provide container id to export layer from")
+	if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Error checking output file: %w", err)
 	}
-	if *bundlePath == "" {
-		return "", "", "", errors.New("must provide bundle path for container")
+	return nil
+}
+
+func parseFlags(args []string) (config, error) {
+	var cfg config
+	flags := flag.NewFlagSet("diff-exporter", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&cfg.outputFile, "outputFile", "", "File to save exported layer, or - to write it to stdout")
+	flags.StringVar(&cfg.containerId, "containerId", "", "Container ID to use")
+	flags.StringVar(&cfg.bundlePath, "bundlePath", "", "Path to the root of the bundle directory to use")
+	flags.BoolVar(&cfg.fromState, "fromWincState", false, "Look up the container's bundle in winc's state instead of passing -bundlePath")
+	flags.StringVar(&cfg.wincRoot, "wincRoot", wincstate.DefaultRoot, "winc's root directory, used with -fromWincState")
+	flags.StringVar(&cfg.specFile, "specFile", "", "Runtime spec to use instead of the bundle's config.json, or - to read it from stdin")
+	flags.Var(&cfg.layerFolders, "layerFolders", "Parent layer folders to use instead of the spec's, topmost first; may be repeated or separated by "+string(filepath.ListSeparator))
+	flags.StringVar(&cfg.sandboxPath, "sandboxPath", "", "Path to the container's sandbox layer (default <volumesHome>\\<containerId>)")
+	flags.StringVar(&cfg.driverStore, "driverStore", "", "Driver store holding the container's sandbox (default two directories above the first layer folder)")
+	flags.StringVar(&cfg.volumesHome, "volumesHome", "", "Directory holding the container's sandbox (default <driverStore>\\volumes)")
+	flags.BoolVar(&cfg.noClobber, "noClobber", false, "Refuse to overwrite an existing output file")
+	flags.BoolVar(&cfg.reprepare, "reprepare", false, "Prepare the container's layer again after exporting it so the container can keep running")
+	flags.BoolVar(&cfg.prune, "pruneUnchanged", false, "Leave out files the container rewrote without changing their content, attributes, streams or security descriptor")
+	flags.BoolVar(&cfg.hardLinks, "hardLinks", false, "Write files that are hard links to a file already in the layer as tar hard links instead of writing their content again")
+	flags.BoolVar(&cfg.linkIdentical, "linkIdentical", false, "Also write files identical to one already in the layer as hard links to it")
+	flags.Var(&cfg.streamPolicy, "streamPolicy", "Which alternate data streams to write: keep, drop, or drop: followed by name patterns separated by ;, e.g. drop:Zone.Identifier")
+	flags.Var(&cfg.eaPolicy, "eaPolicy", "Which extended attributes to write: keep, drop, or drop: followed by name patterns separated by ;")
+	flags.Var(&cfg.reparse, "reparsePolicy", "How to write symlinks and junctions: preserve, symlink to write plain tar symlinks, dereference to write the file they point to, or skip")
+	flags.BoolVar(&cfg.squash, "squash", false, "Flatten the container's diff and all of its parent layers into a single layer; only for containers run straight on a base layer, as it fails if more than one layer changes the same registry hive")
+	flags.Var(&cfg.squashParents, "squashParents", "Exported parent layer tarballs to squash with instead of the layer folders, topmost first; may be repeated or separated by "+string(filepath.ListSeparator))
+	flags.StringVar(&cfg.parentsDir, "parentsDir", "", "Directory to also export each of the container's parent layers to, along with a layers.json listing every layer in order")
+	flags.StringVar(&cfg.errorFormat, "errorFormat", errorFormatText, "How to report errors on stderr: text or json")
+	flags.StringVar(&cfg.metricsFile, "metricsFile", "", "File to save metrics about the export to in the Prometheus text format, e.g. for node_exporter's textfile collector")
+	flags.StringVar(&cfg.manifestFile, "manifestFile", "", "File to save a json manifest of the paths added, modified and deleted in the layer to, e.g. <outputFile>.manifest.json")
+	flags.StringVar(&cfg.sbomFile, "sbomFile", "", "File to save a CycloneDX json SBOM of the layer's files and detected packages to, e.g. <outputFile>.cdx.json")
+	flags.StringVar(&cfg.signingKey, "signingKey", "", "PEM encoded ed25519 or ECDSA private key to sign the layer's digest with")
+	flags.StringVar(&cfg.signatureFile, "signatureFile", "", "File to save the base64 signature to (default <outputFile>.sig)")
+	flags.StringVar(&cfg.payloadFile, "payloadFile", "", "File to save the signed simple signing payload to (default <outputFile>.payload.json)")
+	flags.StringVar(&cfg.signatureReference, "signatureReference", "", "Image reference to record as the signed payload's docker-reference")
+	flags.Var(&cfg.encryptionKeys, "encryptionKey", "PEM encoded RSA or ECDSA public key of a recipient to encrypt the layer for; may be repeated")
+	flags.StringVar(&cfg.descriptorFile, "descriptorFile", "", "File to save the encrypted layer's OCI descriptor to (default <outputFile>.descriptor.json)")
+	flags.Var(&cfg.splitSize, "splitSize", "Write the layer as numbered parts of at most this size, e.g. 4G, named <outputFile>.part0001 and so on, instead of to outputFile")
+	flags.StringVar(&cfg.partsFile, "partsFile", "", "File to save the json manifest of the layer's parts to (default <outputFile>.parts.json)")
+	flags.StringVar(&cfg.usageFile, "usageFile", "", "File to save a du-style report of the size of the layer's directories, largest files and file types to, e.g. <outputFile>.usage.json")
+	flags.IntVar(&cfg.usageDepth, "usageDepth", 0, fmt.Sprintf("Levels of directories to report in the usage file, counting the layer's Files folder as the first (default %d)", diskusage.DefaultDepth))
+	flags.IntVar(&cfg.usageTop, "usageTop", 0, fmt.Sprintf("Number of the largest files and file types to report in the usage file (default %d)", diskusage.DefaultTop))
+	flags.StringVar(&cfg.usageFormat, "usageFormat", "", "How to write the usage file: text or json (default json)")
+	flags.BoolVar(&cfg.dryRun, "dryRun", false, "Print a report of what the layer would contain to stdout instead of writing it; implies -reprepare")
+	flags.StringVar(&cfg.reportFormat, "reportFormat", "", "How to print the -dryRun report: text or json (default text)")
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
 	}
 
-	return *outputFile, *containerId, *bundlePath, nil
+	if err := checkErrorFormat(&cfg.errorFormat); err != nil {
+		return cfg, err
+	}
+	if cfg.dryRun {
+		if err := checkDryRun(&cfg); err != nil {
+			return cfg, err
+		}
+	} else if cfg.reportFormat != "" {
+		return cfg, errors.New("-reportFormat can only be used with -dryRun")
+	}
+	if cfg.outputFile == "" && !cfg.dryRun {
+		return cfg, errors.New("must provide output file to save exported layer")
+	}
+	if cfg.containerId == "" {
+		return cfg, errors.New("must provide container id to export layer from")
+	}
+	if cfg.fromState && cfg.bundlePath != "" {
+		return cfg, errors.New("cannot use both -bundlePath and -fromWincState")
+	}
+	if cfg.bundlePath == "" && !cfg.fromState && cfg.specFile == "" && len(cfg.layerFolders) == 0 {
+		return cfg, errors.New("must provide bundle path for container, or a spec file or layer folders")
+	}
+	if cfg.sandboxPath != "" && cfg.driverStore != "" {
+		return cfg, errors.New("cannot use both -sandboxPath and -driverStore")
+	}
+	if cfg.sandboxPath != "" && cfg.volumesHome != "" {
+		return cfg, errors.New("cannot use both -sandboxPath and -volumesHome")
+	}
+	if cfg.squash && cfg.prune {
+		return cfg, errors.New("cannot use both -squash and -pruneUnchanged")
+	}
+	if cfg.squash && cfg.hardLinks {
+		return cfg, errors.New("cannot use both -squash and -hardLinks")
+	}
+	if cfg.squash && cfg.reparse != reparsePolicy(layer.ReparsePreserve) {
+		return cfg, errors.New("cannot use both -squash and -reparsePolicy")
+	}
+	if cfg.squash && cfg.parentsDir != "" {
+		return cfg, errors.New("cannot use both -squash and -parentsDir")
+	}
+	if len(cfg.squashParents) > 0 && !cfg.squash {
+		return cfg, errors.New("-squashParents can only be used with -squash")
+	}
+	if cfg.linkIdentical && !cfg.hardLinks {
+		return cfg, errors.New("-linkIdentical can only be used with -hardLinks")
+	}
+	if cfg.signingKey != "" {
+		if cfg.outputFile == stdoutFile && (cfg.signatureFile == "" || cfg.payloadFile == "") {
+			return cfg, errors.New("must provide signature and payload files when signing a layer written to stdout")
+		}
+		if cfg.signatureFile == "" {
+			cfg.signatureFile = cfg.outputFile + ".sig"
+		}
+		if cfg.payloadFile == "" {
+			cfg.payloadFile = cfg.outputFile + ".payload.json"
+		}
+	}
+	if cfg.usageFile == "" && (cfg.usageDepth != 0 || cfg.usageTop != 0 || cfg.usageFormat != "") {
+		return cfg, errors.New("-usageDepth, -usageTop and -usageFormat can only be used with -usageFile")
+	}
+	if cfg.usageFile != "" {
+		if err := checkUsageOptions(cfg.usageDepth, cfg.usageTop, &cfg.usageFormat, reportFormatJSON); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.partsFile != "" && cfg.splitSize == 0 {
+		return cfg, errors.New("-partsFile can only be used with -splitSize")
+	}
+	if cfg.splitSize > 0 {
+		if cfg.outputFile == stdoutFile {
+			return cfg, errors.New("cannot split a layer written to stdout")
+		}
+		if cfg.partsFile == "" {
+			cfg.partsFile = cfg.outputFile + ".parts.json"
+		}
+	}
+	if len(cfg.encryptionKeys) > 0 {
+		if err := checkEncryption(cfg); err != nil {
+			return cfg, err
+		}
+		if cfg.outputFile == stdoutFile && cfg.descriptorFile == "" {
+			return cfg, errors.New("must provide descriptor file when encrypting a layer written to stdout")
+		}
+		if cfg.descriptorFile == "" {
+			cfg.descriptorFile = cfg.outputFile + ".descriptor.json"
+		}
+	}
+
+	return cfg, nil
+}
+
+// checkEncryption rejects the flags asking for outputs that would be
+// written in the clear alongside an encrypted layer, giving away its
+// content: the parent layers, and the files listing the layer's paths.
+func checkEncryption(cfg config) error {
+	for _, option := range []struct {
+		flag string
+		set  bool
+	}{
+		{"parentsDir", cfg.parentsDir != ""},
+		{"manifestFile", cfg.manifestFile != ""},
+		{"sbomFile", cfg.sbomFile != ""},
+		{"usageFile", cfg.usageFile != ""},
+	} {
+		if option.set {
+			return fmt.Errorf("cannot use both -encryptionKey and -%s", option.flag)
+		}
+	}
+	return nil
+}
+
+// checkDryRun rejects the flags asking for outputs a dry run doesn't write,
+// or for options that need to read the content of files.
+func checkDryRun(cfg *config) error {
+	if err := checkReportFormat(&cfg.reportFormat, reportFormatText); err != nil {
+		return err
+	}
+
+	for _, option := range []struct {
+		flag string
+		set  bool
+	}{
+		{"outputFile", cfg.outputFile != ""},
+		{"pruneUnchanged", cfg.prune},
+		{"hardLinks", cfg.hardLinks},
+		{"squash", cfg.squash},
+		{"parentsDir", cfg.parentsDir != ""},
+		{"manifestFile", cfg.manifestFile != ""},
+		{"sbomFile", cfg.sbomFile != ""},
+		{"signingKey", cfg.signingKey != ""},
+		{"encryptionKey", len(cfg.encryptionKeys) > 0},
+		{"splitSize", cfg.splitSize > 0},
+	} {
+		if option.set {
+			return fmt.Errorf("cannot use both -dryRun and -%s", option.flag)
+		}
+	}
+	return nil
+}
+
+// layout builds the layer layout from the flags that override the bundle.
+func (cfg config) layout() (layer.Layout, error) {
+	layout := layer.Layout{
+		LayerFolders: cfg.layerFolders,
+		SandboxPath:  cfg.sandboxPath,
+		DriverStore:  cfg.driverStore,
+		VolumesHome:  cfg.volumesHome,
+	}
+
+	switch cfg.specFile {
+	case "":
+	case stdinFile:
+		spec, err := layer.ReadSpec(os.Stdin)
+		if err != nil {
+			return layer.Layout{}, err
+		}
+		layout.Spec = spec
+	default:
+		f, err := os.Open(cfg.specFile)
+		if err != nil {
+			return layer.Layout{}, fmt.Errorf("%w: %w", layer.ErrConfigNotReadable, err)
+		}
+		defer f.Close()
+
+		spec, err := layer.ReadSpec(f)
+		if err != nil {
+			return layer.Layout{}, err
+		}
+		layout.Spec = spec
+	}
+
+	return layout, nil
+}
+
+// stringList is a flag that can be repeated, each value holding one or more
+// paths separated by the OS's list separator.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, string(filepath.ListSeparator))
+}
+
+func (l *stringList) Set(value string) error {
+	for _, path := range filepath.SplitList(value) {
+		if path != "" {
+			*l = append(*l, path)
+		}
+	}
+	return nil
+}
+
+// metadataPolicy is a flag holding a layer.MetadataPolicy: keep, drop, or
+// drop: followed by the name patterns to drop, separated by ;.
+type metadataPolicy layer.MetadataPolicy
+
+func (p *metadataPolicy) dropsAny() bool {
+	return p.DropAll || len(p.Drop) > 0
+}
+
+func (p *metadataPolicy) String() string {
+	switch {
+	case p.DropAll:
+		return "drop"
+	case len(p.Drop) > 0:
+		return "drop:" + strings.Join(p.Drop, ";")
+	default:
+		return "keep"
+	}
+}
+
+func (p *metadataPolicy) Set(value string) error {
+	switch {
+	case value == "keep":
+		*p = metadataPolicy{}
+	case value == "drop":
+		*p = metadataPolicy{DropAll: true}
+	case strings.HasPrefix(value, "drop:"):
+		var patterns []string
+		for _, pattern := range strings.Split(strings.TrimPrefix(value, "drop:"), ";") {
+			if pattern == "" {
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q", pattern)
+			}
+			patterns = append(patterns, pattern)
+		}
+		if len(patterns) == 0 {
+			return errors.New("must provide name patterns after drop:")
+		}
+		*p = metadataPolicy{Drop: patterns}
+	default:
+		return errors.New("must be keep, drop or drop:<patterns>")
+	}
+	return nil
+}
+
+var reparsePolicies = map[string]layer.ReparsePolicy{
+	"preserve":    layer.ReparsePreserve,
+	"symlink":     layer.ReparseSymlink,
+	"dereference": layer.ReparseDereference,
+	"skip":        layer.ReparseSkip,
+}
+
+// reparsePolicy is a flag holding a layer.ReparsePolicy by name.
+type reparsePolicy layer.ReparsePolicy
+
+func (p *reparsePolicy) String() string {
+	for name, policy := range reparsePolicies {
+		if policy == layer.ReparsePolicy(*p) {
+			return name
+		}
+	}
+	return ""
+}
+
+func (p *reparsePolicy) Set(value string) error {
+	policy, ok := reparsePolicies[value]
+	if !ok {
+		return errors.New("must be preserve, symlink, dereference or skip")
+	}
+	*p = reparsePolicy(policy)
+	return nil
+}
+
+var sizeUnits = map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+
+// byteSize is a flag holding a size in bytes, optionally followed by a K, M,
+// G or T binary unit.
+type byteSize int64
+
+func (s *byteSize) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	unit := int64(1)
+	if n := len(value); n > 0 {
+		if u, ok := sizeUnits[value[n-1]&^0x20]; ok {
+			unit = u
+			value = value[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 || size > math.MaxInt64/unit {
+		return errors.New("must be a positive size in bytes, optionally followed by K, M, G or T")
+	}
+	*s = byteSize(size * unit)
+	return nil
 }
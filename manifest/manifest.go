@@ -0,0 +1,88 @@
+package manifest
+
+import (
+	"fmt"
+
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
+)
+
+// Manifest lists every path in an exported layer and how it changed, so the
+// layer can be audited without unpacking it.
+type Manifest struct {
+	LayerDigest string  `json:"layerDigest"`
+	LayerSize   int64   `json:"layerSize"`
+	Added       int     `json:"added"`
+	Modified    int     `json:"modified"`
+	Deleted     int     `json:"deleted"`
+	Entries     []Entry `json:"entries"`
+}
+
+// Entry is a single path in the layer.
+type Entry struct {
+	Path   string          `json:"path"`
+	Change layerfmt.Change `json:"change"`
+	Size   int64           `json:"size"`
+	// Attributes are the names of the path's Win32 file attributes; see
+	// Attributes.
+	Attributes []string `json:"attributes,omitempty"`
+	// Digest is the sha256 of a regular file's content.
+	Digest string `json:"digest,omitempty"`
+	// Link is the path a hard link points to.
+	Link string `json:"link,omitempty"`
+}
+
+func New() *Manifest {
+	return &Manifest{Entries: []Entry{}}
+}
+
+// Add appends entry and counts it towards its change kind.
+func (m *Manifest) Add(entry Entry) {
+	switch entry.Change {
+	case layerfmt.ChangeAdded:
+		m.Added++
+	case layerfmt.ChangeModified:
+		m.Modified++
+	case layerfmt.ChangeDeleted:
+		m.Deleted++
+	}
+	m.Entries = append(m.Entries, entry)
+}
+
+var attributeNames = []struct {
+	bit  uint32
+	name string
+}{
+	{0x1, "readonly"},
+	{0x2, "hidden"},
+	{0x4, "system"},
+	{0x10, "directory"},
+	{0x20, "archive"},
+	{0x80, "normal"},
+	{0x100, "temporary"},
+	{0x200, "sparse"},
+	{0x400, "reparsePoint"},
+	{0x800, "compressed"},
+	{0x1000, "offline"},
+	{0x2000, "notContentIndexed"},
+	{0x4000, "encrypted"},
+	{0x8000, "integrityStream"},
+	{0x20000, "noScrubData"},
+}
+
+// Attributes names the Win32 file attributes set in attrs. Bits without a
+// name are listed in hex.
+func Attributes(attrs uint32) []string {
+	var names []string
+	for _, attribute := range attributeNames {
+		if attrs&attribute.bit != 0 {
+			names = append(names, attribute.name)
+			attrs &^= attribute.bit
+		}
+	}
+	for bit := uint32(1); bit != 0; bit <<= 1 {
+		if attrs&bit != 0 {
+			names = append(names, fmt.Sprintf("0x%x", bit))
+		}
+	}
+	return names
+}
@@ -0,0 +1,47 @@
+package manifest_test
+
+import (
+	"encoding/json"
+
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
+	"code.cloudfoundry.org/diff-exporter/manifest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Manifest", func() {
+	It("counts entries by change", func() {
+		m := manifest.New()
+		m.Add(manifest.Entry{Path: "Files/a.txt", Change: layerfmt.ChangeAdded})
+		m.Add(manifest.Entry{Path: "Files/b.txt", Change: layerfmt.ChangeAdded})
+		m.Add(manifest.Entry{Path: "Files/c.txt", Change: layerfmt.ChangeModified})
+		m.Add(manifest.Entry{Path: "Files/d.txt", Change: layerfmt.ChangeDeleted})
+
+		Expect(m.Added).To(Equal(2))
+		Expect(m.Modified).To(Equal(1))
+		Expect(m.Deleted).To(Equal(1))
+		Expect(m.Entries).To(HaveLen(4))
+		Expect(m.Entries[3].Path).To(Equal("Files/d.txt"))
+	})
+
+	It("encodes an empty layer with an empty entry list", func() {
+		encoded, err := json.Marshal(manifest.New())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(encoded)).To(ContainSubstring(`"entries":[]`))
+	})
+})
+
+var _ = Describe("Attributes", func() {
+	It("names the attributes that are set", func() {
+		Expect(manifest.Attributes(0x21)).To(Equal([]string{"readonly", "archive"}))
+		Expect(manifest.Attributes(0x10)).To(Equal([]string{"directory"}))
+	})
+
+	It("lists unknown attributes in hex", func() {
+		Expect(manifest.Attributes(0x80000 | 0x2)).To(Equal([]string{"hidden", "0x80000"}))
+	})
+
+	It("returns nothing for no attributes", func() {
+		Expect(manifest.Attributes(0)).To(BeEmpty())
+	})
+})
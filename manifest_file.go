@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+
+	"code.cloudfoundry.org/diff-exporter/layer"
+	"code.cloudfoundry.org/diff-exporter/manifest"
+)
+
+// recordManifest makes opts add every entry written to the layer to m.
+func recordManifest(opts *layer.Options, m *manifest.Manifest) {
+	opts.DigestEntries = true
+	onEntry := opts.OnEntry
+	opts.OnEntry = func(entry layer.Entry) {
+		manifestEntry := manifest.Entry{
+			Path:   entry.Name,
+			Change: entry.Change,
+			Size:   entry.Size,
+			Digest: entry.Digest,
+			Link:   entry.Link,
+		}
+		if entry.FileInfo != nil {
+			manifestEntry.Attributes = manifest.Attributes(entry.FileInfo.FileAttributes)
+		}
+		m.Add(manifestEntry)
+
+		if onEntry != nil {
+			onEntry(entry)
+		}
+	}
+}
+
+func writeManifestFile(manifestFile string, noClobber bool, m *manifest.Manifest, result layer.Result) error {
+	m.LayerDigest = result.Digest
+	m.LayerSize = result.Size
+	return writeFileAtomically(manifestFile, noClobber, func(w io.Writer) error {
+		return writeJSON(w, m)
+	})
+}
@@ -0,0 +1,206 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	namespace   = "diff_exporter"
+	contentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the export duration
+// histogram. Committing a large sandbox can take many minutes.
+var durationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800}
+
+// Export is the outcome of a single export.
+type Export struct {
+	Duration time.Duration
+	// BytesRead is read from the container's layer, BytesWritten is the
+	// compressed layer and UncompressedSize the tar stream before compression.
+	BytesRead        int64
+	BytesWritten     int64
+	UncompressedSize int64
+	Entries          int
+	Whiteouts        int
+	// PrunedFiles and PrunedBytes count the unchanged files left out of the
+	// layer.
+	PrunedFiles int
+	PrunedBytes int64
+	// LinkedFiles and LinkedBytes count the files written as hard links
+	// instead of writing their content again.
+	LinkedFiles int
+	LinkedBytes int64
+	// DroppedStreams and DroppedEAs count the alternate data streams and
+	// extended attributes left out of the layer.
+	DroppedStreams int
+	DroppedEAs     int
+	// FailedStage is the stage the export failed in, or empty if it succeeded.
+	FailedStage string
+}
+
+// Recorder accumulates exports and renders them in the Prometheus text
+// format. It is safe for concurrent use.
+type Recorder struct {
+	mu sync.Mutex
+
+	succeeded      int64
+	failures       map[string]int64
+	buckets        []int64
+	durationSum    float64
+	bytesRead      int64
+	bytesWritten   int64
+	uncompressed   int64
+	entries        int64
+	whiteouts      int64
+	prunedFiles    int64
+	prunedBytes    int64
+	linkedFiles    int64
+	linkedBytes    int64
+	droppedStreams int64
+	droppedEAs     int64
+	recorded       bool
+	last           Export
+	lastTimestamp  time.Time
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		failures: map[string]int64{},
+		buckets:  make([]int64, len(durationBuckets)),
+	}
+}
+
+// Record adds an export to the metrics.
+func (r *Recorder) Record(export Export) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if export.FailedStage == "" {
+		r.succeeded++
+	} else {
+		r.failures[export.FailedStage]++
+	}
+
+	seconds := export.Duration.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			r.buckets[i]++
+		}
+	}
+	r.durationSum += seconds
+
+	r.bytesRead += export.BytesRead
+	r.bytesWritten += export.BytesWritten
+	r.uncompressed += export.UncompressedSize
+	r.entries += int64(export.Entries)
+	r.whiteouts += int64(export.Whiteouts)
+	r.prunedFiles += int64(export.PrunedFiles)
+	r.prunedBytes += export.PrunedBytes
+	r.linkedFiles += int64(export.LinkedFiles)
+	r.linkedBytes += export.LinkedBytes
+	r.droppedStreams += int64(export.DroppedStreams)
+	r.droppedEAs += int64(export.DroppedEAs)
+
+	r.recorded = true
+	r.last = export
+	r.lastTimestamp = time.Now()
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format, which is
+// also what node_exporter's textfile collector reads.
+func (r *Recorder) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	var buf bytes.Buffer
+	r.write(&buf)
+	r.mu.Unlock()
+
+	return buf.WriteTo(w)
+}
+
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	r.WriteTo(w)
+}
+
+func (r *Recorder) write(w io.Writer) {
+	total := r.succeeded
+	for _, count := range r.failures {
+		total += count
+	}
+
+	header(w, "exports_total", "counter", "Exports by result.")
+	fmt.Fprintf(w, "%s_exports_total{result=\"success\"} %d\n", namespace, r.succeeded)
+	fmt.Fprintf(w, "%s_exports_total{result=\"failure\"} %d\n", namespace, total-r.succeeded)
+
+	header(w, "export_failures_total", "counter", "Failed exports by the stage they failed in.")
+	stages := make([]string, 0, len(r.failures))
+	for stage := range r.failures {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for _, stage := range stages {
+		fmt.Fprintf(w, "%s_export_failures_total{stage=%q} %d\n", namespace, stage, r.failures[stage])
+	}
+
+	header(w, "export_duration_seconds", "histogram", "Time taken to export a layer, including failed exports.")
+	for i, bound := range durationBuckets {
+		fmt.Fprintf(w, "%s_export_duration_seconds_bucket{le=\"%g\"} %d\n", namespace, bound, r.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_export_duration_seconds_bucket{le=\"+Inf\"} %d\n", namespace, total)
+	fmt.Fprintf(w, "%s_export_duration_seconds_sum %s\n", namespace, formatFloat(r.durationSum))
+	fmt.Fprintf(w, "%s_export_duration_seconds_count %d\n", namespace, total)
+
+	counter(w, "read_bytes_total", "Bytes read from container layers.", r.bytesRead)
+	counter(w, "written_bytes_total", "Bytes of exported layers written.", r.bytesWritten)
+	counter(w, "uncompressed_bytes_total", "Bytes of exported layers before compression.", r.uncompressed)
+	counter(w, "entries_total", "Entries written to exported layers, including whiteouts.", r.entries)
+	counter(w, "whiteouts_total", "Whiteouts written to exported layers.", r.whiteouts)
+	counter(w, "pruned_files_total", "Unchanged files left out of exported layers.", r.prunedFiles)
+	counter(w, "pruned_bytes_total", "Bytes of unchanged files left out of exported layers.", r.prunedBytes)
+	counter(w, "linked_files_total", "Files written to exported layers as hard links.", r.linkedFiles)
+	counter(w, "linked_bytes_total", "Bytes of files not written again because they were hard links.", r.linkedBytes)
+	counter(w, "dropped_streams_total", "Alternate data streams left out of exported layers.", r.droppedStreams)
+	counter(w, "dropped_eas_total", "Extended attributes left out of exported layers.", r.droppedEAs)
+
+	if !r.recorded {
+		return
+	}
+
+	success := 0
+	if r.last.FailedStage == "" {
+		success = 1
+	}
+	gauge(w, "last_export_success", "Whether the last export succeeded.", float64(success))
+	gauge(w, "last_export_timestamp_seconds", "When the last export finished, in seconds since the epoch.", float64(r.lastTimestamp.UnixNano())/float64(time.Second))
+	gauge(w, "last_export_duration_seconds", "Time taken by the last export.", r.last.Duration.Seconds())
+	if r.last.BytesWritten > 0 {
+		gauge(w, "last_export_compression_ratio", "Uncompressed size of the last exported layer divided by its written size.", float64(r.last.UncompressedSize)/float64(r.last.BytesWritten))
+	}
+}
+
+func header(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s_%s %s\n", namespace, name, help)
+	fmt.Fprintf(w, "# TYPE %s_%s %s\n", namespace, name, kind)
+}
+
+func counter(w io.Writer, name, help string, value int64) {
+	header(w, name, "counter", help)
+	fmt.Fprintf(w, "%s_%s %d\n", namespace, name, value)
+}
+
+func gauge(w io.Writer, name, help string, value float64) {
+	header(w, name, "gauge", help)
+	fmt.Fprintf(w, "%s_%s %s\n", namespace, name, formatFloat(value))
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
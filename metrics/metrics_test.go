@@ -0,0 +1,88 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/diff-exporter/metrics"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Recorder", func() {
+	var recorder *metrics.Recorder
+
+	BeforeEach(func() {
+		recorder = metrics.NewRecorder()
+	})
+
+	render := func() string {
+		var buf bytes.Buffer
+		_, err := recorder.WriteTo(&buf)
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		return buf.String()
+	}
+
+	It("reports zeroed counters before any export", func() {
+		output := render()
+		Expect(output).To(ContainSubstring("# TYPE diff_exporter_exports_total counter\n"))
+		Expect(output).To(ContainSubstring(`diff_exporter_exports_total{result="success"} 0` + "\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_export_duration_seconds_count 0\n"))
+		Expect(output).ToNot(ContainSubstring("diff_exporter_last_export"))
+	})
+
+	It("accumulates successful exports", func() {
+		recorder.Record(metrics.Export{Duration: 2 * time.Second, BytesRead: 100, BytesWritten: 10, UncompressedSize: 40, Entries: 3, Whiteouts: 1, PrunedFiles: 2, PrunedBytes: 30, LinkedFiles: 1, LinkedBytes: 7, DroppedStreams: 4, DroppedEAs: 5})
+		recorder.Record(metrics.Export{Duration: 45 * time.Second, BytesRead: 50, BytesWritten: 10, UncompressedSize: 20, Entries: 2})
+
+		output := render()
+		Expect(output).To(ContainSubstring(`diff_exporter_exports_total{result="success"} 2` + "\n"))
+		Expect(output).To(ContainSubstring(`diff_exporter_exports_total{result="failure"} 0` + "\n"))
+		Expect(output).To(ContainSubstring(`diff_exporter_export_duration_seconds_bucket{le="1"} 0` + "\n"))
+		Expect(output).To(ContainSubstring(`diff_exporter_export_duration_seconds_bucket{le="5"} 1` + "\n"))
+		Expect(output).To(ContainSubstring(`diff_exporter_export_duration_seconds_bucket{le="60"} 2` + "\n"))
+		Expect(output).To(ContainSubstring(`diff_exporter_export_duration_seconds_bucket{le="+Inf"} 2` + "\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_export_duration_seconds_sum 47\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_read_bytes_total 150\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_written_bytes_total 20\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_uncompressed_bytes_total 60\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_entries_total 5\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_whiteouts_total 1\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_pruned_files_total 2\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_pruned_bytes_total 30\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_linked_files_total 1\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_linked_bytes_total 7\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_dropped_streams_total 4\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_dropped_eas_total 5\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_last_export_success 1\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_last_export_duration_seconds 45\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_last_export_compression_ratio 2\n"))
+		Expect(output).To(MatchRegexp(`diff_exporter_last_export_timestamp_seconds \d`))
+	})
+
+	It("counts failures by stage", func() {
+		recorder.Record(metrics.Export{Duration: time.Second, FailedStage: "unprepare"})
+		recorder.Record(metrics.Export{Duration: time.Second, FailedStage: "spec"})
+		recorder.Record(metrics.Export{Duration: time.Second, FailedStage: "spec"})
+
+		output := render()
+		Expect(output).To(ContainSubstring(`diff_exporter_exports_total{result="failure"} 3` + "\n"))
+		Expect(output).To(ContainSubstring(`diff_exporter_export_failures_total{stage="spec"} 2` + "\n" +
+			`diff_exporter_export_failures_total{stage="unprepare"} 1` + "\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_export_duration_seconds_count 3\n"))
+		Expect(output).To(ContainSubstring("diff_exporter_last_export_success 0\n"))
+		Expect(output).ToNot(ContainSubstring("diff_exporter_last_export_compression_ratio"))
+	})
+
+	It("serves the metrics over HTTP", func() {
+		recorder.Record(metrics.Export{Duration: time.Second})
+
+		rec := httptest.NewRecorder()
+		recorder.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+		Expect(rec.Code).To(Equal(200))
+		Expect(rec.Header().Get("Content-Type")).To(HavePrefix("text/plain; version=0.0.4"))
+		Expect(rec.Body.String()).To(Equal(render()))
+	})
+})
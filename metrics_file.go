@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"code.cloudfoundry.org/diff-exporter/layer"
+	"code.cloudfoundry.org/diff-exporter/metrics"
+)
+
+// exportMetrics describes an export for the metrics, labelling failures with
+// the same stage as -errorFormat json.
+func exportMetrics(result layer.Result, duration time.Duration, err error) metrics.Export {
+	export := metrics.Export{
+		Duration:         duration,
+		BytesRead:        result.BytesRead,
+		BytesWritten:     result.Size,
+		UncompressedSize: result.UncompressedSize,
+		Entries:          result.Entries,
+		Whiteouts:        result.Whiteouts,
+		PrunedFiles:      result.Pruned,
+		PrunedBytes:      result.PrunedBytes,
+		LinkedFiles:      result.Links,
+		LinkedBytes:      result.LinkedBytes,
+		DroppedStreams:   result.DroppedStreams,
+		DroppedEAs:       result.DroppedEAs,
+	}
+	if err != nil {
+		_, stage := classify(err)
+		export.FailedStage = string(stage)
+	}
+	return export
+}
+
+// writeMetricsFile replaces metricsFile atomically, as the textfile
+// collector may read it at any time.
+func writeMetricsFile(metricsFile string, recorder *metrics.Recorder) error {
+	return writeFileAtomically(metricsFile, false, func(w io.Writer) error {
+		_, err := recorder.WriteTo(w)
+		return err
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/diff-exporter/encryption"
+	"code.cloudfoundry.org/diff-exporter/layer"
+)
+
+const (
+	layerMediaType     = "application/vnd.oci.image.layer.v1.tar+gzip"
+	layersManifestFile = "layers.json"
+)
+
+// layersManifest lists the layers needed to rebuild the container's image.
+type layersManifest struct {
+	// Layers are in the order an image applies them: base first, ending with
+	// the container's diff.
+	Layers []layerBlob `json:"layers"`
+}
+
+type layerBlob struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	// File is where the layer was written; it is empty for a diff written to
+	// stdout, and the parts file for a diff split into parts.
+	File string `json:"file,omitempty"`
+	// LayerFolder is the parent layer's folder in the driver store; it is
+	// empty for the container's diff.
+	LayerFolder string `json:"layerFolder,omitempty"`
+}
+
+// writeParentLayers exports each of the container's parent layers to
+// parentsDir, named after its layer folder, and writes layers.json listing
+// them along with the container's diff.
+func writeParentLayers(ctx context.Context, exporter *layer.Exporter, opts layer.Options, cfg config, diff layer.Result) error {
+	layerFolders, err := exporter.ParentLayers(opts.Layout)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.parentsDir, 0755); err != nil {
+		return &stageError{stage: stageWrite, err: fmt.Errorf("Error creating parents directory: %w", err)}
+	}
+
+	var manifest layersManifest
+	for i := len(layerFolders) - 1; i >= 0; i-- {
+		file := filepath.Join(cfg.parentsDir, filepath.Base(layerFolders[i])+".tgz")
+		var result layer.Result
+		err := writeFileAtomically(file, cfg.noClobber, func(w io.Writer) error {
+			var err error
+			result, err = exporter.ExportParentTo(ctx, w, i, layer.Options{Layout: opts.Layout})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Error exporting parent layer %s: %w", layerFolders[i], err)
+		}
+		manifest.Layers = append(manifest.Layers, layerBlob{
+			MediaType:   layerMediaType,
+			Digest:      result.Digest,
+			Size:        result.Size,
+			File:        file,
+			LayerFolder: layerFolders[i],
+		})
+	}
+
+	blob := layerBlob{MediaType: layerMediaType, Digest: diff.Digest, Size: diff.Size}
+	if len(cfg.encryptionKeys) > 0 {
+		blob.MediaType = encryption.MediaType
+	}
+	switch {
+	case cfg.splitSize > 0:
+		blob.File = cfg.partsFile
+	case cfg.outputFile != stdoutFile:
+		blob.File = cfg.outputFile
+	}
+	manifest.Layers = append(manifest.Layers, blob)
+
+	return writeFileAtomically(filepath.Join(cfg.parentsDir, layersManifestFile), cfg.noClobber, func(w io.Writer) error {
+		return writeJSON(w, manifest)
+	})
+}
@@ -0,0 +1,159 @@
+// Package posix rewrites layers exported by backuptar as plain POSIX tars,
+// for tools other than Windows to scan and diff.
+package posix
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
+)
+
+const (
+	fileAttributesRecord = "MSWINDOWS.fileattr"
+	readOnlyAttribute    = 0x1
+)
+
+// Result counts what Convert wrote and left out.
+type Result struct {
+	// Entries is the number of entries written.
+	Entries int
+	// Skipped is the number of entries outside the layer's Files folder, or
+	// linking outside it, that were left out.
+	Skipped int
+	// Streams is the number of alternate data streams left out.
+	Streams int
+}
+
+// Convert writes the layer read from r to w as a plain POSIX tar. Paths lose
+// the Files/ prefix, file attributes become mode bits, and the MSWINDOWS PAX
+// records, security descriptors included, are dropped. A gzipped layer is
+// written gzipped.
+func Convert(w io.Writer, r io.Reader) (Result, error) {
+	var result Result
+
+	input, gzipped, err := layerfmt.Decompress(r)
+	if err != nil {
+		return result, err
+	}
+	var compressed *gzip.Writer
+	if gzipped {
+		compressed = gzip.NewWriter(w)
+		w = compressed
+	}
+
+	tr := tar.NewReader(input)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+
+		name, ok := stripRoot(hdr.Name)
+		if !ok {
+			result.Skipped++
+			continue
+		}
+		if strings.Contains(path.Base(name), ":") {
+			// Windows file names can't hold a colon, so this is an
+			// alternate data stream written as an entry of its own.
+			result.Streams++
+			continue
+		}
+
+		converted, ok := convertHeader(hdr, name)
+		if !ok {
+			result.Skipped++
+			continue
+		}
+		if err := tw.WriteHeader(converted); err != nil {
+			return result, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return result, err
+		}
+		result.Entries++
+	}
+
+	if err := tw.Close(); err != nil {
+		return result, err
+	}
+	if compressed != nil {
+		return result, compressed.Close()
+	}
+	return result, nil
+}
+
+// stripRoot returns name relative to the layer's Files folder, or false if
+// it is the folder itself or outside it.
+func stripRoot(name string) (string, bool) {
+	name = strings.TrimSuffix(name, "/")
+	rel, ok := strings.CutPrefix(name, layerfmt.Root+"/")
+	return rel, ok && rel != ""
+}
+
+// convertHeader builds a header from scratch for the entry hdr named name,
+// keeping only what POSIX tools understand. It returns false for links that
+// can't be expressed inside the converted layer.
+func convertHeader(hdr *tar.Header, name string) (*tar.Header, bool) {
+	converted := &tar.Header{
+		Typeflag: hdr.Typeflag,
+		Name:     name,
+		Size:     hdr.Size,
+		ModTime:  hdr.ModTime,
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		converted.Name += "/"
+		converted.Mode = 0755
+	case tar.TypeSymlink:
+		linkname, ok := symlinkTarget(name, hdr.Linkname)
+		if !ok {
+			return nil, false
+		}
+		converted.Linkname = linkname
+		converted.Mode = 0777
+	case tar.TypeLink:
+		linkname, ok := stripRoot(hdr.Linkname)
+		if !ok {
+			return nil, false
+		}
+		converted.Linkname = linkname
+		converted.Mode = fileMode(hdr)
+	default:
+		converted.Mode = fileMode(hdr)
+	}
+	return converted, true
+}
+
+// fileMode maps a file's read-only attribute to its write bits. Windows has
+// no executable bit, so none is set.
+func fileMode(hdr *tar.Header) int64 {
+	attributes, err := strconv.ParseUint(hdr.PAXRecords[fileAttributesRecord], 10, 32)
+	if err == nil && attributes&readOnlyAttribute != 0 {
+		return 0444
+	}
+	return 0644
+}
+
+// symlinkTarget returns where the symlink name, relative to the layer's
+// Files folder, points to relative to it. It returns false for targets
+// outside the container's system drive, including relative targets climbing
+// above its root.
+func symlinkTarget(name, target string) (string, bool) {
+	link := layerfmt.Root + "/" + name
+	resolved, ok := layerfmt.ResolveLink(link, target)
+	if !ok {
+		return "", false
+	}
+	return layerfmt.RelativeLink(link, resolved), true
+}
@@ -0,0 +1,13 @@
+package posix_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestPosix(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Posix Suite")
+}
@@ -0,0 +1,238 @@
+package posix_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"time"
+
+	"code.cloudfoundry.org/diff-exporter/posix"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var modTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+type entry struct {
+	hdr  *tar.Header
+	data string
+}
+
+func windowsHeader(typeflag byte, name string, attributes string) *tar.Header {
+	return &tar.Header{
+		Typeflag: typeflag,
+		Name:     name,
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+		PAXRecords: map[string]string{
+			"MSWINDOWS.fileattr":        attributes,
+			"MSWINDOWS.rawsd":           "AQAEgBQAAAAkAAAAAAAAADAAAAA=",
+			"MSWINDOWS.xattr.$KERNEL":   "AQ==",
+			"LIBARCHIVE.creationtime":   "1709294400",
+			"MSWINDOWS.accesstime_unix": "1709294400",
+		},
+	}
+}
+
+func file(name, data, attributes string) entry {
+	hdr := windowsHeader(tar.TypeReg, name, attributes)
+	hdr.Size = int64(len(data))
+	return entry{hdr: hdr, data: data}
+}
+
+func dir(name string) entry {
+	return entry{hdr: windowsHeader(tar.TypeDir, name, "16")}
+}
+
+func symlink(name, target string) entry {
+	hdr := windowsHeader(tar.TypeSymlink, name, "1056")
+	hdr.Linkname = target
+	return entry{hdr: hdr}
+}
+
+func layerTar(entries ...entry) []byte {
+	var buf bytes.Buffer
+	t := tar.NewWriter(&buf)
+	for _, e := range entries {
+		ExpectWithOffset(1, t.WriteHeader(e.hdr)).To(Succeed())
+		_, err := t.Write([]byte(e.data))
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	}
+	ExpectWithOffset(1, t.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+func readTar(r io.Reader) ([]*tar.Header, map[string]string) {
+	var headers []*tar.Header
+	contents := map[string]string{}
+	t := tar.NewReader(r)
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			return headers, contents
+		}
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		data, err := io.ReadAll(t)
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		headers = append(headers, hdr)
+		contents[hdr.Name] = string(data)
+	}
+}
+
+func names(headers []*tar.Header) []string {
+	var names []string
+	for _, hdr := range headers {
+		names = append(names, hdr.Name)
+	}
+	return names
+}
+
+var _ = Describe("Convert", func() {
+	var output bytes.Buffer
+
+	BeforeEach(func() {
+		output.Reset()
+	})
+
+	It("writes the contents of Files at the root of the tar", func() {
+		result, err := posix.Convert(&output, bytes.NewReader(layerTar(
+			dir("Files"),
+			dir("Files/Windows"),
+			file("Files/Windows/win.ini", "some ini", "32"),
+			file("Hives/SOFTWARE_BASE", "some hive", "32"),
+			dir("UtilityVM"),
+		)))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal(posix.Result{Entries: 2, Skipped: 3}))
+
+		headers, contents := readTar(&output)
+		Expect(names(headers)).To(Equal([]string{"Windows/", "Windows/win.ini"}))
+		Expect(contents).To(HaveKeyWithValue("Windows/win.ini", "some ini"))
+	})
+
+	It("drops the Windows PAX records", func() {
+		_, err := posix.Convert(&output, bytes.NewReader(layerTar(
+			file("Files/app.exe", "some exe", "32"),
+		)))
+		Expect(err).ToNot(HaveOccurred())
+
+		headers, _ := readTar(&output)
+		Expect(headers).To(HaveLen(1))
+		Expect(headers[0].PAXRecords).To(BeEmpty())
+		Expect(headers[0].Format).To(Equal(tar.FormatUSTAR))
+		Expect(headers[0].ModTime).To(Equal(modTime.Local()))
+		Expect(headers[0].Uid).To(Equal(0))
+	})
+
+	It("maps file attributes to mode bits", func() {
+		_, err := posix.Convert(&output, bytes.NewReader(layerTar(
+			dir("Files/dir"),
+			file("Files/dir/writable", "data", "32"),
+			file("Files/dir/readonly", "data", "33"),
+			symlink("Files/dir/link", "writable"),
+		)))
+		Expect(err).ToNot(HaveOccurred())
+
+		headers, _ := readTar(&output)
+		modes := map[string]int64{}
+		for _, hdr := range headers {
+			modes[hdr.Name] = hdr.Mode
+		}
+		Expect(modes).To(Equal(map[string]int64{
+			"dir/":         0755,
+			"dir/writable": 0644,
+			"dir/readonly": 0444,
+			"dir/link":     0777,
+		}))
+	})
+
+	It("leaves out alternate data streams", func() {
+		result, err := posix.Convert(&output, bytes.NewReader(layerTar(
+			file("Files/setup.exe", "some exe", "32"),
+			file("Files/setup.exe:Zone.Identifier", "[ZoneTransfer]", "0"),
+		)))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal(posix.Result{Entries: 1, Streams: 1}))
+
+		headers, _ := readTar(&output)
+		Expect(names(headers)).To(Equal([]string{"setup.exe"}))
+	})
+
+	It("keeps whiteouts", func() {
+		_, err := posix.Convert(&output, bytes.NewReader(layerTar(
+			file("Files/dir/.wh.deleted", "", "0"),
+		)))
+		Expect(err).ToNot(HaveOccurred())
+
+		headers, _ := readTar(&output)
+		Expect(names(headers)).To(Equal([]string{"dir/.wh.deleted"}))
+	})
+
+	It("strips the prefix from hard links", func() {
+		link := windowsHeader(tar.TypeLink, "Files/copy.dll", "32")
+		link.Linkname = "Files/original.dll"
+		_, err := posix.Convert(&output, bytes.NewReader(layerTar(
+			file("Files/original.dll", "some dll", "32"),
+			entry{hdr: link},
+		)))
+		Expect(err).ToNot(HaveOccurred())
+
+		headers, contents := readTar(&output)
+		Expect(headers).To(HaveLen(2))
+		Expect(headers[1].Typeflag).To(BeEquivalentTo(tar.TypeLink))
+		Expect(headers[1].Linkname).To(Equal("original.dll"))
+		Expect(contents).To(HaveKeyWithValue("original.dll", "some dll"))
+	})
+
+	DescribeTable("translates symlink targets",
+		func(target, linkname string) {
+			_, err := posix.Convert(&output, bytes.NewReader(layerTar(
+				symlink("Files/Program Files/app/link", target),
+			)))
+			Expect(err).ToNot(HaveOccurred())
+
+			headers, _ := readTar(&output)
+			Expect(headers).To(HaveLen(1))
+			Expect(headers[0].Linkname).To(Equal(linkname))
+		},
+		Entry("an NT path", `\??\C:\Windows\System32`, "../../Windows/System32"),
+		Entry("a drive path", `c:\Program Files\app\bin`, "bin"),
+		Entry("a rooted path", `\Windows`, "../../Windows"),
+		Entry("a relative Windows path", `..\other\bin`, "../other/bin"),
+		Entry("a relative POSIX path", "../other/bin", "../other/bin"),
+		Entry("a relative path in the same directory", "bin", "bin"),
+		Entry("a rooted POSIX path", "/Windows", "../../Windows"),
+	)
+
+	DescribeTable("leaves out symlinks outside the system drive",
+		func(target string) {
+			result, err := posix.Convert(&output, bytes.NewReader(layerTar(
+				symlink("Files/link", target),
+			)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result).To(Equal(posix.Result{Skipped: 1}))
+		},
+		Entry("another drive", `\??\D:\data`),
+		Entry("a UNC path", `\\server\share`),
+		Entry("a volume", `\??\Volume{0b2cf4f6-1f6c-4e3a-9b5f-3c7e7a1f1c2d}\`),
+		Entry("a relative Windows path above the root", `..\..\..\..\etc`),
+		Entry("a relative POSIX path above the root", "../etc"),
+	)
+
+	It("writes a gzipped layer gzipped", func() {
+		var compressed bytes.Buffer
+		g := gzip.NewWriter(&compressed)
+		_, err := g.Write(layerTar(file("Files/a.txt", "some text", "32")))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(g.Close()).To(Succeed())
+
+		_, err = posix.Convert(&output, &compressed)
+		Expect(err).ToNot(HaveOccurred())
+
+		r, err := gzip.NewReader(&output)
+		Expect(err).ToNot(HaveOccurred())
+		_, contents := readTar(r)
+		Expect(contents).To(Equal(map[string]string{"a.txt": "some text"}))
+	})
+})
@@ -0,0 +1,213 @@
+package sbom
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+const (
+	rtVersion          = 16
+	fixedInfoSignature = 0xfeef04bd
+	fixedInfoSize      = 52
+	versionBlockHeader = 6
+	// maxResourceDepth is how many directories may lie below a resource's
+	// type: its name and its language.
+	maxResourceDepth = 2
+)
+
+var errMalformedResource = errors.New("malformed version resource")
+
+// versionInfo is what an image's version resource says about it.
+type versionInfo struct {
+	// strings are the first string table's values, such as ProductName.
+	strings        map[string]string
+	fileVersion    string
+	productVersion string
+}
+
+// readVersionInfo reads the version resource of a PE image. It returns nil
+// if the image has none.
+func readVersionInfo(image []byte) (*versionInfo, error) {
+	f, err := pe.NewFile(bytes.NewReader(image))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	section := f.Section(".rsrc")
+	if section == nil {
+		return nil, nil
+	}
+	rsrc, err := section.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := versionResource(rsrc, section.VirtualAddress)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	root, _, err := parseVersionBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	return newVersionInfo(root), nil
+}
+
+// versionResource finds the first RT_VERSION resource in a resource section
+// loaded at virtualAddress.
+func versionResource(rsrc []byte, virtualAddress uint32) ([]byte, error) {
+	offset, isDir, found, err := resourceEntry(rsrc, 0, rtVersion)
+	if err != nil || !found {
+		return nil, err
+	}
+	// Below the type are the resource's name and then its language; any
+	// will do.
+	for depth := 0; isDir; depth++ {
+		if depth >= maxResourceDepth {
+			return nil, errMalformedResource
+		}
+		offset, isDir, found, err = resourceEntry(rsrc, offset, -1)
+		if err != nil || !found {
+			return nil, err
+		}
+	}
+
+	if int(offset)+16 > len(rsrc) {
+		return nil, errMalformedResource
+	}
+	rva := binary.LittleEndian.Uint32(rsrc[offset:])
+	size := binary.LittleEndian.Uint32(rsrc[offset+4:])
+	start := int64(rva) - int64(virtualAddress)
+	if start < 0 || start+int64(size) > int64(len(rsrc)) {
+		return nil, errMalformedResource
+	}
+	return rsrc[start : start+int64(size)], nil
+}
+
+// resourceEntry looks up id, or the first entry if id is negative, in the
+// resource directory at offset. It returns the offset of the subdirectory
+// or data entry the entry points at.
+func resourceEntry(rsrc []byte, offset uint32, id int) (uint32, bool, bool, error) {
+	if int(offset)+16 > len(rsrc) {
+		return 0, false, false, errMalformedResource
+	}
+	named := binary.LittleEndian.Uint16(rsrc[offset+12:])
+	ids := binary.LittleEndian.Uint16(rsrc[offset+14:])
+
+	entries := rsrc[offset+16:]
+	count := int(named) + int(ids)
+	if count*8 > len(entries) {
+		return 0, false, false, errMalformedResource
+	}
+	for i := 0; i < count; i++ {
+		name := binary.LittleEndian.Uint32(entries[i*8:])
+		target := binary.LittleEndian.Uint32(entries[i*8+4:])
+		if id < 0 || (name&0x80000000 == 0 && name == uint32(id)) {
+			return target &^ 0x80000000, target&0x80000000 != 0, true, nil
+		}
+	}
+	return 0, false, false, nil
+}
+
+// versionBlock is one of the nested VS_VERSIONINFO, StringFileInfo,
+// StringTable, String, VarFileInfo and Var structures.
+type versionBlock struct {
+	key      string
+	value    []byte
+	text     bool
+	children []versionBlock
+}
+
+func parseVersionBlock(data []byte) (versionBlock, int, error) {
+	if len(data) < versionBlockHeader {
+		return versionBlock{}, 0, errMalformedResource
+	}
+	length := int(binary.LittleEndian.Uint16(data))
+	if length < versionBlockHeader || length > len(data) {
+		return versionBlock{}, 0, errMalformedResource
+	}
+	data = data[:length]
+	valueLength := int(binary.LittleEndian.Uint16(data[2:]))
+	block := versionBlock{text: binary.LittleEndian.Uint16(data[4:]) == 1}
+
+	key, pos := readUTF16(data, versionBlockHeader)
+	block.key = key
+	pos = align4(pos)
+
+	// Text values are measured in characters rather than bytes.
+	if block.text {
+		valueLength *= 2
+	}
+	if pos+valueLength > length {
+		valueLength = max(length-pos, 0)
+	}
+	if pos < length {
+		block.value = data[pos : pos+valueLength]
+	}
+	pos = align4(pos + valueLength)
+
+	for pos+versionBlockHeader <= length {
+		child, n, err := parseVersionBlock(data[pos:])
+		if err != nil {
+			return versionBlock{}, 0, err
+		}
+		block.children = append(block.children, child)
+		pos = align4(pos + n)
+	}
+	return block, length, nil
+}
+
+func newVersionInfo(root versionBlock) *versionInfo {
+	info := &versionInfo{strings: map[string]string{}}
+
+	if len(root.value) >= fixedInfoSize && binary.LittleEndian.Uint32(root.value) == fixedInfoSignature {
+		info.fileVersion = fixedVersion(root.value[8:])
+		info.productVersion = fixedVersion(root.value[16:])
+	}
+
+	for _, child := range root.children {
+		if child.key != "StringFileInfo" {
+			continue
+		}
+		for _, table := range child.children {
+			for _, s := range table.children {
+				if _, ok := info.strings[s.key]; !ok {
+					info.strings[s.key], _ = readUTF16(s.value, 0)
+				}
+			}
+		}
+	}
+	return info
+}
+
+// fixedVersion formats a version held as two DWORDs, most significant first.
+func fixedVersion(b []byte) string {
+	ms := binary.LittleEndian.Uint32(b)
+	ls := binary.LittleEndian.Uint32(b[4:])
+	return fmt.Sprintf("%d.%d.%d.%d", ms>>16, ms&0xffff, ls>>16, ls&0xffff)
+}
+
+// readUTF16 reads a NUL terminated UTF-16 string at offset, returning it and
+// the offset just past its terminator.
+func readUTF16(data []byte, offset int) (string, int) {
+	var chars []uint16
+	for offset+2 <= len(data) {
+		c := binary.LittleEndian.Uint16(data[offset:])
+		offset += 2
+		if c == 0 {
+			break
+		}
+		chars = append(chars, c)
+	}
+	return string(utf16.Decode(chars)), offset
+}
+
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,241 @@
+package sbom
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	hiveBinsOffset = 4096
+	// maxListDepth bounds how deeply index roots may nest subkey lists.
+	maxListDepth = 2
+
+	keyCompressedName   = 0x20
+	valueCompressedName = 0x1
+	regSZ               = 1
+	regExpandSZ         = 2
+)
+
+var (
+	errKeyNotFound = errors.New("registry key not found")
+	errInvalidHive = errors.New("invalid registry hive")
+)
+
+// hive reads keys and string values from a registry hive file. It only
+// supports what is needed to list installed programs.
+type hive struct {
+	bins []byte
+	root uint32
+}
+
+type registryKey struct {
+	name   string
+	offset uint32
+}
+
+func openHive(data []byte) (*hive, error) {
+	if len(data) < hiveBinsOffset || string(data[:4]) != "regf" {
+		return nil, errInvalidHive
+	}
+	h := &hive{bins: data[hiveBinsOffset:], root: binary.LittleEndian.Uint32(data[0x24:])}
+	if _, err := h.key(h.root); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// open finds the key at a backslash separated path below the hive's root.
+func (h *hive) open(path string) (registryKey, error) {
+	current, err := h.key(h.root)
+	if err != nil {
+		return registryKey{}, err
+	}
+
+	for _, name := range strings.Split(path, `\`) {
+		subkeys, err := h.subkeys(current)
+		if err != nil {
+			return registryKey{}, err
+		}
+		found := false
+		for _, subkey := range subkeys {
+			if strings.EqualFold(subkey.name, name) {
+				current, found = subkey, true
+				break
+			}
+		}
+		if !found {
+			return registryKey{}, fmt.Errorf("%w: %s", errKeyNotFound, path)
+		}
+	}
+	return current, nil
+}
+
+func (h *hive) subkeys(k registryKey) ([]registryKey, error) {
+	nk, err := h.cell(k.offset, "nk")
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(nk[0x14:]) == 0 {
+		return nil, nil
+	}
+	return h.subkeyList(binary.LittleEndian.Uint32(nk[0x1c:]), 0)
+}
+
+func (h *hive) subkeyList(offset uint32, depth int) ([]registryKey, error) {
+	list, err := h.cell(offset, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(list) < 4 {
+		return nil, errInvalidHive
+	}
+
+	signature := string(list[:2])
+	count := int(binary.LittleEndian.Uint16(list[2:]))
+	stride := 4
+	switch signature {
+	case "lf", "lh":
+		// Each offset is followed by a hash of the key's name.
+		stride = 8
+	case "li":
+	case "ri":
+		if depth >= maxListDepth {
+			return nil, errInvalidHive
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown subkey list %q", errInvalidHive, signature)
+	}
+	if 4+count*stride > len(list) {
+		return nil, errInvalidHive
+	}
+
+	var keys []registryKey
+	for i := 0; i < count; i++ {
+		offset := binary.LittleEndian.Uint32(list[4+i*stride:])
+		if signature == "ri" {
+			subkeys, err := h.subkeyList(offset, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, subkeys...)
+			continue
+		}
+		k, err := h.key(offset)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (h *hive) key(offset uint32) (registryKey, error) {
+	nk, err := h.cell(offset, "nk")
+	if err != nil {
+		return registryKey{}, err
+	}
+	if len(nk) < 0x4c {
+		return registryKey{}, errInvalidHive
+	}
+	flags := binary.LittleEndian.Uint16(nk[2:])
+	nameLength := int(binary.LittleEndian.Uint16(nk[0x48:]))
+	if 0x4c+nameLength > len(nk) {
+		return registryKey{}, errInvalidHive
+	}
+	return registryKey{name: decodeName(nk[0x4c:0x4c+nameLength], flags&keyCompressedName != 0), offset: offset}, nil
+}
+
+// stringValues returns a key's REG_SZ and REG_EXPAND_SZ values by name.
+func (h *hive) stringValues(k registryKey) (map[string]string, error) {
+	nk, err := h.cell(k.offset, "nk")
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	count := int(binary.LittleEndian.Uint32(nk[0x24:]))
+	if count == 0 {
+		return values, nil
+	}
+
+	list, err := h.cell(binary.LittleEndian.Uint32(nk[0x28:]), "")
+	if err != nil {
+		return nil, err
+	}
+	if count*4 > len(list) {
+		return nil, errInvalidHive
+	}
+	for i := 0; i < count; i++ {
+		vk, err := h.cell(binary.LittleEndian.Uint32(list[i*4:]), "vk")
+		if err != nil {
+			return nil, err
+		}
+		if len(vk) < 0x14 {
+			return nil, errInvalidHive
+		}
+		nameLength := int(binary.LittleEndian.Uint16(vk[2:]))
+		size := binary.LittleEndian.Uint32(vk[4:])
+		dataOffset := binary.LittleEndian.Uint32(vk[8:])
+		valueType := binary.LittleEndian.Uint32(vk[0x0c:])
+		flags := binary.LittleEndian.Uint16(vk[0x10:])
+		if 0x14+nameLength > len(vk) {
+			return nil, errInvalidHive
+		}
+		if valueType != regSZ && valueType != regExpandSZ {
+			continue
+		}
+
+		var data []byte
+		if size&0x80000000 != 0 {
+			// Data of up to four bytes is stored in place of its offset.
+			data = vk[8 : 8+min(size&^0x80000000, 4)]
+		} else {
+			cell, err := h.cell(dataOffset, "")
+			if err != nil {
+				return nil, err
+			}
+			// Larger values are split into big data blocks, which no
+			// program's name or version needs.
+			if int(size) > len(cell) {
+				continue
+			}
+			data = cell[:size]
+		}
+
+		name := decodeName(vk[0x14:0x14+nameLength], flags&valueCompressedName != 0)
+		values[name], _ = readUTF16(data, 0)
+	}
+	return values, nil
+}
+
+// cell returns the content of the allocated cell at offset, checking that it
+// starts with signature.
+func (h *hive) cell(offset uint32, signature string) ([]byte, error) {
+	if int64(offset)+4 > int64(len(h.bins)) {
+		return nil, errInvalidHive
+	}
+	size := int32(binary.LittleEndian.Uint32(h.bins[offset:]))
+	// Allocated cells have a negative size.
+	if size >= 0 || int64(offset)+int64(-size) > int64(len(h.bins)) || -size < 4 {
+		return nil, errInvalidHive
+	}
+	data := h.bins[offset+4 : offset+uint32(-size)]
+	if signature != "" && (len(data) < 2 || string(data[:2]) != signature) {
+		return nil, fmt.Errorf("%w: expected %s cell", errInvalidHive, signature)
+	}
+	return data, nil
+}
+
+// decodeName decodes a key or value name, which is either Latin-1 or UTF-16.
+func decodeName(b []byte, compressed bool) string {
+	if !compressed {
+		name, _ := readUTF16(b, 0)
+		return name
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
@@ -0,0 +1,308 @@
+package sbom
+
+import (
+	"archive/tar"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
+)
+
+const (
+	bomFormat   = "CycloneDX"
+	specVersion = "1.5"
+
+	// maxImageSize and maxHiveSize bound how much of an executable or a
+	// registry hive is held in memory to look for package metadata. Larger
+	// files are still listed, just not inspected.
+	maxImageSize = 64 << 20
+	maxHiveSize  = 256 << 20
+
+	softwareHive   = "Hives/Software_Delta"
+	installerCache = layerfmt.Root + "/Windows/Installer/"
+)
+
+// Document is a CycloneDX bill of materials in its json encoding.
+type Document struct {
+	BOMFormat    string      `json:"bomFormat"`
+	SpecVersion  string      `json:"specVersion"`
+	SerialNumber string      `json:"serialNumber"`
+	Version      int         `json:"version"`
+	Metadata     Metadata    `json:"metadata"`
+	Components   []Component `json:"components"`
+}
+
+type Metadata struct {
+	Timestamp string `json:"timestamp"`
+	Tools     Tools  `json:"tools"`
+	// Component is what the document describes, i.e. the exported layer.
+	Component *Component `json:"component,omitempty"`
+}
+
+type Tools struct {
+	Components []Component `json:"components"`
+}
+
+type Component struct {
+	Type       string     `json:"type"`
+	BOMRef     string     `json:"bom-ref,omitempty"`
+	Name       string     `json:"name"`
+	Version    string     `json:"version,omitempty"`
+	Publisher  string     `json:"publisher,omitempty"`
+	Hashes     []Hash     `json:"hashes,omitempty"`
+	Properties []Property `json:"properties,omitempty"`
+}
+
+type Hash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type Property struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Property names used for metadata CycloneDX has no field for.
+const (
+	PropertyPath        = "diff-exporter:path"
+	PropertySize        = "diff-exporter:size"
+	PropertySource      = "diff-exporter:source"
+	PropertyFileVersion = "diff-exporter:fileVersion"
+	PropertyRegistryKey = "diff-exporter:registryKey"
+)
+
+// Sources of detected packages.
+const (
+	SourceVersionResource = "versionResource"
+	SourceInstallerCache  = "installerCache"
+	SourceUninstallKey    = "uninstallKey"
+)
+
+// Scan reads an uncompressed layer tar stream, as written by the layer
+// package, and lists the files it adds or modifies along with the packages
+// it can find: executables and libraries with version resources, Windows
+// Installer packages cached by msiexec and programs registered for
+// uninstall in the layer's software hive.
+func Scan(r io.Reader) (*Document, error) {
+	doc := &Document{
+		BOMFormat:    bomFormat,
+		SpecVersion:  specVersion,
+		SerialNumber: serialNumber(),
+		Version:      1,
+		Metadata: Metadata{
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Tools:     Tools{Components: []Component{{Type: "application", Name: "diff-exporter"}}},
+		},
+		Components: []Component{},
+	}
+
+	var packages []Component
+	// files holds each file's component, for the hard links to it.
+	files := map[string]Component{}
+	t := tar.NewReader(r)
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading layer: %w", err)
+		}
+		// Whiteouts, directories and alternate data streams aren't files of
+		// their own.
+		if (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeLink) || strings.HasPrefix(path.Base(hdr.Name), layerfmt.WhiteoutPrefix) || strings.Contains(hdr.Name, ":") {
+			continue
+		}
+
+		// Hard links, written for -hardLinks and dereferenced reparse
+		// points, are files with their target's content.
+		if hdr.Typeflag == tar.TypeLink {
+			if target, ok := files[hdr.Linkname]; ok {
+				doc.Components = append(doc.Components, fileComponent(hdr.Name, target.Hashes, target.Properties))
+			}
+			continue
+		}
+
+		found, digest, err := inspect(hdr, t)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %w", hdr.Name, err)
+		}
+		file := fileComponent(hdr.Name, []Hash{{Alg: "SHA-256", Content: digest}}, []Property{
+			{Name: PropertySize, Value: strconv.FormatInt(hdr.Size, 10)},
+		})
+		files[hdr.Name] = file
+		doc.Components = append(doc.Components, file)
+		packages = append(packages, found...)
+	}
+
+	doc.Components = append(doc.Components, packages...)
+	return doc, nil
+}
+
+func fileComponent(name string, hashes []Hash, properties []Property) Component {
+	return Component{
+		Type:       "file",
+		BOMRef:     "file:" + name,
+		Name:       name,
+		Hashes:     hashes,
+		Properties: properties,
+	}
+}
+
+// inspect hashes a file's content and looks for packages in it.
+func inspect(hdr *tar.Header, r io.Reader) ([]Component, string, error) {
+	digest := sha256.New()
+	r = io.TeeReader(r, digest)
+
+	var found []Component
+	switch {
+	case isImage(hdr.Name) && hdr.Size <= maxImageSize:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, "", err
+		}
+		if component, ok := imagePackage(hdr.Name, data); ok {
+			found = append(found, component)
+		}
+	case strings.EqualFold(hdr.Name, softwareHive) && hdr.Size <= maxHiveSize:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, "", err
+		}
+		// A hive we can't parse still belongs in the file list.
+		if programs, err := uninstallPackages(data); err == nil {
+			found = append(found, programs...)
+		}
+	case isCachedInstaller(hdr.Name):
+		found = append(found, Component{
+			Type:   "application",
+			BOMRef: "msi:" + hdr.Name,
+			Name:   path.Base(hdr.Name),
+			Properties: []Property{
+				{Name: PropertySource, Value: SourceInstallerCache},
+				{Name: PropertyPath, Value: hdr.Name},
+			},
+		})
+	}
+
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, "", err
+	}
+	return found, hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+func isImage(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".exe" || ext == ".dll"
+}
+
+func isCachedInstaller(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), strings.ToLower(installerCache)) && strings.EqualFold(path.Ext(name), ".msi")
+}
+
+// imagePackage describes an executable or library from its version resource.
+func imagePackage(name string, data []byte) (Component, bool) {
+	info, err := readVersionInfo(data)
+	if err != nil || info == nil {
+		return Component{}, false
+	}
+
+	component := Component{
+		Type:      "library",
+		BOMRef:    "pe:" + name,
+		Name:      info.strings["ProductName"],
+		Version:   info.strings["ProductVersion"],
+		Publisher: info.strings["CompanyName"],
+		Properties: []Property{
+			{Name: PropertySource, Value: SourceVersionResource},
+			{Name: PropertyPath, Value: name},
+		},
+	}
+	if strings.EqualFold(path.Ext(name), ".exe") {
+		component.Type = "application"
+	}
+	if component.Name == "" {
+		component.Name = path.Base(name)
+	}
+	if component.Version == "" {
+		component.Version = info.productVersion
+	}
+	fileVersion := info.strings["FileVersion"]
+	if fileVersion == "" {
+		fileVersion = info.fileVersion
+	}
+	if fileVersion != "" {
+		component.Properties = append(component.Properties, Property{Name: PropertyFileVersion, Value: fileVersion})
+	}
+	return component, true
+}
+
+// uninstallPackages lists the programs registered for uninstall in a
+// software hive.
+func uninstallPackages(data []byte) ([]Component, error) {
+	h, err := openHive(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []Component
+	for _, keyPath := range []string{
+		`Microsoft\Windows\CurrentVersion\Uninstall`,
+		`WOW6432Node\Microsoft\Windows\CurrentVersion\Uninstall`,
+	} {
+		uninstall, err := h.open(keyPath)
+		if errors.Is(err, errKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		programs, err := h.subkeys(uninstall)
+		if err != nil {
+			return nil, err
+		}
+		for _, program := range programs {
+			values, err := h.stringValues(program)
+			if err != nil {
+				return nil, err
+			}
+			if values["DisplayName"] == "" {
+				continue
+			}
+			key := `HKLM\SOFTWARE\` + keyPath + `\` + program.name
+			found = append(found, Component{
+				Type:      "application",
+				BOMRef:    "registry:" + key,
+				Name:      values["DisplayName"],
+				Version:   values["DisplayVersion"],
+				Publisher: values["Publisher"],
+				Properties: []Property{
+					{Name: PropertySource, Value: SourceUninstallKey},
+					{Name: PropertyRegistryKey, Value: key},
+				},
+			})
+		}
+	}
+	return found, nil
+}
+
+// serialNumber returns a random version 4 UUID URN.
+func serialNumber() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,330 @@
+package sbom_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"unicode/utf16"
+
+	"code.cloudfoundry.org/diff-exporter/sbom"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Scan", func() {
+	var layer *bytes.Buffer
+
+	BeforeEach(func() {
+		layer = new(bytes.Buffer)
+	})
+
+	scan := func(files map[string][]byte) *sbom.Document {
+		t := tar.NewWriter(layer)
+		Expect(t.WriteHeader(&tar.Header{Name: "Files/app", Typeflag: tar.TypeDir})).To(Succeed())
+		for name, data := range files {
+			Expect(t.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Size: int64(len(data))})).To(Succeed())
+			_, err := t.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(t.WriteHeader(&tar.Header{Name: "Files/app/.wh.deleted.txt", Typeflag: tar.TypeReg})).To(Succeed())
+		Expect(t.Close()).To(Succeed())
+
+		doc, err := sbom.Scan(layer)
+		Expect(err).ToNot(HaveOccurred())
+		return doc
+	}
+
+	componentsOfType := func(doc *sbom.Document, types ...string) []sbom.Component {
+		var found []sbom.Component
+		for _, component := range doc.Components {
+			for _, t := range types {
+				if component.Type == t {
+					found = append(found, component)
+				}
+			}
+		}
+		return found
+	}
+
+	It("describes a CycloneDX document", func() {
+		doc := scan(nil)
+		Expect(doc.BOMFormat).To(Equal("CycloneDX"))
+		Expect(doc.SpecVersion).To(Equal("1.5"))
+		Expect(doc.SerialNumber).To(MatchRegexp(`^urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`))
+		Expect(doc.Components).To(BeEmpty())
+	})
+
+	It("lists files with their digest and size, skipping whiteouts and directories", func() {
+		doc := scan(map[string][]byte{"Files/app/hello.txt": []byte("hello")})
+
+		sum := sha256.Sum256([]byte("hello"))
+		Expect(doc.Components).To(Equal([]sbom.Component{{
+			Type:       "file",
+			BOMRef:     "file:Files/app/hello.txt",
+			Name:       "Files/app/hello.txt",
+			Hashes:     []sbom.Hash{{Alg: "SHA-256", Content: hex.EncodeToString(sum[:])}},
+			Properties: []sbom.Property{{Name: sbom.PropertySize, Value: "5"}},
+		}}))
+	})
+
+	It("lists hard links with their target's digest and size", func() {
+		t := tar.NewWriter(layer)
+		Expect(t.WriteHeader(&tar.Header{Name: "Files/a/app.dll", Typeflag: tar.TypeReg, Size: 3})).To(Succeed())
+		_, err := t.Write([]byte("dll"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.WriteHeader(&tar.Header{Name: "Files/b/app.dll", Typeflag: tar.TypeLink, Linkname: "Files/a/app.dll"})).To(Succeed())
+		Expect(t.Close()).To(Succeed())
+
+		doc, err := sbom.Scan(layer)
+		Expect(err).ToNot(HaveOccurred())
+
+		sum := sha256.Sum256([]byte("dll"))
+		Expect(doc.Components).To(HaveLen(2))
+		Expect(doc.Components[1]).To(Equal(sbom.Component{
+			Type:       "file",
+			BOMRef:     "file:Files/b/app.dll",
+			Name:       "Files/b/app.dll",
+			Hashes:     []sbom.Hash{{Alg: "SHA-256", Content: hex.EncodeToString(sum[:])}},
+			Properties: []sbom.Property{{Name: sbom.PropertySize, Value: "3"}},
+		}))
+	})
+
+	It("reads the version resources of executables and libraries", func() {
+		doc := scan(map[string][]byte{
+			"Files/app/app.exe": peImage(map[string]string{"ProductName": "Some App", "ProductVersion": "1.2.3", "CompanyName": "Some Company", "FileVersion": "1.2.3.4"}),
+			"Files/app/lib.dll": peImage(map[string]string{}),
+		})
+
+		packages := componentsOfType(doc, "application", "library")
+		Expect(packages).To(ConsistOf(
+			sbom.Component{
+				Type:      "application",
+				BOMRef:    "pe:Files/app/app.exe",
+				Name:      "Some App",
+				Version:   "1.2.3",
+				Publisher: "Some Company",
+				Properties: []sbom.Property{
+					{Name: sbom.PropertySource, Value: sbom.SourceVersionResource},
+					{Name: sbom.PropertyPath, Value: "Files/app/app.exe"},
+					{Name: sbom.PropertyFileVersion, Value: "1.2.3.4"},
+				},
+			},
+			sbom.Component{
+				Type:    "library",
+				BOMRef:  "pe:Files/app/lib.dll",
+				Name:    "lib.dll",
+				Version: "5.6.7.8",
+				Properties: []sbom.Property{
+					{Name: sbom.PropertySource, Value: sbom.SourceVersionResource},
+					{Name: sbom.PropertyPath, Value: "Files/app/lib.dll"},
+					{Name: sbom.PropertyFileVersion, Value: "1.0.0.2"},
+				},
+			},
+		))
+		Expect(componentsOfType(doc, "file")).To(HaveLen(2))
+	})
+
+	It("ignores executables that aren't valid images", func() {
+		doc := scan(map[string][]byte{"Files/app/broken.exe": []byte("not a PE image")})
+		Expect(componentsOfType(doc, "application", "library")).To(BeEmpty())
+		Expect(componentsOfType(doc, "file")).To(HaveLen(1))
+	})
+
+	It("ignores images whose resource directories loop", func() {
+		image := peImage(map[string]string{"ProductName": "Some App"})
+		// Point the name directory's entry back at itself.
+		binary.LittleEndian.PutUint32(image[0x200+0x18+20:], 0x80000000|0x18)
+
+		doc := scan(map[string][]byte{"Files/app/loop.exe": image})
+		Expect(componentsOfType(doc, "application", "library")).To(BeEmpty())
+		Expect(componentsOfType(doc, "file")).To(HaveLen(1))
+	})
+
+	It("lists packages cached by Windows Installer", func() {
+		doc := scan(map[string][]byte{"Files/Windows/Installer/1a2b3c.msi": []byte("msi")})
+
+		Expect(componentsOfType(doc, "application")).To(Equal([]sbom.Component{{
+			Type:   "application",
+			BOMRef: "msi:Files/Windows/Installer/1a2b3c.msi",
+			Name:   "1a2b3c.msi",
+			Properties: []sbom.Property{
+				{Name: sbom.PropertySource, Value: sbom.SourceInstallerCache},
+				{Name: sbom.PropertyPath, Value: "Files/Windows/Installer/1a2b3c.msi"},
+			},
+		}}))
+	})
+
+	It("lists programs registered for uninstall in the software hive", func() {
+		doc := scan(map[string][]byte{"Hives/Software_Delta": softwareHive()})
+
+		key := `HKLM\SOFTWARE\Microsoft\Windows\CurrentVersion\Uninstall\SomeApp`
+		Expect(componentsOfType(doc, "application")).To(Equal([]sbom.Component{{
+			Type:      "application",
+			BOMRef:    "registry:" + key,
+			Name:      "Some App",
+			Version:   "2.0",
+			Publisher: "Some Company",
+			Properties: []sbom.Property{
+				{Name: sbom.PropertySource, Value: sbom.SourceUninstallKey},
+				{Name: sbom.PropertyRegistryKey, Value: key},
+			},
+		}}))
+	})
+
+	It("still lists a hive it can't parse", func() {
+		doc := scan(map[string][]byte{"Hives/Software_Delta": []byte("not a hive")})
+		Expect(doc.Components).To(HaveLen(1))
+	})
+
+	It("errors on a truncated layer", func() {
+		_, err := sbom.Scan(bytes.NewReader(make([]byte, 100)))
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+func utf16z(s string) []byte {
+	var b []byte
+	for _, c := range append(utf16.Encode([]rune(s)), 0) {
+		b = binary.LittleEndian.AppendUint16(b, c)
+	}
+	return b
+}
+
+func pad4(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// versionBlock encodes one of the nested structures of a version resource.
+func versionBlock(key string, value []byte, text bool, children ...[]byte) []byte {
+	b := make([]byte, 6)
+	valueLength := len(value)
+	if text {
+		valueLength /= 2
+		binary.LittleEndian.PutUint16(b[4:], 1)
+	}
+	binary.LittleEndian.PutUint16(b[2:], uint16(valueLength))
+	b = pad4(append(b, utf16z(key)...))
+	b = append(b, value...)
+	for _, child := range children {
+		b = append(pad4(b), child...)
+	}
+	binary.LittleEndian.PutUint16(b, uint16(len(b)))
+	return b
+}
+
+// peImage builds a PE image whose only section holds a version resource
+// with strings, file version 1.0.0.2 and product version 5.6.7.8.
+func peImage(strings map[string]string) []byte {
+	fixed := make([]byte, 52)
+	for i, v := range []uint32{0xfeef04bd, 0x10000, 0x10000, 2, 0x50006, 0x70008} {
+		binary.LittleEndian.PutUint32(fixed[i*4:], v)
+	}
+	var table [][]byte
+	for key, value := range strings {
+		table = append(table, versionBlock(key, utf16z(value), true))
+	}
+	version := versionBlock("VS_VERSION_INFO", fixed, false,
+		versionBlock("StringFileInfo", nil, true, versionBlock("040904b0", nil, true, table...)))
+
+	const virtualAddress, dataOffset = 0x1000, 0x58
+	rsrc := make([]byte, dataOffset)
+	directory := func(offset, id, target uint32) {
+		binary.LittleEndian.PutUint16(rsrc[offset+14:], 1)
+		binary.LittleEndian.PutUint32(rsrc[offset+16:], id)
+		binary.LittleEndian.PutUint32(rsrc[offset+20:], target)
+	}
+	directory(0, 16, 0x80000000|0x18)
+	directory(0x18, 1, 0x80000000|0x30)
+	directory(0x30, 0x409, 0x48)
+	binary.LittleEndian.PutUint32(rsrc[0x48:], virtualAddress+dataOffset)
+	binary.LittleEndian.PutUint32(rsrc[0x4c:], uint32(len(version)))
+	rsrc = append(rsrc, version...)
+
+	image := make([]byte, 0x200)
+	copy(image, "MZ")
+	binary.LittleEndian.PutUint32(image[0x3c:], 0x40)
+	copy(image[0x40:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(image[0x44:], 0x8664)
+	binary.LittleEndian.PutUint16(image[0x46:], 1)
+	section := image[0x58:]
+	copy(section, ".rsrc")
+	binary.LittleEndian.PutUint32(section[8:], uint32(len(rsrc)))
+	binary.LittleEndian.PutUint32(section[12:], virtualAddress)
+	binary.LittleEndian.PutUint32(section[16:], uint32(len(rsrc)))
+	binary.LittleEndian.PutUint32(section[20:], 0x200)
+	return append(image, rsrc...)
+}
+
+// hiveBuilder lays out the cells of a registry hive's single bin.
+type hiveBuilder struct {
+	bin []byte
+}
+
+func (h *hiveBuilder) cell(data []byte) uint32 {
+	offset := uint32(len(h.bin))
+	size := (4 + len(data) + 7) &^ 7
+	cell := make([]byte, size)
+	binary.LittleEndian.PutUint32(cell, uint32(-int32(size)))
+	copy(cell[4:], data)
+	h.bin = append(h.bin, cell...)
+	return offset
+}
+
+func (h *hiveBuilder) key(name string, subkeys []uint32, values map[string]string) uint32 {
+	nk := make([]byte, 0x4c)
+	copy(nk, "nk")
+	binary.LittleEndian.PutUint16(nk[2:], 0x20)
+	binary.LittleEndian.PutUint32(nk[0x14:], uint32(len(subkeys)))
+	if len(subkeys) > 0 {
+		list := []byte("lf")
+		list = binary.LittleEndian.AppendUint16(list, uint16(len(subkeys)))
+		for _, subkey := range subkeys {
+			list = binary.LittleEndian.AppendUint32(list, subkey)
+			list = append(list, 0, 0, 0, 0)
+		}
+		binary.LittleEndian.PutUint32(nk[0x1c:], h.cell(list))
+	}
+	binary.LittleEndian.PutUint32(nk[0x24:], uint32(len(values)))
+	if len(values) > 0 {
+		var list []byte
+		for valueName, value := range values {
+			data := utf16z(value)
+			vk := make([]byte, 0x14)
+			copy(vk, "vk")
+			binary.LittleEndian.PutUint16(vk[2:], uint16(len(valueName)))
+			binary.LittleEndian.PutUint32(vk[4:], uint32(len(data)))
+			binary.LittleEndian.PutUint32(vk[8:], h.cell(data))
+			binary.LittleEndian.PutUint32(vk[0x0c:], 1)
+			binary.LittleEndian.PutUint16(vk[0x10:], 1)
+			list = binary.LittleEndian.AppendUint32(list, h.cell(append(vk, valueName...)))
+		}
+		binary.LittleEndian.PutUint32(nk[0x28:], h.cell(list))
+	}
+	binary.LittleEndian.PutUint16(nk[0x48:], uint16(len(name)))
+	return h.cell(append(nk, name...))
+}
+
+// softwareHive builds a hive with one program registered for uninstall and
+// one key without a display name.
+func softwareHive() []byte {
+	h := &hiveBuilder{bin: make([]byte, 32)}
+	copy(h.bin, "hbin")
+
+	app := h.key("SomeApp", nil, map[string]string{"DisplayName": "Some App", "DisplayVersion": "2.0", "Publisher": "Some Company"})
+	update := h.key("SomeUpdate", nil, map[string]string{"ParentKeyName": "SomeApp"})
+	key := h.key("Uninstall", []uint32{app, update}, nil)
+	for _, name := range []string{"CurrentVersion", "Windows", "Microsoft"} {
+		key = h.key(name, []uint32{key}, nil)
+	}
+	root := h.key("ROOT", []uint32{key}, nil)
+
+	header := make([]byte, 4096)
+	copy(header, "regf")
+	binary.LittleEndian.PutUint32(header[0x24:], root)
+	return append(header, h.bin...)
+}
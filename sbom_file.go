@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	"code.cloudfoundry.org/diff-exporter/layer"
+	"code.cloudfoundry.org/diff-exporter/sbom"
+)
+
+type sbomScan struct {
+	doc *sbom.Document
+	err error
+}
+
+// scanSBOM makes opts copy the layer's tar stream to an SBOM scanner. The
+// returned function must be called with the export's error once it is done
+// and waits for the scan to finish.
+func scanSBOM(opts *layer.Options) func(exportErr error) (*sbom.Document, error) {
+	r, w := io.Pipe()
+	done := make(chan sbomScan, 1)
+	go func() {
+		doc, err := sbom.Scan(r)
+		// Keep reading so a failed scan doesn't hold up the export.
+		io.Copy(io.Discard, r)
+		done <- sbomScan{doc: doc, err: err}
+	}()
+
+	opts.Tee = w
+	return func(exportErr error) (*sbom.Document, error) {
+		w.CloseWithError(exportErr)
+		scan := <-done
+		return scan.doc, scan.err
+	}
+}
+
+// writeSBOMFile describes the exported layer in doc and writes it.
+func writeSBOMFile(sbomFile string, noClobber bool, doc *sbom.Document, containerId string, result layer.Result) error {
+	doc.Metadata.Component = &sbom.Component{
+		Type:   "container",
+		Name:   containerId,
+		Hashes: []sbom.Hash{{Alg: "SHA-256", Content: strings.TrimPrefix(result.Digest, "sha256:")}},
+	}
+	return writeFileAtomically(sbomFile, noClobber, func(w io.Writer) error {
+		return writeJSON(w, doc)
+	})
+}
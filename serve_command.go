@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/diff-exporter/layer"
+	"code.cloudfoundry.org/diff-exporter/metrics"
+	"code.cloudfoundry.org/diff-exporter/server"
+)
+
+const (
+	serveCommand = "serve"
+	serveUsage   = "USAGE: diff-exporter.exe serve [-listen address] [-maxExports count] [-errorFormat text|json]\n" +
+		"The API has no authentication: only listen where untrusted users can't connect."
+
+	shutdownTimeout   = 30 * time.Second
+	readHeaderTimeout = 10 * time.Second
+)
+
+type serveConfig struct {
+	listen      string
+	maxExports  int
+	errorFormat string
+}
+
+// runServe serves exports over HTTP until interrupted.
+func runServe(args []string) {
+	cfg, err := parseServeFlags(args)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, serveUsage)
+		os.Exit(0)
+	}
+	reporter := errorReporter{format: cfg.errorFormat, usage: serveUsage}
+	if err != nil {
+		reporter.exit(&stageError{stage: stageFlags, err: fmt.Errorf("Error parsing flags: %w", err)})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	recorder := metrics.NewRecorder()
+	srv := server.NewWithOptions(layerExporter{recorder: recorder}, server.Options{MaxExports: cfg.maxExports})
+	srv.Handle("GET /metrics", recorder)
+
+	httpServer := &http.Server{
+		Addr:              cfg.listen,
+		Handler:           srv,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ErrorLog:          log.New(os.Stderr, "", log.LstdFlags),
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "Listening on %s\n", cfg.listen)
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		reporter.exit(fmt.Errorf("Error serving: %w", err))
+	}
+}
+
+func parseServeFlags(args []string) (serveConfig, error) {
+	var cfg serveConfig
+	flags := flag.NewFlagSet("diff-exporter serve", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&cfg.listen, "listen", "127.0.0.1:8787", "Address to serve the unauthenticated HTTP API on, which must not be reachable by untrusted users")
+	flags.IntVar(&cfg.maxExports, "maxExports", server.DefaultMaxExports, "Number of exports to run at once; more are refused with 503 Service Unavailable until one finishes")
+	flags.StringVar(&cfg.errorFormat, "errorFormat", errorFormatText, "How to report errors on stderr: text or json")
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if err := checkErrorFormat(&cfg.errorFormat); err != nil {
+		return cfg, err
+	}
+	if cfg.listen == "" {
+		return cfg, errors.New("must provide address to listen on")
+	}
+	if cfg.maxExports < 1 {
+		return cfg, errors.New("maxExports must be at least 1")
+	}
+
+	return cfg, nil
+}
+
+// layerExporter exports layers for the HTTP server and records metrics about
+// them.
+type layerExporter struct {
+	recorder *metrics.Recorder
+}
+
+func (e layerExporter) Export(ctx context.Context, containerId string, req server.ExportRequest, w io.Writer) (server.Result, error) {
+	exporter := layer.New(containerId, req.BundlePath)
+	opts := layer.Options{
+		Layout:    layer.Layout{Spec: req.Spec},
+		Reprepare: req.Reprepare,
+	}
+
+	start := time.Now()
+	result, err := exporter.ExportTo(ctx, w, opts)
+	e.recorder.Record(exportMetrics(result, time.Since(start), err))
+	if err != nil {
+		log.Printf("Error exporting container %s: %s", containerId, err.Error())
+		if layer.StageOf(err) == layer.StageSpec {
+			return server.Result{}, fmt.Errorf("%w: %w", server.ErrBadRequest, err)
+		}
+		return server.Result{}, err
+	}
+
+	return server.Result{Digest: result.Digest, Size: result.Size}, nil
+}
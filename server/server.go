@@ -0,0 +1,275 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	// Trailers sent once a layer has been streamed.
+	DigestTrailer = "X-Layer-Digest"
+	SizeTrailer   = "X-Layer-Size"
+	// ErrorTrailer is set when an export fails after the layer started streaming.
+	ErrorTrailer = "X-Export-Error"
+
+	layerMediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// DefaultMaxExports is how many exports run at once unless Options say
+	// otherwise.
+	DefaultMaxExports = 4
+	// maxRequestSize bounds the body of an export request, which holds at
+	// most a runtime spec.
+	maxRequestSize = 1 << 20
+)
+
+// ErrBadRequest marks errors caused by the request rather than the server.
+// Exporters may wrap it to have the error reported as 400 Bad Request.
+var ErrBadRequest = errors.New("bad request")
+
+var errTooManyExports = errors.New("too many exports in flight")
+
+// ExportRequest is the body of POST /v1/containers/{id}/export. One of
+// BundlePath or Spec is required.
+type ExportRequest struct {
+	BundlePath string      `json:"bundlePath,omitempty"`
+	Spec       *specs.Spec `json:"spec,omitempty"`
+	Reprepare  bool        `json:"reprepare,omitempty"`
+}
+
+// Result describes a layer written by an Exporter.
+type Result struct {
+	Digest string
+	Size   int64
+}
+
+// Exporter writes a container's layer to w.
+type Exporter interface {
+	Export(ctx context.Context, containerId string, req ExportRequest, w io.Writer) (Result, error)
+}
+
+// Status describes an export in flight.
+type Status struct {
+	ContainerId  string    `json:"containerId"`
+	StartedAt    time.Time `json:"startedAt"`
+	BytesWritten int64     `json:"bytesWritten"`
+}
+
+type export struct {
+	containerId  string
+	startedAt    time.Time
+	bytesWritten int64
+}
+
+// Options controls how a Server handles exports.
+type Options struct {
+	// MaxExports is how many exports may run at once; more are refused
+	// until one finishes. Zero uses DefaultMaxExports.
+	MaxExports int
+}
+
+// Server serves container layer exports over HTTP.
+type Server struct {
+	exporter   Exporter
+	mux        *http.ServeMux
+	maxExports int
+
+	mu       sync.Mutex
+	inFlight map[string]*export
+}
+
+func New(exporter Exporter) *Server {
+	return NewWithOptions(exporter, Options{})
+}
+
+func NewWithOptions(exporter Exporter, opts Options) *Server {
+	if opts.MaxExports == 0 {
+		opts.MaxExports = DefaultMaxExports
+	}
+	s := &Server{
+		exporter:   exporter,
+		mux:        http.NewServeMux(),
+		maxExports: opts.MaxExports,
+		inFlight:   map[string]*export{},
+	}
+	s.mux.HandleFunc("POST /v1/containers/{id}/export", s.handleExport)
+	s.mux.HandleFunc("GET /v1/exports", s.handleListExports)
+	s.mux.HandleFunc("GET /v1/exports/{id}", s.handleGetExport)
+	return s
+}
+
+// Handle registers an additional handler, e.g. for metrics.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	// The path value is unescaped, so it may hold separators sent as %5C
+	// or %2F.
+	containerId := r.PathValue("id")
+	if !layerfmt.ValidContainerId(containerId) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid container id %q", containerId))
+		return
+	}
+
+	var req ExportRequest
+	body := http.MaxBytesReader(w, r.Body, maxRequestSize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil && err != io.EOF {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeError(w, status, fmt.Errorf("Error parsing request: %w", err))
+		return
+	}
+	if req.BundlePath == "" && req.Spec == nil {
+		writeError(w, http.StatusBadRequest, errors.New("must provide bundle path or spec"))
+		return
+	}
+
+	exp, err := s.start(containerId)
+	if err != nil {
+		status := http.StatusConflict
+		if errors.Is(err, errTooManyExports) {
+			status = http.StatusServiceUnavailable
+		}
+		writeError(w, status, err)
+		return
+	}
+	defer s.finish(containerId)
+
+	stream := &streamWriter{w: w, export: exp}
+	result, err := s.exporter.Export(r.Context(), containerId, req, stream)
+	if err != nil {
+		if !stream.started {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrBadRequest) {
+				status = http.StatusBadRequest
+			}
+			writeError(w, status, err)
+			return
+		}
+		// The status line has already been sent, so the trailer is the
+		// only way left to tell the client the layer is incomplete.
+		w.Header().Set(ErrorTrailer, err.Error())
+		return
+	}
+
+	stream.start()
+	w.Header().Set(DigestTrailer, result.Digest)
+	w.Header().Set(SizeTrailer, fmt.Sprintf("%d", result.Size))
+}
+
+func (s *Server) handleListExports(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Exports())
+}
+
+func (s *Server) handleGetExport(w http.ResponseWriter, r *http.Request) {
+	containerId := r.PathValue("id")
+	for _, status := range s.Exports() {
+		if status.ContainerId == containerId {
+			writeJSON(w, http.StatusOK, status)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("no export in flight for container %s", containerId))
+}
+
+// Exports returns the exports in flight, oldest first.
+func (s *Server) Exports() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := []Status{}
+	for _, exp := range s.inFlight {
+		statuses = append(statuses, Status{
+			ContainerId:  exp.containerId,
+			StartedAt:    exp.startedAt,
+			BytesWritten: atomic.LoadInt64(&exp.bytesWritten),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].StartedAt.Before(statuses[j].StartedAt)
+	})
+	return statuses
+}
+
+// start records an export of containerId as in flight, unless the container
+// is already being exported or the server is running as many exports as it
+// may.
+func (s *Server) start(containerId string) (*export, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.inFlight[containerId]; ok {
+		return nil, fmt.Errorf("container %s is already being exported", containerId)
+	}
+	if len(s.inFlight) >= s.maxExports {
+		return nil, fmt.Errorf("%w: %d are running", errTooManyExports, len(s.inFlight))
+	}
+	exp := &export{containerId: containerId, startedAt: time.Now()}
+	s.inFlight[containerId] = exp
+	return exp, nil
+}
+
+func (s *Server) finish(containerId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inFlight, containerId)
+}
+
+// streamWriter holds back the response status until the exporter writes the
+// first byte, so errors before that can still be reported with a status code.
+type streamWriter struct {
+	w       http.ResponseWriter
+	export  *export
+	started bool
+}
+
+func (s *streamWriter) start() {
+	if !s.started {
+		s.w.Header().Set("Content-Type", layerMediaType)
+		s.w.Header().Set("Trailer", DigestTrailer+", "+SizeTrailer+", "+ErrorTrailer)
+		s.w.WriteHeader(http.StatusOK)
+		s.started = true
+	}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.start()
+	n, err := s.w.Write(p)
+	atomic.AddInt64(&s.export.bytesWritten, int64(n))
+	return n, err
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
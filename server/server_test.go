@@ -0,0 +1,257 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/diff-exporter/server"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type exportCall struct {
+	containerId string
+	req         server.ExportRequest
+}
+
+// fakeExporter writes layer and then returns err. If block is set it waits
+// for block to be closed after writing the layer.
+type fakeExporter struct {
+	mu    sync.Mutex
+	calls []exportCall
+
+	layer   string
+	err     error
+	block   chan struct{}
+	started chan struct{}
+}
+
+func (f *fakeExporter) Export(ctx context.Context, containerId string, req server.ExportRequest, w io.Writer) (server.Result, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, exportCall{containerId: containerId, req: req})
+	f.mu.Unlock()
+
+	if _, err := io.WriteString(w, f.layer); err != nil {
+		return server.Result{}, err
+	}
+	if f.block != nil {
+		f.started <- struct{}{}
+		<-f.block
+	}
+	if f.err != nil {
+		return server.Result{}, f.err
+	}
+	return server.Result{Digest: "sha256:some-digest", Size: int64(len(f.layer))}, nil
+}
+
+var _ = Describe("Server", func() {
+	var (
+		exporter *fakeExporter
+		ts       *httptest.Server
+	)
+
+	BeforeEach(func() {
+		exporter = &fakeExporter{layer: "some-layer-bytes"}
+		ts = httptest.NewServer(server.New(exporter))
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	exportContainer := func(containerId, body string) *http.Response {
+		resp, err := http.Post(ts.URL+"/v1/containers/"+containerId+"/export", "application/json", strings.NewReader(body))
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		return resp
+	}
+
+	readError := func(resp *http.Response) string {
+		defer resp.Body.Close()
+		var body map[string]string
+		ExpectWithOffset(1, json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+		return body["error"]
+	}
+
+	Describe("POST /v1/containers/{id}/export", func() {
+		It("streams the layer with its digest and size as trailers", func() {
+			resp := exportContainer("some-container", `{"bundlePath": "C:\\bundles\\some-container"}`)
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Content-Type")).To(Equal("application/vnd.oci.image.layer.v1.tar+gzip"))
+
+			body, err := io.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).To(Equal("some-layer-bytes"))
+
+			Expect(resp.Trailer.Get(server.DigestTrailer)).To(Equal("sha256:some-digest"))
+			Expect(resp.Trailer.Get(server.SizeTrailer)).To(Equal(fmt.Sprintf("%d", len("some-layer-bytes"))))
+			Expect(resp.Trailer.Get(server.ErrorTrailer)).To(BeEmpty())
+		})
+
+		It("passes the request on to the exporter", func() {
+			resp := exportContainer("some-container", `{"spec": {"windows": {"layerFolders": ["C:\\layers\\base"]}}, "reprepare": true}`)
+			resp.Body.Close()
+
+			Expect(exporter.calls).To(HaveLen(1))
+			Expect(exporter.calls[0].containerId).To(Equal("some-container"))
+			Expect(exporter.calls[0].req.Reprepare).To(BeTrue())
+			Expect(exporter.calls[0].req.Spec.Windows.LayerFolders).To(Equal([]string{`C:\layers\base`}))
+		})
+
+		It("rejects a malformed body", func() {
+			resp := exportContainer("some-container", `{"bundlePath":`)
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(readError(resp)).To(ContainSubstring("Error parsing request"))
+			Expect(exporter.calls).To(BeEmpty())
+		})
+
+		It("rejects a body larger than a spec can be", func() {
+			resp := exportContainer("some-container", `{"bundlePath": "`+strings.Repeat("a", 2<<20)+`"}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(readError(resp)).To(ContainSubstring("Error parsing request"))
+			Expect(exporter.calls).To(BeEmpty())
+		})
+
+		DescribeTable("rejects ids that aren't a single path element",
+			func(containerId string) {
+				resp := exportContainer(containerId, `{"bundlePath": "C:\\bundles\\some-container"}`)
+				Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+				Expect(readError(resp)).To(ContainSubstring("invalid container id"))
+				Expect(exporter.calls).To(BeEmpty())
+			},
+			Entry("an escaped backslash", `..%5Cother-layer`),
+			Entry("an escaped slash", `..%2Fother-layer`),
+			Entry("a parent directory", `%2E%2E`),
+			Entry("a drive", `C:%5Clayers`),
+		)
+
+		It("requires a bundle path or spec", func() {
+			resp := exportContainer("some-container", `{}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(readError(resp)).To(Equal("must provide bundle path or spec"))
+		})
+
+		Context("when the export fails before streaming", func() {
+			BeforeEach(func() {
+				exporter.layer = ""
+			})
+
+			It("responds with a server error", func() {
+				exporter.err = errors.New("couldn't unprepare")
+
+				resp := exportContainer("some-container", `{"bundlePath": "some-bundle"}`)
+				Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+				Expect(readError(resp)).To(Equal("couldn't unprepare"))
+			})
+
+			It("responds with a bad request when the exporter blames the request", func() {
+				exporter.err = fmt.Errorf("%w: bundle spec has no windows section", server.ErrBadRequest)
+
+				resp := exportContainer("some-container", `{"bundlePath": "some-bundle"}`)
+				Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+				Expect(readError(resp)).To(ContainSubstring("no windows section"))
+			})
+		})
+
+		Context("when the export fails while streaming", func() {
+			BeforeEach(func() {
+				exporter.err = errors.New("couldn't read")
+			})
+
+			It("reports the error in a trailer", func() {
+				resp := exportContainer("some-container", `{"bundlePath": "some-bundle"}`)
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				_, err := io.ReadAll(resp.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.Trailer.Get(server.ErrorTrailer)).To(Equal("couldn't read"))
+				Expect(resp.Trailer.Get(server.DigestTrailer)).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("in-flight exports", func() {
+		BeforeEach(func() {
+			exporter.block = make(chan struct{})
+			exporter.started = make(chan struct{}, 1)
+		})
+
+		It("reports them until they finish", func() {
+			done := make(chan *http.Response)
+			go func() {
+				defer GinkgoRecover()
+				done <- exportContainer("some-container", `{"bundlePath": "some-bundle"}`)
+			}()
+			Eventually(exporter.started).Should(Receive())
+
+			resp, err := http.Get(ts.URL + "/v1/exports")
+			Expect(err).ToNot(HaveOccurred())
+			var statuses []server.Status
+			Expect(json.NewDecoder(resp.Body).Decode(&statuses)).To(Succeed())
+			resp.Body.Close()
+			Expect(statuses).To(HaveLen(1))
+			Expect(statuses[0].ContainerId).To(Equal("some-container"))
+			Expect(statuses[0].BytesWritten).To(Equal(int64(len("some-layer-bytes"))))
+
+			resp, err = http.Get(ts.URL + "/v1/exports/some-container")
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			close(exporter.block)
+			exportResp := <-done
+			io.ReadAll(exportResp.Body)
+			exportResp.Body.Close()
+
+			resp, err = http.Get(ts.URL + "/v1/exports/some-container")
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		})
+
+		It("refuses to export the same container twice at once", func() {
+			done := make(chan *http.Response)
+			go func() {
+				defer GinkgoRecover()
+				done <- exportContainer("some-container", `{"bundlePath": "some-bundle"}`)
+			}()
+			Eventually(exporter.started).Should(Receive())
+
+			resp := exportContainer("some-container", `{"bundlePath": "some-bundle"}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusConflict))
+			Expect(readError(resp)).To(ContainSubstring("already being exported"))
+
+			close(exporter.block)
+			exportResp := <-done
+			exportResp.Body.Close()
+		})
+
+		It("refuses more exports than it may run at once", func() {
+			ts.Close()
+			ts = httptest.NewServer(server.NewWithOptions(exporter, server.Options{MaxExports: 1}))
+			done := make(chan *http.Response)
+			go func() {
+				defer GinkgoRecover()
+				done <- exportContainer("some-container", `{"bundlePath": "some-bundle"}`)
+			}()
+			Eventually(exporter.started).Should(Receive())
+
+			resp := exportContainer("other-container", `{"bundlePath": "other-bundle"}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(readError(resp)).To(ContainSubstring("too many exports in flight"))
+			Expect(exporter.calls).To(HaveLen(1))
+
+			close(exporter.block)
+			exportResp := <-done
+			exportResp.Body.Close()
+		})
+	})
+})
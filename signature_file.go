@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"os"
+
+	"code.cloudfoundry.org/diff-exporter/layer"
+	"code.cloudfoundry.org/diff-exporter/signing"
+)
+
+func loadSigningKey(keyFile string) (crypto.Signer, error) {
+	pemBytes, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, &stageError{stage: stageSign, err: fmt.Errorf("Error reading signing key: %w", err)}
+	}
+	key, err := signing.LoadPrivateKey(pemBytes)
+	if err != nil {
+		return nil, &stageError{stage: stageSign, err: fmt.Errorf("Error loading signing key: %w", err)}
+	}
+	return key, nil
+}
+
+// writeSignatureFiles signs the layer's digest, writing the simple signing
+// payload and its detached signature.
+func writeSignatureFiles(cfg config, key crypto.Signer, result layer.Result) error {
+	payload, err := signing.NewPayload(result.Digest, cfg.signatureReference)
+	if err != nil {
+		return &stageError{stage: stageSign, err: err}
+	}
+	signature, err := signing.Sign(key, payload)
+	if err != nil {
+		return &stageError{stage: stageSign, err: fmt.Errorf("Error signing layer: %w", err)}
+	}
+
+	if err := writeFileAtomically(cfg.payloadFile, cfg.noClobber, writeBytes(payload)); err != nil {
+		return fmt.Errorf("Error writing payload file: %w", err)
+	}
+	if err := writeFileAtomically(cfg.signatureFile, cfg.noClobber, writeBytes(signature)); err != nil {
+		return fmt.Errorf("Error writing signature file: %w", err)
+	}
+	return nil
+}
+
+func writeBytes(b []byte) func(io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	}
+}
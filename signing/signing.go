@@ -0,0 +1,179 @@
+package signing
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// signatureType is the type cosign gives simple signing payloads.
+const signatureType = "cosign container image signature"
+
+var (
+	ErrInvalidKey       = errors.New("key is not a PEM encoded ed25519 or ECDSA key")
+	ErrInvalidSignature = errors.New("signature does not match payload")
+	ErrInvalidPayload   = errors.New("payload is not a simple signing payload")
+	ErrDigestMismatch   = errors.New("payload was signed for a different digest")
+)
+
+// Payload is a simple signing payload, the document cosign signs to vouch
+// for an image or layer digest.
+type Payload struct {
+	Critical Critical          `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+type Critical struct {
+	Identity Identity `json:"identity"`
+	Image    Image    `json:"image"`
+	Type     string   `json:"type"`
+}
+
+type Identity struct {
+	DockerReference string `json:"docker-reference"`
+}
+
+type Image struct {
+	DockerManifestDigest string `json:"docker-manifest-digest"`
+}
+
+// NewPayload returns the encoded payload for digest. reference names where
+// the layer will be published and may be empty.
+func NewPayload(digest, reference string) ([]byte, error) {
+	return json.Marshal(Payload{
+		Critical: Critical{
+			Identity: Identity{DockerReference: reference},
+			Image:    Image{DockerManifestDigest: digest},
+			Type:     signatureType,
+		},
+	})
+}
+
+// ParsePayload decodes a payload, checking that it is a simple signing one.
+func ParsePayload(payload []byte) (Payload, error) {
+	var p Payload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return Payload{}, fmt.Errorf("%w: %w", ErrInvalidPayload, err)
+	}
+	if p.Critical.Type != signatureType || p.Critical.Image.DockerManifestDigest == "" {
+		return Payload{}, ErrInvalidPayload
+	}
+	return p, nil
+}
+
+// LoadPrivateKey parses an unencrypted PKCS #8 or SEC 1 private key.
+func LoadPrivateKey(pemBytes []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, ErrInvalidKey
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%w: unsupported PEM block %q", ErrInvalidKey, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %T", ErrInvalidKey, key)
+	}
+}
+
+// LoadPublicKey parses a PKIX public key, as written by cosign
+// generate-key-pair.
+func LoadPublicKey(pemBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, ErrInvalidKey
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+
+	switch key := key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %T", ErrInvalidKey, key)
+	}
+}
+
+// Sign signs payload the way cosign does: ed25519 keys sign it directly
+// and ECDSA keys sign its SHA-256. The signature is base64 encoded.
+func Sign(key crypto.Signer, payload []byte) ([]byte, error) {
+	var signature []byte
+	var err error
+	switch key.(type) {
+	case ed25519.PrivateKey:
+		signature, err = key.Sign(rand.Reader, payload, crypto.Hash(0))
+	default:
+		digest := sha256.Sum256(payload)
+		signature, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(signature)), nil
+}
+
+// Verify checks a base64 encoded signature of payload.
+func Verify(key crypto.PublicKey, payload, signature []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature)))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+
+	valid := false
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, payload, raw)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(payload)
+		valid = ecdsa.VerifyASN1(key, digest[:], raw)
+	default:
+		return fmt.Errorf("%w: unsupported key type %T", ErrInvalidKey, key)
+	}
+	if !valid {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// VerifyDigest checks a signature of payload and that the payload vouches
+// for digest.
+func VerifyDigest(key crypto.PublicKey, payload, signature []byte, digest string) error {
+	if err := Verify(key, payload, signature); err != nil {
+		return err
+	}
+	p, err := ParsePayload(payload)
+	if err != nil {
+		return err
+	}
+	if p.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("%w: signed %s, got %s", ErrDigestMismatch, p.Critical.Image.DockerManifestDigest, digest)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package signing_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+
+	"code.cloudfoundry.org/diff-exporter/signing"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const digest = "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func encodeKeyPair(key crypto.Signer, privateType string) ([]byte, []byte) {
+	var der []byte
+	var err error
+	if privateType == "EC PRIVATE KEY" {
+		der, err = x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
+	} else {
+		der, err = x509.MarshalPKCS8PrivateKey(key)
+	}
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+
+	return pem.EncodeToMemory(&pem.Block{Type: privateType, Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+}
+
+var _ = Describe("Payload", func() {
+	It("is a cosign simple signing payload", func() {
+		payload, err := signing.NewPayload(digest, "registry.example.com/app")
+		Expect(err).ToNot(HaveOccurred())
+
+		var decoded map[string]interface{}
+		Expect(json.Unmarshal(payload, &decoded)).To(Succeed())
+		Expect(decoded).To(Equal(map[string]interface{}{
+			"critical": map[string]interface{}{
+				"identity": map[string]interface{}{"docker-reference": "registry.example.com/app"},
+				"image":    map[string]interface{}{"docker-manifest-digest": digest},
+				"type":     "cosign container image signature",
+			},
+			"optional": nil,
+		}))
+	})
+
+	It("rejects payloads of another type", func() {
+		_, err := signing.ParsePayload([]byte(`{"critical": {"type": "something else", "image": {"docker-manifest-digest": "sha256:abc"}}}`))
+		Expect(err).To(MatchError(signing.ErrInvalidPayload))
+	})
+
+	It("rejects payloads that aren't json", func() {
+		_, err := signing.ParsePayload([]byte("nope"))
+		Expect(err).To(MatchError(signing.ErrInvalidPayload))
+	})
+})
+
+var _ = Describe("Sign and Verify", func() {
+	var payload []byte
+
+	BeforeEach(func() {
+		var err error
+		payload, err = signing.NewPayload(digest, "")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	keys := []struct {
+		name     string
+		generate func() (crypto.Signer, string)
+	}{
+		{"ed25519", func() (crypto.Signer, string) {
+			_, key, err := ed25519.GenerateKey(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			return key, "PRIVATE KEY"
+		}},
+		{"ECDSA P-256", func() (crypto.Signer, string) {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			return key, "PRIVATE KEY"
+		}},
+		{"SEC 1 ECDSA", func() (crypto.Signer, string) {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			return key, "EC PRIVATE KEY"
+		}},
+	}
+
+	for _, key := range keys {
+		generate := key.generate
+		Context("with an "+key.name+" key", func() {
+			var privatePEM, publicPEM []byte
+
+			BeforeEach(func() {
+				privatePEM, publicPEM = encodeKeyPair(generate())
+			})
+
+			It("verifies what it signed", func() {
+				key, err := signing.LoadPrivateKey(privatePEM)
+				Expect(err).ToNot(HaveOccurred())
+				signature, err := signing.Sign(key, payload)
+				Expect(err).ToNot(HaveOccurred())
+
+				pub, err := signing.LoadPublicKey(publicPEM)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(signing.VerifyDigest(pub, payload, append(signature, '\n'), digest)).To(Succeed())
+			})
+
+			It("rejects a tampered payload", func() {
+				key, err := signing.LoadPrivateKey(privatePEM)
+				Expect(err).ToNot(HaveOccurred())
+				signature, err := signing.Sign(key, payload)
+				Expect(err).ToNot(HaveOccurred())
+
+				tampered, err := signing.NewPayload("sha256:0000", "")
+				Expect(err).ToNot(HaveOccurred())
+				pub, err := signing.LoadPublicKey(publicPEM)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(signing.Verify(pub, tampered, signature)).To(MatchError(signing.ErrInvalidSignature))
+			})
+		})
+	}
+
+	It("rejects a payload signed for another digest", func() {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		signature, err := signing.Sign(key, payload)
+		Expect(err).ToNot(HaveOccurred())
+
+		err = signing.VerifyDigest(key.Public(), payload, signature, "sha256:0000")
+		Expect(err).To(MatchError(signing.ErrDigestMismatch))
+	})
+
+	It("rejects a signature that isn't base64", func() {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(signing.Verify(key.Public(), payload, []byte("!!!"))).To(MatchError(signing.ErrInvalidSignature))
+	})
+
+	It("rejects keys that aren't PEM", func() {
+		_, err := signing.LoadPrivateKey([]byte("nope"))
+		Expect(err).To(MatchError(signing.ErrInvalidKey))
+		_, err = signing.LoadPublicKey([]byte("nope"))
+		Expect(err).To(MatchError(signing.ErrInvalidKey))
+	})
+
+	It("rejects encrypted cosign keys", func() {
+		_, err := signing.LoadPrivateKey(pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED SIGSTORE PRIVATE KEY", Bytes: []byte("secret")}))
+		Expect(err).To(MatchError(signing.ErrInvalidKey))
+	})
+})
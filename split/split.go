@@ -0,0 +1,173 @@
+// Package split writes a layer as consecutive parts of bounded size, for
+// transfer channels and blobstores that cap the size of an object, and
+// joins them back together.
+package split
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+var (
+	ErrPartMismatch   = errors.New("part does not match the parts manifest")
+	ErrDigestMismatch = errors.New("joined layer does not match its digest")
+)
+
+// Manifest lists the parts a layer was split into, in order, so each can be
+// verified on its own and the layer checked once they are joined.
+type Manifest struct {
+	// Digest and Size are those of the whole layer.
+	Digest   string `json:"digest"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"partSize"`
+	Parts    []Part `json:"parts"`
+}
+
+// Part is one of the files a layer was split into.
+type Part struct {
+	// Index is the part's position in the layer, starting at 1.
+	Index int `json:"index"`
+	// Name is the part's file name, relative to the parts manifest.
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// PartName is the name of the part of the layer name at index.
+func PartName(name string, index int) string {
+	return fmt.Sprintf("%s.part%04d", name, index)
+}
+
+// Writer writes a layer as parts of at most partSize bytes, each opened with
+// create when the first byte of it is written.
+type Writer struct {
+	name     string
+	partSize int64
+	create   func(index int) (io.Writer, error)
+
+	part      io.Writer
+	partHash  hash.Hash
+	partBytes int64
+
+	total    hash.Hash
+	manifest Manifest
+}
+
+// NewWriter returns a Writer for the layer name, whose parts are named by
+// PartName.
+func NewWriter(name string, partSize int64, create func(index int) (io.Writer, error)) *Writer {
+	return &Writer{
+		name:     name,
+		partSize: partSize,
+		create:   create,
+		total:    sha256.New(),
+		manifest: Manifest{PartSize: partSize, Parts: []Part{}},
+	}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.part == nil || w.partBytes == w.partSize {
+			if err := w.nextPart(); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := p[:min(int64(len(p)), w.partSize-w.partBytes)]
+		n, err := io.MultiWriter(w.part, w.partHash, w.total).Write(chunk)
+		w.partBytes += int64(n)
+		w.manifest.Size += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *Writer) nextPart() error {
+	w.finishPart()
+	index := len(w.manifest.Parts) + 1
+	part, err := w.create(index)
+	if err != nil {
+		return err
+	}
+	w.part = part
+	w.partHash = sha256.New()
+	w.partBytes = 0
+	w.manifest.Parts = append(w.manifest.Parts, Part{Index: index, Name: PartName(w.name, index)})
+	return nil
+}
+
+func (w *Writer) finishPart() {
+	if w.part == nil {
+		return
+	}
+	last := &w.manifest.Parts[len(w.manifest.Parts)-1]
+	last.Digest = digestOf(w.partHash)
+	last.Size = w.partBytes
+}
+
+// Manifest lists the parts written, once the whole layer has been.
+func (w *Writer) Manifest() Manifest {
+	w.finishPart()
+	m := w.manifest
+	m.Digest = digestOf(w.total)
+	m.Parts = append([]Part{}, w.manifest.Parts...)
+	return m
+}
+
+// VerifyPart reads r to its end and checks it is part.
+func VerifyPart(part Part, r io.Reader) error {
+	return copyPart(io.Discard, part, r)
+}
+
+// Join writes the layer split as m to w, reading each part from open. Each
+// part is verified as it is read and the whole layer once they all have
+// been, so w should only be kept once Join has succeeded.
+func Join(w io.Writer, m Manifest, open func(part Part) (io.ReadCloser, error)) error {
+	total := sha256.New()
+	var size int64
+	for i, part := range m.Parts {
+		if part.Index != i+1 {
+			return fmt.Errorf("%w: part %d is listed at position %d", ErrPartMismatch, part.Index, i+1)
+		}
+		r, err := open(part)
+		if err != nil {
+			return err
+		}
+		err = copyPart(io.MultiWriter(w, total), part, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		size += part.Size
+	}
+
+	if size != m.Size || digestOf(total) != m.Digest {
+		return fmt.Errorf("%w: expected %s (%d bytes), got %s (%d bytes)", ErrDigestMismatch, m.Digest, m.Size, digestOf(total), size)
+	}
+	return nil
+}
+
+func copyPart(w io.Writer, part Part, r io.Reader) error {
+	digest := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, digest), io.LimitReader(r, part.Size+1))
+	if err != nil {
+		return err
+	}
+	if n != part.Size || digestOf(digest) != part.Digest {
+		return fmt.Errorf("%w: part %d (%s) is not the expected %d bytes with digest %s", ErrPartMismatch, part.Index, part.Name, part.Size, part.Digest)
+	}
+	return nil
+}
+
+func digestOf(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,121 @@
+package split_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"code.cloudfoundry.org/diff-exporter/split"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func digestOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// splitLayer splits layer into parts of partSize, writing it in pieces of
+// 7 bytes so writes straddle the part boundaries.
+func splitLayer(layer []byte, partSize int64) (map[int]*bytes.Buffer, split.Manifest) {
+	parts := map[int]*bytes.Buffer{}
+	w := split.NewWriter("layer.tgz", partSize, func(index int) (io.Writer, error) {
+		parts[index] = &bytes.Buffer{}
+		return parts[index], nil
+	})
+	for i := 0; i < len(layer); i += 7 {
+		_, err := w.Write(layer[i:min(i+7, len(layer))])
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	}
+	return parts, w.Manifest()
+}
+
+func opener(parts map[int]*bytes.Buffer) func(split.Part) (io.ReadCloser, error) {
+	return func(part split.Part) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(parts[part.Index].Bytes())), nil
+	}
+}
+
+var _ = Describe("Split", func() {
+	var layer []byte
+
+	BeforeEach(func() {
+		layer = make([]byte, 100)
+		for i := range layer {
+			layer[i] = byte(i)
+		}
+	})
+
+	It("writes parts of at most the part size", func() {
+		parts, m := splitLayer(layer, 30)
+		Expect(parts).To(HaveLen(4))
+		Expect(parts[1].Bytes()).To(Equal(layer[:30]))
+		Expect(parts[4].Bytes()).To(Equal(layer[90:]))
+
+		Expect(m.Digest).To(Equal(digestOf(layer)))
+		Expect(m.Size).To(BeEquivalentTo(100))
+		Expect(m.PartSize).To(BeEquivalentTo(30))
+		Expect(m.Parts).To(HaveLen(4))
+		Expect(m.Parts[0]).To(Equal(split.Part{Index: 1, Name: "layer.tgz.part0001", Digest: digestOf(layer[:30]), Size: 30}))
+		Expect(m.Parts[3]).To(Equal(split.Part{Index: 4, Name: "layer.tgz.part0004", Digest: digestOf(layer[90:]), Size: 10}))
+	})
+
+	It("does not write an empty part when the layer fills the last one", func() {
+		parts, m := splitLayer(layer, 50)
+		Expect(parts).To(HaveLen(2))
+		Expect(m.Parts).To(HaveLen(2))
+	})
+
+	It("verifies each part on its own", func() {
+		parts, m := splitLayer(layer, 30)
+		Expect(split.VerifyPart(m.Parts[2], parts[3])).To(Succeed())
+
+		err := split.VerifyPart(m.Parts[2], parts[2])
+		Expect(errors.Is(err, split.ErrPartMismatch)).To(BeTrue())
+	})
+
+	Describe("Join", func() {
+		It("writes the layer back", func() {
+			parts, m := splitLayer(layer, 30)
+
+			var joined bytes.Buffer
+			Expect(split.Join(&joined, m, opener(parts))).To(Succeed())
+			Expect(joined.Bytes()).To(Equal(layer))
+		})
+
+		It("fails for a corrupted part", func() {
+			parts, m := splitLayer(layer, 30)
+			parts[2].Bytes()[0] = 'x'
+
+			err := split.Join(io.Discard, m, opener(parts))
+			Expect(errors.Is(err, split.ErrPartMismatch)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("part 2 (layer.tgz.part0002)"))
+		})
+
+		It("fails for a part that is too long", func() {
+			parts, m := splitLayer(layer, 30)
+			parts[4].WriteString("more")
+
+			err := split.Join(io.Discard, m, opener(parts))
+			Expect(errors.Is(err, split.ErrPartMismatch)).To(BeTrue())
+		})
+
+		It("fails for parts out of order", func() {
+			parts, m := splitLayer(layer, 30)
+			m.Parts[1], m.Parts[2] = m.Parts[2], m.Parts[1]
+
+			err := split.Join(io.Discard, m, opener(parts))
+			Expect(errors.Is(err, split.ErrPartMismatch)).To(BeTrue())
+		})
+
+		It("fails when a part is missing from the manifest", func() {
+			parts, m := splitLayer(layer, 30)
+			m.Parts = m.Parts[:3]
+
+			err := split.Join(io.Discard, m, opener(parts))
+			Expect(errors.Is(err, split.ErrDigestMismatch)).To(BeTrue())
+		})
+	})
+})
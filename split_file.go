@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/diff-exporter/layer"
+	"code.cloudfoundry.org/diff-exporter/split"
+)
+
+// writeSplitFiles writes the exported layer as parts of at most -splitSize
+// bytes next to outputFile, followed by the parts manifest. As with a single
+// output file, no part is left in place unless the whole export and the
+// manifest were written.
+func writeSplitFiles(ctx context.Context, exporter Exporter, opts layer.Options, cfg config) (layer.Result, error) {
+	if cfg.noClobber {
+		if err := checkNotExists(cfg.partsFile); err != nil {
+			return layer.Result{}, &stageError{stage: stageWrite, err: err}
+		}
+	}
+
+	parts := &partFiles{dir: filepath.Dir(cfg.outputFile)}
+	defer parts.remove()
+
+	splitter := split.NewWriter(filepath.Base(cfg.outputFile), int64(cfg.splitSize), parts.create)
+	result, err := writeTgzStream(ctx, exporter, opts, splitter)
+	if err != nil {
+		return result, err
+	}
+	if err := parts.commit(splitter.Manifest(), cfg.noClobber); err != nil {
+		return result, err
+	}
+
+	err = writeFileAtomically(cfg.partsFile, cfg.noClobber, func(w io.Writer) error {
+		return writeJSON(w, splitter.Manifest())
+	})
+	if err != nil {
+		return result, fmt.Errorf("Error writing parts file: %w", err)
+	}
+	parts.keep()
+	return result, nil
+}
+
+// partFiles are the temporary files a layer's parts are written to until
+// they are all renamed into place.
+type partFiles struct {
+	dir   string
+	files []*os.File
+	// renamed are the parts renamed into place, which are removed again
+	// unless the parts manifest is written too.
+	renamed []string
+}
+
+func (p *partFiles) create(index int) (io.Writer, error) {
+	if err := p.closeLast(); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(p.dir, fmt.Sprintf(".part%04d.*.tmp", index))
+	if err != nil {
+		return nil, &stageError{stage: stageWrite, err: fmt.Errorf("Error creating temporary file: %w", err)}
+	}
+	p.files = append(p.files, f)
+	return f, nil
+}
+
+// closeLast syncs and closes the part being written.
+func (p *partFiles) closeLast() error {
+	if len(p.files) == 0 {
+		return nil
+	}
+	f := p.files[len(p.files)-1]
+	if err := f.Sync(); err != nil {
+		return &stageError{stage: stageWrite, err: fmt.Errorf("Error syncing file: %w", err)}
+	}
+	if err := f.Close(); err != nil {
+		return &stageError{stage: stageWrite, err: fmt.Errorf("Error closing file: %w", err)}
+	}
+	return nil
+}
+
+// commit renames each part into place under the name m gives it.
+func (p *partFiles) commit(m split.Manifest, noClobber bool) error {
+	if err := p.closeLast(); err != nil {
+		return err
+	}
+	if noClobber {
+		for _, part := range m.Parts {
+			if err := checkNotExists(filepath.Join(p.dir, part.Name)); err != nil {
+				return &stageError{stage: stageWrite, err: err}
+			}
+		}
+	}
+
+	for i, part := range m.Parts {
+		name := filepath.Join(p.dir, part.Name)
+		if err := renameFile(p.files[i].Name(), name, noClobber); err != nil {
+			return &stageError{stage: stageWrite, err: err}
+		}
+		p.renamed = append(p.renamed, name)
+	}
+	p.files = nil
+	return nil
+}
+
+// keep leaves the parts renamed into place once the manifest listing them
+// has been written.
+func (p *partFiles) keep() {
+	p.renamed = nil
+}
+
+// remove deletes the parts, whether or not they have been renamed into
+// place, unless they have been kept.
+func (p *partFiles) remove() {
+	for _, f := range p.files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	for _, name := range p.renamed {
+		os.Remove(name)
+	}
+}
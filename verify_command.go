@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"code.cloudfoundry.org/diff-exporter/signing"
+)
+
+const (
+	verifySignatureCommand = "verify-signature"
+	verifySignatureUsage   = "USAGE: diff-exporter.exe verify-signature <-key publicKeyFile> <-layer layerFile | -digest digest> <-signature signatureFile> <-payload payloadFile> [-errorFormat text|json]"
+)
+
+type verifyConfig struct {
+	keyFile       string
+	layerFile     string
+	digest        string
+	signatureFile string
+	payloadFile   string
+	errorFormat   string
+}
+
+// runVerifySignature checks that a layer was signed with the private half of
+// a public key, exiting with exitVerify if it wasn't.
+func runVerifySignature(args []string) {
+	cfg, err := parseVerifyFlags(args)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, verifySignatureUsage)
+		os.Exit(0)
+	}
+	reporter := errorReporter{format: cfg.errorFormat, usage: verifySignatureUsage}
+	if err != nil {
+		reporter.exit(&stageError{stage: stageFlags, err: fmt.Errorf("Error parsing flags: %w", err)})
+	}
+
+	digest, err := verifySignature(cfg)
+	if err != nil {
+		reporter.exit(&stageError{stage: stageVerify, err: err})
+	}
+	fmt.Fprintf(os.Stderr, "Verified OK: %s\n", digest)
+}
+
+// verifySignature returns the digest whose signature it verified.
+func verifySignature(cfg verifyConfig) (string, error) {
+	pemBytes, err := os.ReadFile(cfg.keyFile)
+	if err != nil {
+		return "", fmt.Errorf("Error reading public key: %w", err)
+	}
+	key, err := signing.LoadPublicKey(pemBytes)
+	if err != nil {
+		return "", fmt.Errorf("Error loading public key: %w", err)
+	}
+	payload, err := os.ReadFile(cfg.payloadFile)
+	if err != nil {
+		return "", fmt.Errorf("Error reading payload: %w", err)
+	}
+	signature, err := os.ReadFile(cfg.signatureFile)
+	if err != nil {
+		return "", fmt.Errorf("Error reading signature: %w", err)
+	}
+
+	if cfg.layerFile != "" {
+		cfg.digest, err = fileDigest(cfg.layerFile)
+		if err != nil {
+			return "", fmt.Errorf("Error reading layer: %w", err)
+		}
+	}
+
+	if err := signing.VerifyDigest(key, payload, signature, cfg.digest); err != nil {
+		return "", fmt.Errorf("Error verifying signature: %w", err)
+	}
+	return cfg.digest, nil
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	digest := sha256.New()
+	if _, err := io.Copy(digest, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+func parseVerifyFlags(args []string) (verifyConfig, error) {
+	var cfg verifyConfig
+	flags := flag.NewFlagSet("diff-exporter verify-signature", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&cfg.keyFile, "key", "", "PEM encoded public key of the key the layer was signed with")
+	flags.StringVar(&cfg.layerFile, "layer", "", "Exported layer to check the signature of")
+	flags.StringVar(&cfg.digest, "digest", "", "Digest of the layer to check the signature of, instead of -layer")
+	flags.StringVar(&cfg.signatureFile, "signature", "", "File holding the base64 signature")
+	flags.StringVar(&cfg.payloadFile, "payload", "", "File holding the signed payload")
+	flags.StringVar(&cfg.errorFormat, "errorFormat", errorFormatText, "How to report errors on stderr: text or json")
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if err := checkErrorFormat(&cfg.errorFormat); err != nil {
+		return cfg, err
+	}
+	if cfg.keyFile == "" {
+		return cfg, errors.New("must provide public key to verify the signature with")
+	}
+	if (cfg.layerFile == "") == (cfg.digest == "") {
+		return cfg, errors.New("must provide either the layer or its digest")
+	}
+	if cfg.signatureFile == "" {
+		return cfg, errors.New("must provide signature file")
+	}
+	if cfg.payloadFile == "" {
+		return cfg, errors.New("must provide payload file")
+	}
+
+	return cfg, nil
+}
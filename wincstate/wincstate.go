@@ -0,0 +1,62 @@
+// Package wincstate finds a container's bundle from the state winc keeps
+// for it, so the exporter can be pointed at a container by id alone.
+package wincstate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/diff-exporter/layer/layerfmt"
+)
+
+// DefaultRoot is winc's default --root, where it keeps container state.
+const DefaultRoot = `C:\run\winc`
+
+const (
+	stateFile  = "state.json"
+	specConfig = "config.json"
+)
+
+// Errors returned when a container's bundle can't be found from winc's state.
+// They are wrapped with details; use errors.Is to check for them.
+var (
+	ErrStateNotFound = errors.New("container state not found")
+	ErrInvalidState  = errors.New("container state is not valid")
+	ErrStaleState    = errors.New("container state is stale")
+)
+
+// State is the part of winc's state.json the exporter needs.
+type State struct {
+	Bundle string `json:"Bundle"`
+}
+
+// BundlePath returns the bundle winc recorded for containerId under root.
+func BundlePath(root, containerId string) (string, error) {
+	if !layerfmt.ValidContainerId(containerId) {
+		return "", fmt.Errorf("%w: invalid container id %s", ErrStateNotFound, containerId)
+	}
+	path := filepath.Join(root, containerId, stateFile)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%w for container %s: %w", ErrStateNotFound, containerId, err)
+	}
+
+	var state State
+	if err := json.Unmarshal(content, &state); err != nil {
+		return "", fmt.Errorf("%w: %s: %w", ErrInvalidState, path, err)
+	}
+	if state.Bundle == "" {
+		return "", fmt.Errorf("%w: %s has no bundle", ErrInvalidState, path)
+	}
+
+	// winc leaves state behind if it is killed before cleaning up, so make
+	// sure the bundle it points at is still there.
+	if _, err := os.Stat(filepath.Join(state.Bundle, specConfig)); err != nil {
+		return "", fmt.Errorf("%w for container %s: %w", ErrStaleState, containerId, err)
+	}
+
+	return state.Bundle, nil
+}
@@ -0,0 +1,13 @@
+package wincstate_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestWincstate(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Wincstate Suite")
+}
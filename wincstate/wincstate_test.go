@@ -0,0 +1,38 @@
+package wincstate_test
+
+import (
+	"path/filepath"
+
+	"code.cloudfoundry.org/diff-exporter/wincstate"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BundlePath", func() {
+	var root string
+
+	BeforeEach(func() {
+		root = filepath.Join("testdata", "root")
+	})
+
+	It("returns the bundle winc recorded for the container", func() {
+		bundlePath, err := wincstate.BundlePath(root, "running")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bundlePath).To(Equal("testdata/bundles/running"))
+	})
+
+	DescribeTable("unusable state",
+		func(containerId string, expected error) {
+			_, err := wincstate.BundlePath(root, containerId)
+			Expect(err).To(MatchError(expected))
+			Expect(err).To(MatchError(ContainSubstring(containerId)))
+		},
+		Entry("for an unknown container", "unknown", wincstate.ErrStateNotFound),
+		Entry("with malformed json", "corrupt", wincstate.ErrInvalidState),
+		Entry("without a bundle", "no-bundle", wincstate.ErrInvalidState),
+		Entry("whose bundle has been deleted", "stale", wincstate.ErrStaleState),
+		Entry("whose bundle has no config.json", "missing-config", wincstate.ErrStaleState),
+		Entry("whose id climbs out of the root", `..\root\running`, wincstate.ErrStateNotFound),
+		Entry("whose id is a path", "running/../running", wincstate.ErrStateNotFound),
+	)
+})